@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/xoba/sms/audit"
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/store"
+)
+
+// RunInfo is what the audit log records about each run.
+type RunInfo struct {
+	Operator string
+	Host     string `json:",omitempty"`
+	Args     []string
+	Config   json.RawMessage
+	Revision string // git revision the binary was built from
+}
+
+// revision is the git revision of the build, with "+dirty" if there were
+// uncommitted changes.
+func revision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	var rev, dirty string
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision":
+			rev = s.Value
+		case s.Key == "vcs.modified" && s.Value == "true":
+			dirty = "+dirty"
+		}
+	}
+	if rev == "" {
+		return "unknown"
+	}
+	return rev + dirty
+}
+
+// startAudit records the run in the audit log, returning the log for
+// the rest of the run's entries.
+func startAudit(ctx context.Context, c Config, s store.Store) (*audit.Log, error) {
+	key, err := auditKey(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return audit.Start(ctx, s, key, RunInfo{
+		Operator: operator(),
+		Host:     host,
+		Args:     os.Args[1:],
+		Config:   json.RawMessage(c.String()),
+		Revision: revision(),
+	})
+}
+
+// auditKey unwraps the audit log's key with the store's KMS, given by
+// -keyfile or -kms; without either, the log is unkeyed.
+func auditKey(ctx context.Context, s store.Store) ([]byte, error) {
+	var kms store.KMS
+	if e, ok := s.(store.Encrypted); ok {
+		kms = e.KMS
+	}
+	return audit.LoadKey(ctx, s, kms)
+}
+
+// auditDecision identifies a decision in the audit log by its key rather
+// than its address, with any details given as name and value pairs.
+func auditDecision(d jin.Decision, kv ...interface{}) map[string]interface{} {
+	m := map[string]interface{}{
+		"decision": d.Key(),
+		"campaign": d.Campaign,
+		"patient":  d.Patient,
+		"channel":  d.Type(),
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		m[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	return m
+}
+
+// Audit checks the audit log:
+//
+//	-m audit verify
+//
+// reporting gaps in it and entries that were altered, and failing if
+// there are any.
+func Audit(ctx context.Context, c Config) error {
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("audit needs a command: verify")
+	}
+	switch cmd := args[0]; cmd {
+	case "verify":
+		key, err := auditKey(ctx, s)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			fmt.Println("verifying without a key, as for a log written without -keyfile or -kms")
+		}
+		n, head, problems, err := audit.Verify(ctx, s, key)
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if head != nil {
+			fmt.Printf("latest is entry %d at %s, with hash %s\n", head.Seq, head.Time.Format(time.RFC3339), head.Hash)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d problems in %d audit entries", len(problems), n)
+		}
+		fmt.Printf("%d audit entries verified\n", n)
+	default:
+		return fmt.Errorf("unknown audit command: %q", cmd)
+	}
+	return nil
+}
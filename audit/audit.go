@@ -0,0 +1,284 @@
+// Package audit keeps an append-only log in the store, each entry holding
+// the hash of the one before, so that removing, reordering or editing
+// entries can be detected.
+//
+// Given a key, the hashes are HMACs under it, so that only those holding
+// the key can write a chain that verifies. The key is itself kept in the
+// store wrapped by the store's KMS, and so is only as safe as access to
+// that KMS: anyone who can use it can rewrite the log whole. Without a
+// key, the hashes are plain SHA-256, which catches careless edits but not
+// someone rewriting the chain from the edit on.
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xoba/sms/store"
+)
+
+// Prefix is where the entries are kept, one object each.
+const Prefix = "audit"
+
+// KeyName is where the chain's key is kept, wrapped by the store's KMS.
+const KeyName = "audit-key.json"
+
+// Kinds of entry.
+const (
+	Run        = "run"        // a process starting, with who ran it and how
+	Considered = "considered" // a decision looked at for sending
+	Skipped    = "skipped"    // a decision not sent, and why
+	Sent       = "sent"       // a decision carried out, successfully or not
+	Status     = "status"     // a later update, like a bounce or a reconciliation
+)
+
+// Entry is one record in the chain.
+type Entry struct {
+	Seq  int64
+	Time time.Time
+	Run  string // id of the process that wrote it
+	Kind string
+	Data json.RawMessage `json:",omitempty"`
+	Prev string          // hash of the entry before, if any
+	Hash string          // of the entry with an empty Hash, keyed if there's a key
+}
+
+func (e Entry) hash(key []byte) (string, error) {
+	e.Hash = ""
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		h := sha256.Sum256(buf)
+		return hex.EncodeToString(h[:]), nil
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write(buf)
+	return hex.EncodeToString(m.Sum(nil)), nil
+}
+
+// wrappedKey is the chain's key as kept in the store.
+type wrappedKey struct {
+	KeyID string
+	Key   []byte
+}
+
+// LoadKey unwraps the chain's key with kms, first making one if the store
+// has none. With a nil kms there's no key, and the chain is unkeyed.
+func LoadKey(ctx context.Context, s store.Store, kms store.KMS) ([]byte, error) {
+	if kms == nil {
+		return nil, nil
+	}
+	buf, err := s.Get(ctx, KeyName)
+	if errors.Is(err, store.ErrNotFound) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		var w wrappedKey
+		if w.Key, w.KeyID, err = kms.Encrypt(ctx, key); err != nil {
+			return nil, err
+		}
+		if buf, err = json.Marshal(w); err != nil {
+			return nil, err
+		}
+		err = s.Create(ctx, KeyName, buf)
+		if err == nil {
+			return key, nil
+		} else if !errors.Is(err, store.ErrExists) {
+			return nil, err
+		}
+		// somebody else made one first
+		buf, err = s.Get(ctx, KeyName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var w wrappedKey
+	if err := json.Unmarshal(buf, &w); err != nil {
+		return nil, fmt.Errorf("can't unmarshal %s: %w", KeyName, err)
+	}
+	key, err := kms.Decrypt(ctx, w.Key, w.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("can't unwrap audit key: %w", err)
+	}
+	return key, nil
+}
+
+func key(seq int64) string {
+	return path.Join(Prefix, fmt.Sprintf("%012d.json", seq))
+}
+
+func parseKey(k string) (int64, bool) {
+	n, err := strconv.ParseInt(strings.TrimSuffix(path.Base(k), ".json"), 10, 64)
+	return n, err == nil
+}
+
+// Log appends entries for one process. A nil *Log appends nothing.
+type Log struct {
+	s    store.Store
+	key  []byte
+	run  string
+	mu   sync.Mutex
+	head *Entry
+}
+
+// Start begins a process's entries with a Run entry holding info, such
+// as the operator, config and revision, chained under key, as from
+// LoadKey.
+func Start(ctx context.Context, s store.Store, key []byte, info interface{}) (*Log, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	l := &Log{s: s, key: key, run: hex.EncodeToString(id)}
+	if err := l.Append(ctx, Run, info); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// RunID names the process's entries.
+func (l *Log) RunID() string {
+	if l == nil {
+		return ""
+	}
+	return l.run
+}
+
+func latest(ctx context.Context, s store.Store) (*Entry, error) {
+	keys, err := s.List(ctx, Prefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sort.Strings(keys)
+	return get(ctx, s, keys[len(keys)-1])
+}
+
+func get(ctx context.Context, s store.Store, k string) (*Entry, error) {
+	buf, err := s.Get(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return nil, fmt.Errorf("can't unmarshal %s: %w", k, err)
+	}
+	return &e, nil
+}
+
+// Append adds an entry after the latest one, whoever wrote it; entries are
+// created, never overwritten, so concurrent writers each get their own.
+func (l *Log) Append(ctx context.Context, kind string, data interface{}) error {
+	if l == nil {
+		return nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the entry must be written even as a run is being interrupted
+	ctx = context.WithoutCancel(ctx)
+	for tries := 0; ; tries++ {
+		if l.head == nil || tries > 0 {
+			if l.head, err = latest(ctx, l.s); err != nil {
+				return err
+			}
+		}
+		e := Entry{Seq: 1, Time: time.Now().UTC(), Run: l.run, Kind: kind, Data: raw}
+		if l.head != nil {
+			e.Seq, e.Prev = l.head.Seq+1, l.head.Hash
+		}
+		if e.Hash, err = e.hash(l.key); err != nil {
+			return err
+		}
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		err = l.s.Create(ctx, key(e.Seq), buf)
+		if errors.Is(err, store.ErrExists) && tries < 100 {
+			continue // somebody else appended first
+		} else if err != nil {
+			return fmt.Errorf("can't append to audit log: %w", err)
+		}
+		l.head = &e
+		return nil
+	}
+}
+
+// Verify checks the whole chain under key, returning the number of
+// entries, the latest one, and the problems found: gaps in the sequence,
+// entries whose contents don't match their hash, and links that don't
+// match the entry before. Entries removed from the end can only be caught
+// by comparing with a head recorded earlier.
+func Verify(ctx context.Context, s store.Store, key []byte) (int, *Entry, []string, error) {
+	keys, err := s.List(ctx, Prefix+"/")
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	sort.Strings(keys)
+	var problems []string
+	var prev *Entry
+	for _, k := range keys {
+		seq, ok := parseKey(k)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: not an entry", k))
+			continue
+		}
+		e, err := get(ctx, s, k)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if e.Seq != seq {
+			problems = append(problems, fmt.Sprintf("%s: holds entry %d", k, e.Seq))
+		}
+		if h, err := e.hash(key); err != nil || !hmac.Equal([]byte(h), []byte(e.Hash)) {
+			problems = append(problems, fmt.Sprintf("entry %d: contents don't match its hash", seq))
+		}
+		var first int64 = 1
+		if prev != nil {
+			first = prev.Seq + 1
+		}
+		switch {
+		case seq > first:
+			problems = append(problems, missing(first, seq-1))
+		case prev == nil && e.Prev != "":
+			problems = append(problems, "entry 1 links to an earlier entry")
+		case prev != nil && e.Prev != prev.Hash:
+			problems = append(problems, fmt.Sprintf("entry %d doesn't link to entry %d", seq, prev.Seq))
+		}
+		if prev != nil && e.Time.Before(prev.Time.Add(-time.Minute)) {
+			// a minute's grace for clock skew between runners
+			problems = append(problems, fmt.Sprintf("entry %d is dated before entry %d", seq, prev.Seq))
+		}
+		prev = e
+	}
+	return len(keys), prev, problems, nil
+}
+
+func missing(from, to int64) string {
+	if from == to {
+		return fmt.Sprintf("entry %d is missing", from)
+	}
+	return fmt.Sprintf("entries %d to %d are missing", from, to)
+}
@@ -0,0 +1,281 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xoba/sms/store"
+	"github.com/xoba/sms/store/s3test"
+)
+
+// testKey chains the tests' logs.
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newLog(t *testing.T, s store.Store, entries int) *Log {
+	t.Helper()
+	ctx := context.Background()
+	l, err := Start(ctx, s, testKey, map[string]string{"operator": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < entries; i++ {
+		if err := l.Append(ctx, Considered, map[string]int{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l
+}
+
+func verify(t *testing.T, s store.Store) (int, *Entry, []string) {
+	t.Helper()
+	n, head, problems, err := Verify(context.Background(), s, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, head, problems
+}
+
+func TestVerifyChain(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLog(t, s, 4)
+	n, head, problems := verify(t, s)
+	if n != 5 || len(problems) > 0 {
+		t.Fatalf("got %d entries, problems %q", n, problems)
+	}
+	if head.Seq != 5 || head.Run != l.RunID() || head.Kind != Considered {
+		t.Fatalf("head is %+v", head)
+	}
+	// a second run carries on the same chain
+	newLog(t, s, 1)
+	if n, head, problems = verify(t, s); n != 7 || head.Seq != 7 || len(problems) > 0 {
+		t.Fatalf("got %d entries, head %d, problems %q", n, head.Seq, problems)
+	}
+
+	var nothing *Log
+	if err := nothing.Append(context.Background(), Sent, "ignored"); err != nil || nothing.RunID() != "" {
+		t.Fatalf("nil log: %v", err)
+	}
+}
+
+func TestVerifyTampering(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		name   string
+		tamper func(s store.Store, e *Entry) error
+		want   string
+	}{
+		{
+			"edited",
+			func(s store.Store, e *Entry) error {
+				e.Data = json.RawMessage(`{"i":99}`)
+				return put(ctx, s, e)
+			},
+			"entry 3: contents don't match its hash",
+		},
+		{
+			"edited and rehashed",
+			func(s store.Store, e *Entry) error {
+				e.Data = json.RawMessage(`{"i":99}`)
+				var err error
+				if e.Hash, err = e.hash(testKey); err != nil {
+					return err
+				}
+				return put(ctx, s, e)
+			},
+			"entry 4 doesn't link to entry 3",
+		},
+		{
+			"rewritten without the key",
+			func(s store.Store, e *Entry) error {
+				e.Data = json.RawMessage(`{"i":99}`)
+				for seq := e.Seq; ; seq++ {
+					var err error
+					if e.Hash, err = e.hash(nil); err != nil {
+						return err
+					}
+					if err := put(ctx, s, e); err != nil {
+						return err
+					}
+					next, err := get(ctx, s, key(seq+1))
+					if errors.Is(err, store.ErrNotFound) {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					next.Prev, e = e.Hash, next
+				}
+			},
+			"entry 5: contents don't match its hash",
+		},
+		{
+			"removed",
+			func(s store.Store, e *Entry) error {
+				return s.Delete(ctx, key(e.Seq))
+			},
+			"entry 3 is missing",
+		},
+		{
+			"moved",
+			func(s store.Store, e *Entry) error {
+				buf, err := s.Get(ctx, key(e.Seq))
+				if err != nil {
+					return err
+				}
+				if err := s.Delete(ctx, key(e.Seq)); err != nil {
+					return err
+				}
+				return s.Put(ctx, key(9), buf)
+			},
+			"audit/000000000009.json: holds entry 3",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := store.NewDir(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			newLog(t, s, 4)
+			e, err := get(ctx, s, key(3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.tamper(s, e); err != nil {
+				t.Fatal(err)
+			}
+			_, _, problems := verify(t, s)
+			if !strings.Contains(strings.Join(problems, "\n"), c.want) {
+				t.Fatalf("problems %q lack %q", problems, c.want)
+			}
+		})
+	}
+}
+
+func put(ctx context.Context, s store.Store, e *Entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, key(e.Seq), buf)
+}
+
+// Separate runs appending at once to the same bucket each get their own
+// entries, and the chain stays whole.
+func TestConcurrentAppenders(t *testing.T) {
+	srv := httptest.NewServer(s3test.New("test"))
+	defer srv.Close()
+	c, err := s3test.Client(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewS3(c, "test")
+	const runs, entries = 4, 10
+	var wg sync.WaitGroup
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.Background()
+			l, err := Start(ctx, s, testKey, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j := 0; j < entries; j++ {
+				if err := l.Append(ctx, Sent, j); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	n, head, problems := verify(t, s)
+	if want := runs * (1 + entries); n != want || head.Seq != int64(want) || len(problems) > 0 {
+		t.Fatalf("got %d entries of %d, head %d, problems %q", n, want, head.Seq, problems)
+	}
+}
+
+// The key is made once and unwrapped by each run after; without a KMS,
+// the chain is unkeyed.
+func TestLoadKey(t *testing.T) {
+	ctx := context.Background()
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kms := func() store.KMS {
+		name := filepath.Join(t.TempDir(), "key.txt")
+		if err := store.NewKeyfile(name); err != nil {
+			t.Fatal(err)
+		}
+		k, err := store.LoadKeyfile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	if key, err := LoadKey(ctx, s, nil); key != nil || err != nil {
+		t.Fatalf("got %x, %v without a kms", key, err)
+	}
+	master := kms()
+	key, err := LoadKey(ctx, s, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := LoadKey(ctx, s, master); err != nil || !bytes.Equal(again, key) {
+		t.Fatalf("got %x, %v the second time; want %x", again, err, key)
+	}
+	if _, err := LoadKey(ctx, s, kms()); err == nil {
+		t.Fatal("unwrapped the key with another master key")
+	}
+
+	if _, err := Start(ctx, s, key, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		key  []byte
+		ok   bool
+	}{
+		{"the key", key, true},
+		{"no key", nil, false},
+		{"another key", testKey, false},
+	} {
+		_, _, problems, err := Verify(ctx, s, c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := len(problems) == 0; ok != c.ok {
+			t.Errorf("verified with %s: %q", c.name, problems)
+		}
+	}
+}
+
+// Without a key, the chain is still checked.
+func TestUnkeyed(t *testing.T) {
+	ctx := context.Background()
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Start(ctx, s, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(ctx, Sent, 1); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, problems, err := Verify(ctx, s, nil); n != 2 || len(problems) > 0 || err != nil {
+		t.Fatalf("got %d entries, problems %q, %v", n, problems, err)
+	}
+}
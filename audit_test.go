@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/xoba/sms/store"
+)
+
+// The audit log is keyed whenever the store is encrypted.
+func TestAuditKey(t *testing.T) {
+	ctx := context.Background()
+	dir, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := auditKey(ctx, dir); key != nil || err != nil {
+		t.Fatalf("got %x, %v for a plain store", key, err)
+	}
+	name := filepath.Join(t.TempDir(), "key.txt")
+	if err := store.NewKeyfile(name); err != nil {
+		t.Fatal(err)
+	}
+	kms, err := store.LoadKeyfile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := auditKey(ctx, store.Encrypted{Store: dir, KMS: kms}); len(key) != 32 || err != nil {
+		t.Fatalf("got %x, %v for an encrypted store", key, err)
+	}
+}
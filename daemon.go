@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/store"
+)
+
+// DaemonState is what the daemon is up to, as served at /state.
+type DaemonState struct {
+	Started     time.Time
+	Status      string    // planning, waiting, sending, idle, or done for the day
+	Source      string    `json:",omitempty"` // hash of the contact list last planned from
+	Planned     time.Time `json:",omitempty"`
+	Decisions   int       // planned
+	Escalations int       // due and not yet sent
+	Day         string
+	SentToday   int
+	Quota       int            // per day, if non-zero
+	Quotas      jin.Quotas     `json:",omitempty"`
+	Used        map[string]int `json:",omitempty"` // today, by channel, across campaigns
+	Next        time.Time      `json:",omitempty"` // when it next wakes up
+	LastError   string         `json:",omitempty"`
+}
+
+type daemonState struct {
+	sync.Mutex
+	DaemonState
+}
+
+func (d *daemonState) update(f func(*DaemonState)) {
+	d.Lock()
+	defer d.Unlock()
+	f(&d.DaemonState)
+}
+
+func (d *daemonState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.Lock()
+	buf, err := json.MarshalIndent(d.DaemonState, "", "  ")
+	d.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// Daemon runs the campaign unattended: during working hours it sends up
+// to -q contacts a day, within -quota for each channel, re-planning
+// whenever patients.csv changes, and once a campaign's Escalate delay
+// passes without a reply it tries the patient's other channels. STOP
+// replies are added to the suppression list every poll, and receipts get
+// twilio's price once it has one. Receipts are kept between polls, with
+// only new ones read, and all of them again hourly. Its state is served
+// at /state on -listen.
+func Daemon(ctx context.Context, c Config) error {
+	if c.Hertz > 2 {
+		return fmt.Errorf("too fast")
+	}
+	if c.Quantity <= 0 && len(c.Quotas) == 0 {
+		return fmt.Errorf("daemon needs a daily quota, -q or -quota")
+	}
+	delay, err := c.campaign.EscalateAfter()
+	if err != nil {
+		return err
+	}
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	provider, err := c.Provider(ctx, s)
+	if err != nil {
+		return err
+	}
+	if c.audit, err = startAudit(ctx, c, s); err != nil {
+		return err
+	}
+
+	state := &daemonState{DaemonState: DaemonState{Started: time.Now(), Quota: c.Quantity, Quotas: c.Quotas}}
+	ln, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/state", state)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	go server.Serve(ln)
+	slog.Info("serving daemon state", "url", c.Listen+"/state")
+
+	var (
+		source    [sha256.Size]byte
+		info      []jin.ContactInfo
+		decisions []jin.Decision
+		inbound   = time.Now().Add(-c.Since)
+		cache     = newReceiptCache(s, *c.campaign)
+	)
+	for {
+		err := func() error {
+			// suppress STOP replies before sending anything more
+			checked := time.Now()
+			messages, err := provider.Inbound(inbound)
+			if err != nil {
+				return err
+			}
+			if stops, err := jin.SuppressStops(ctx, s, messages); err != nil {
+				return err
+			} else if stops > 0 {
+				slog.Info("suppressed stop replies", "stops", stops)
+			}
+			// allow for clock skew between us and the provider
+			inbound = checked.Add(-time.Minute)
+
+			buf, err := s.Get(ctx, "patients.csv")
+			if err != nil {
+				return err
+			}
+			if h := sha256.Sum256(buf); h != source || decisions == nil {
+				state.update(func(d *DaemonState) { d.Status = "planning" })
+				if info, err = jin.LoadContacts(ctx, s); err != nil {
+					return err
+				}
+				if decisions, err = Plan(ctx, c, s, info); err != nil {
+					return err
+				}
+				source = h
+				state.update(func(d *DaemonState) {
+					d.Source = fmt.Sprintf("%x", h[:8])
+					d.Planned = time.Now()
+					d.Decisions = len(decisions)
+				})
+				slog.Info("planned", "decisions", len(decisions), "source", fmt.Sprintf("%x", h[:8]))
+			}
+
+			receipts, err := cache.update(ctx)
+			if err != nil {
+				return err
+			}
+			if n, err := refreshPrices(ctx, s, provider, *c.campaign, receipts); err != nil {
+				return err
+			} else if n > 0 {
+				slog.Info("priced receipts", "receipts", n)
+			}
+			today := time.Now().Format("2006-01-02")
+			contacted := make(map[string]time.Time)
+			var sent int
+			for _, r := range receipts {
+				if r.Time.Local().Format("2006-01-02") == today {
+					sent++
+				}
+				p := r.Decision.Patient
+				if t, ok := contacted[p]; r.Successful && p != "" && (!ok || r.Time.Before(t)) {
+					contacted[p] = r.Time
+				}
+			}
+			escalations, err := dueEscalations(ctx, c, s, info, contacted, delay)
+			if err != nil {
+				return err
+			}
+			used, err := jin.QuotaUsed(ctx, s, time.Now())
+			if err != nil {
+				return err
+			}
+			state.update(func(d *DaemonState) {
+				d.Day, d.SentToday, d.Escalations, d.Used = today, sent, len(escalations), used
+			})
+
+			switch {
+			case !WithinWorkingHours():
+				state.update(func(d *DaemonState) { d.Status = "waiting" })
+				return nil
+			case c.Quantity > 0 && sent >= c.Quantity:
+				state.update(func(d *DaemonState) { d.Status = "done for the day" })
+				return nil
+			case len(escalations) == 0 && !anyUndone(decisions, receipts):
+				state.update(func(d *DaemonState) { d.Status = "idle" })
+				return nil
+			}
+			state.update(func(d *DaemonState) { d.Status = "sending" })
+			quantity := len(escalations) + len(decisions)
+			if c.Quantity > 0 {
+				quantity = c.Quantity - sent
+			}
+			n, err := Send(ctx, c, s, provider, cache, append(escalations, decisions...), quantity)
+			state.update(func(d *DaemonState) {
+				d.SentToday += n
+				d.Status = "idle"
+			})
+			return err
+		}()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			// keep going, since the store or a provider may recover
+			slog.Error("daemon pass failed", "err", err)
+		}
+		setHealth(err)
+		if err != nil {
+			passFailures.Inc()
+		}
+		next := time.Now().Add(c.Poll)
+		state.update(func(d *DaemonState) {
+			d.Next = next
+			if err != nil {
+				d.LastError = jin.MaskText(err.Error())
+			}
+		})
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// dueEscalations returns the escalations whose delay has passed, less
+// suppressed addresses, in the order to send them.
+func dueEscalations(ctx context.Context, c Config, s store.Store, info []jin.ContactInfo, contacted map[string]time.Time, delay time.Duration) ([]jin.Decision, error) {
+	if delay <= 0 {
+		return nil, nil
+	}
+	replied, err := jin.RepliedPatients(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	due, err := jin.DueEscalations(info, contacted, replied, delay, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	suppressions, err := jin.LoadSuppressions(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	receipts, err := loadReceipts(ctx, s, *c.campaign)
+	if err != nil {
+		return nil, err
+	}
+	var out []jin.Decision
+	for _, d := range due {
+		d.Campaign = c.campaign.Name
+		if d.Suppressed(suppressions) != nil || receipts[d.Key()] || receipts[d.LegacyKey()] {
+			continue
+		}
+		out = append(out, d)
+	}
+	if err := c.campaign.CheckLanguages(out); err != nil {
+		return nil, err
+	}
+	prioritizers, err := jin.ParseOrder(c.Order, info, c.campaign.Estimator())
+	if err != nil {
+		return nil, err
+	}
+	jin.Prioritize(out, c.Seed, prioritizers...)
+	return out, nil
+}
+
+// anyUndone reports whether any decision lacks a receipt, under either
+// the current or the legacy key, as Send checks.
+func anyUndone(decisions []jin.Decision, receipts []*jin.Receipt) bool {
+	done := make(map[string]bool)
+	for _, r := range receipts {
+		done[r.Decision.Key()] = true
+		done[r.Decision.LegacyKey()] = true
+	}
+	for _, d := range decisions {
+		if !done[d.Key()] && !done[d.LegacyKey()] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/store"
+)
+
+// A decision done under its legacy key is done, as far as the daemon's
+// idling goes.
+func TestAnyUndone(t *testing.T) {
+	d := jin.NewSMS("+12126888887")
+	d.Campaign = "reminder"
+	legacy := jin.NewSMS("+12126888887") // written before campaigns
+	if d.Key() == legacy.Key() {
+		t.Fatal("keys should differ by campaign")
+	}
+	other := jin.NewEmail("a@example.com")
+	receipts := []*jin.Receipt{{Decision: legacy}}
+	if anyUndone([]jin.Decision{d}, receipts) {
+		t.Fatal("a legacy receipt left its decision undone")
+	}
+	if !anyUndone([]jin.Decision{d, other}, receipts) {
+		t.Fatal("missed a decision without a receipt")
+	}
+	if anyUndone(nil, nil) {
+		t.Fatal("nothing to do is all done")
+	}
+}
+
+// The daemon escalates only to patients who haven't replied, and not by
+// ways that are suppressed or already done.
+func TestDaemonDueEscalations(t *testing.T) {
+	ctx := context.Background()
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := filepath.Join(t.TempDir(), "message.txt")
+	if err := os.WriteFile(message, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	campaign := jin.Campaign{Name: "test", Message: message, TwimlURL: "https://example.com/twiml"}
+	c := Config{Order: "random", campaign: &campaign}
+
+	var info []jin.ContactInfo
+	contacted := make(map[string]time.Time)
+	for i, id := range []string{"due", "replied", "suppressed", "done"} {
+		info = append(info, jin.ContactInfo{ID: id, Preferred: jin.Email, Email: jin.Addr(id + "@example.com"), Home: jin.Phone(fmt.Sprintf("+12126888%03d", 880+i))})
+		contacted[id] = time.Now().Add(-4 * 24 * time.Hour)
+	}
+	if err := s.Put(ctx, "patients/replied.json", []byte(`{"ID":"replied","Replies":["r1"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	x, err := jin.NewSuppression(jin.SuppressPhone, string(info[2].Home), "asked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jin.AddSuppression(ctx, s, *x); err != nil {
+		t.Fatal(err)
+	}
+	done := jin.NewPhone(info[3].Home)
+	done.Campaign, done.Patient = campaign.Name, "done"
+	if err := markDone(ctx, s, campaign, &jin.Receipt{Time: time.Now(), Successful: true, Decision: done}); err != nil {
+		t.Fatal(err)
+	}
+
+	if list, err := dueEscalations(ctx, c, s, info, contacted, 0); err != nil || list != nil {
+		t.Fatalf("escalated %v, %v without a delay", list, err)
+	}
+	list, err := dueEscalations(ctx, c, s, info, contacted, 72*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Patient != "due" || list[0].Type() != "phone" || list[0].Campaign != "test" {
+		t.Fatalf("got %v", list)
+	}
+	if list, err = dueEscalations(ctx, c, s, info, contacted, 5*24*time.Hour); err != nil || len(list) != 0 {
+		t.Fatalf("escalated %v, %v before the delay", list, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/xoba/sms/store"
+)
+
+// Encrypt manages encryption of the store:
+//
+//	-m encrypt keygen -keyfile <file>
+//	-m encrypt all [prefix]
+//
+// where keygen makes a new local master key, and all encrypts the objects
+// still in the clear with -keyfile or -kms. Run all while nothing else is
+// writing to the store.
+func Encrypt(ctx context.Context, c Config) error {
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("encrypt needs a command: keygen or all")
+	}
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "keygen":
+		if c.Keyfile == "" {
+			return fmt.Errorf("keygen needs a -keyfile to write")
+		}
+		if err := store.NewKeyfile(c.Keyfile); err != nil {
+			return err
+		}
+		fmt.Printf("wrote a new key to %s; keep it safe, since the store can't be read without it\n", c.Keyfile)
+	case "all":
+		s, err := c.OpenStore()
+		if err != nil {
+			return err
+		}
+		e, ok := s.(store.Encrypted)
+		if !ok || e.KMS == nil {
+			return errors.New("encrypting needs -keyfile or -kms")
+		}
+		var prefix string
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+		n, skipped, err := e.EncryptAll(ctx, prefix)
+		fmt.Printf("encrypted %d objects, %d already were\n", n, skipped)
+		return err
+	default:
+		return fmt.Errorf("unknown encrypt command: %q", cmd)
+	}
+	return nil
+}
@@ -1,10 +1,11 @@
 module github.com/xoba/sms
 
-go 1.19
+go 1.21
 
 require (
 	github.com/aws/aws-sdk-go v1.44.167
 	github.com/kevinburke/twilio-go v0.0.0-20221122012537-65f3dd7539e2
+	github.com/ttacon/libphonenumber v1.2.1
 	golang.org/x/time v0.3.0
 )
 
@@ -15,7 +16,6 @@ require (
 	github.com/kevinburke/go-types v0.0.0-20210723172823-2deba1f80ba7 // indirect
 	github.com/kevinburke/rest v0.0.0-20210506044642-5611499aa33c // indirect
 	github.com/ttacon/builder v0.0.0-20170518171403-c099f663e1c2 // indirect
-	github.com/ttacon/libphonenumber v1.2.1 // indirect
 	golang.org/x/net v0.4.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/text v0.5.0 // indirect
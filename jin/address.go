@@ -0,0 +1,280 @@
+package jin
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// states maps usps state codes to names, including dc, territories and
+// military addresses.
+var states = map[string]string{
+	"AL": "Alabama", "AK": "Alaska", "AZ": "Arizona", "AR": "Arkansas",
+	"CA": "California", "CO": "Colorado", "CT": "Connecticut", "DE": "Delaware",
+	"DC": "District of Columbia", "FL": "Florida", "GA": "Georgia", "HI": "Hawaii",
+	"ID": "Idaho", "IL": "Illinois", "IN": "Indiana", "IA": "Iowa",
+	"KS": "Kansas", "KY": "Kentucky", "LA": "Louisiana", "ME": "Maine",
+	"MD": "Maryland", "MA": "Massachusetts", "MI": "Michigan", "MN": "Minnesota",
+	"MS": "Mississippi", "MO": "Missouri", "MT": "Montana", "NE": "Nebraska",
+	"NV": "Nevada", "NH": "New Hampshire", "NJ": "New Jersey", "NM": "New Mexico",
+	"NY": "New York", "NC": "North Carolina", "ND": "North Dakota", "OH": "Ohio",
+	"OK": "Oklahoma", "OR": "Oregon", "PA": "Pennsylvania", "RI": "Rhode Island",
+	"SC": "South Carolina", "SD": "South Dakota", "TN": "Tennessee", "TX": "Texas",
+	"UT": "Utah", "VT": "Vermont", "VA": "Virginia", "WA": "Washington",
+	"WV": "West Virginia", "WI": "Wisconsin", "WY": "Wyoming",
+	"AS": "American Samoa", "GU": "Guam", "MP": "Northern Mariana Islands",
+	"PR": "Puerto Rico", "VI": "Virgin Islands", "FM": "Micronesia",
+	"MH": "Marshall Islands", "PW": "Palau",
+	"AA": "Armed Forces Americas", "AE": "Armed Forces Europe", "AP": "Armed Forces Pacific",
+}
+
+var stateCodes = func() map[string]string {
+	m := make(map[string]string)
+	for k, v := range states {
+		m[strings.ToUpper(v)] = k
+	}
+	return m
+}()
+
+// suffixes are usps street suffix abbreviations, from publication 28,
+// along with common variants people write.
+var suffixes = map[string]string{
+	"ALLEY": "ALY", "ALLY": "ALY", "ANNEX": "ANX", "AVENUE": "AVE", "AV": "AVE", "AVEN": "AVE",
+	"BEACH": "BCH", "BOULEVARD": "BLVD", "BOUL": "BLVD", "BRIDGE": "BRG", "BYPASS": "BYP",
+	"CAUSEWAY": "CSWY", "CENTER": "CTR", "CENTRE": "CTR", "CIRCLE": "CIR", "CIRC": "CIR",
+	"CONCOURSE": "CONC", "COURT": "CT", "COURTS": "CTS", "COVE": "CV", "CRESCENT": "CRES",
+	"CROSSING": "XING", "DRIVE": "DR", "DRIV": "DR", "DRV": "DR", "ESTATES": "ESTS",
+	"EXPRESSWAY": "EXPY", "EXPRESS": "EXPY", "EXTENSION": "EXT", "FREEWAY": "FWY",
+	"GARDENS": "GDNS", "GARDEN": "GDN", "GROVE": "GRV", "HARBOR": "HBR", "HEIGHTS": "HTS",
+	"HIGHWAY": "HWY", "HIWAY": "HWY", "HILL": "HL", "HILLS": "HLS", "HOLLOW": "HOLW",
+	"ISLAND": "IS", "JUNCTION": "JCT", "LAKE": "LK", "LANDING": "LNDG", "LANE": "LN",
+	"LOOP": "LOOP", "MANOR": "MNR", "MEADOWS": "MDWS", "MOUNT": "MT", "MOUNTAIN": "MTN",
+	"PARKWAY": "PKWY", "PARKWY": "PKWY", "PKY": "PKWY", "PLACE": "PL", "PLAZA": "PLZ",
+	"POINT": "PT", "PORT": "PRT", "RIDGE": "RDG", "ROAD": "RD", "ROUTE": "RTE",
+	"SQUARE": "SQ", "STREET": "ST", "STR": "ST", "STRT": "ST", "TERRACE": "TER",
+	"TRAIL": "TRL", "TURNPIKE": "TPKE", "VALLEY": "VLY", "VIADUCT": "VIA", "VIEW": "VW",
+	"VILLAGE": "VLG", "VISTA": "VIS", "WALK": "WALK", "WAY": "WAY",
+	// already abbreviated
+	"ALY": "ALY", "AVE": "AVE", "BLVD": "BLVD", "CIR": "CIR", "CT": "CT", "DR": "DR",
+	"EXPY": "EXPY", "HWY": "HWY", "LN": "LN", "PKWY": "PKWY", "PL": "PL", "PLZ": "PLZ",
+	"RD": "RD", "SQ": "SQ", "ST": "ST", "TER": "TER", "TPKE": "TPKE", "TRL": "TRL",
+}
+
+var directionals = map[string]string{
+	"NORTH": "N", "SOUTH": "S", "EAST": "E", "WEST": "W",
+	"NORTHEAST": "NE", "NORTHWEST": "NW", "SOUTHEAST": "SE", "SOUTHWEST": "SW",
+	"N": "N", "S": "S", "E": "E", "W": "W", "NE": "NE", "NW": "NW", "SE": "SE", "SW": "SW",
+}
+
+var units = map[string]string{
+	"APARTMENT": "APT", "APT": "APT", "SUITE": "STE", "STE": "STE", "FLOOR": "FL",
+	"FL": "FL", "ROOM": "RM", "RM": "RM", "BUILDING": "BLDG", "BLDG": "BLDG",
+	"UNIT": "UNIT", "DEPARTMENT": "DEPT", "DEPT": "DEPT", "BASEMENT": "BSMT",
+	"FRONT": "FRNT", "REAR": "REAR", "LOWER": "LOWR", "UPPER": "UPPR", "PENTHOUSE": "PH",
+	"SPACE": "SPC", "LOT": "LOT", "TRAILER": "TRLR",
+}
+
+//go:embed zip3.txt
+var zip3Table string
+
+// zip3 maps the first three digits of a zip code to the states it's used in.
+var zip3 = func() map[int][]string {
+	m := make(map[int][]string)
+	s := bufio.NewScanner(strings.NewReader(zip3Table))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		lo, err1 := strconv.Atoi(f[0])
+		hi, err2 := strconv.Atoi(f[1])
+		if err1 != nil || err2 != nil || len(f) < 3 {
+			panic(fmt.Errorf("bad zip3 line: %q", s.Text()))
+		}
+		for i := lo; i <= hi; i++ {
+			m[i] = append(m[i], f[2:]...)
+		}
+	}
+	return m
+}()
+
+// NormalizeState returns the usps code for a state code or name.
+func NormalizeState(s string) (string, bool) {
+	s = strings.ToUpper(strings.Join(strings.Fields(strings.ReplaceAll(s, ".", "")), " "))
+	if _, ok := states[s]; ok {
+		return s, true
+	}
+	code, ok := stateCodes[s]
+	return code, ok
+}
+
+var zipRegexp = regexp.MustCompile(`^(\d{5})(?:-?(\d{4}))?$`)
+
+// NormalizeZip formats a zip or zip+4 as 12345 or 12345-6789, restoring
+// leading zeros dropped by spreadsheets.
+func NormalizeZip(z string) (string, bool) {
+	z = strings.ReplaceAll(strings.TrimSpace(z), " ", "")
+	if n := len(z); n == 4 || n == 8 || (n == 9 && z[4] == '-') {
+		z = "0" + z
+	}
+	m := zipRegexp.FindStringSubmatch(z)
+	if m == nil || m[1] == "00000" {
+		return z, false
+	}
+	if m[2] != "" {
+		return m[1] + "-" + m[2], true
+	}
+	return m[1], true
+}
+
+// ZipMatchesState checks a normalized zip against the embedded table.
+func ZipMatchesState(zip, state string) bool {
+	n, err := strconv.Atoi(zip[:3])
+	if err != nil {
+		return false
+	}
+	for _, s := range zip3[n] {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeLine uppercases an address line and applies usps
+// abbreviations: the street suffix, directionals and unit designators.
+// Words that could be either are left as written unless their place in
+// the line says which they are, so "100 Front Street" and "200 West End
+// Avenue" keep their names.
+func normalizeLine(line string) string {
+	line = strings.NewReplacer(".", "", ",", " ").Replace(strings.ToUpper(line))
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return ""
+	}
+	// a line of just the unit, like "apartment 4b"
+	if isUnit(words, 0) {
+		if u, ok := units[words[0]]; ok {
+			words[0] = u
+		}
+		return strings.Join(words, " ")
+	}
+	// the unit designator and what follows it aren't part of the street;
+	// a designator word comes after the suffix, as in "12 main st apt 3",
+	// while a "#" can follow any street, as in "12 broadway #3"
+	street := len(words)
+	for i := 2; i < len(words); i++ {
+		if isUnit(words, i) && (strings.HasPrefix(words[i], "#") || hasSuffix(words[:i])) {
+			if u, ok := units[words[i]]; ok {
+				words[i] = u
+			}
+			street = i
+			break
+		}
+	}
+	s := words[:street]
+	// a trailing directional, as in "main st w"
+	last := len(s) - 1
+	if d, ok := directionals[s[last]]; ok && last >= 3 && suffixes[s[last-1]] != "" {
+		s[last] = d
+		last--
+	}
+	// the suffix needs a name between it and the number
+	if x, ok := suffixes[s[last]]; ok && last >= 2 {
+		s[last] = x
+	}
+	// a leading directional before a numbered street, as in "w 57th st";
+	// before a name, like "west end ave", it may be the name itself
+	if len(s) >= 4 && strings.ContainsAny(s[2], "0123456789") {
+		if d, ok := directionals[s[1]]; ok {
+			s[1] = d
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// isUnit tells whether words[i] starts a unit: a designator followed by
+// its identifier, like "apt 4b" or "fl 2", or a "#" number.
+func isUnit(words []string, i int) bool {
+	w := words[i]
+	if strings.HasPrefix(w, "#") {
+		return len(w) > 1 || i+1 < len(words)
+	}
+	if _, ok := units[w]; !ok || i+1 >= len(words) {
+		return false
+	}
+	id := words[i+1]
+	return strings.HasPrefix(id, "#") || len(id) == 1 || strings.ContainsAny(id, "0123456789")
+}
+
+// hasSuffix tells whether a street, number first, ends in a suffix,
+// perhaps followed by a directional.
+func hasSuffix(s []string) bool {
+	last := len(s) - 1
+	if _, ok := directionals[s[last]]; ok && last >= 3 {
+		last--
+	}
+	_, ok := suffixes[s[last]]
+	return ok && last >= 2
+}
+
+var (
+	streetNumber = regexp.MustCompile(`^\d+[A-Z]?(-\d+)?\b`)
+	poBox        = regexp.MustCompile(`^(?:P ?O ?|POST OFFICE )?BOX (\d+)`)
+	placeholder  = regexp.MustCompile(`\b(UNKNOWN|UNK|N/?A|NONE|SAME|HOMELESS|TEST|XX+|RETURN(ED)? TO SENDER|RTS|BAD ADDRESS|MOVED|DECEASED|NO ADDRESS)\b`)
+)
+
+// NormalizeAddress standardizes an address to usps conventions, returning
+// the problems that make it look undeliverable, if any.
+func NormalizeAddress(a PostalAddress) (PostalAddress, []string) {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	a.Address1 = normalizeLine(a.Address1)
+	a.Address2 = normalizeLine(a.Address2)
+	a.City = strings.ToUpper(strings.Join(strings.Fields(strings.ReplaceAll(a.City, ".", "")), " "))
+	// a unit alone on the first line belongs on the second, and vice versa
+	if a.Address2 != "" && streetNumber.MatchString(a.Address2) && !streetNumber.MatchString(a.Address1) {
+		a.Address1, a.Address2 = a.Address2, a.Address1
+	}
+
+	switch {
+	case a.Address1 == "":
+		problem("no street address")
+	case poBox.MatchString(a.Address1):
+		a.Address1 = poBox.ReplaceAllString(a.Address1, "PO BOX $1")
+	case !streetNumber.MatchString(a.Address1):
+		problem("no street number")
+	}
+	for _, s := range []string{a.Address1, a.Address2, a.City} {
+		if placeholder.MatchString(s) {
+			problem("placeholder %q", placeholder.FindString(s))
+		}
+	}
+	if a.City == "" {
+		problem("no city")
+	}
+
+	if a.State == "" {
+		problem("no state")
+	} else if s, ok := NormalizeState(a.State); ok {
+		a.State = s
+	} else {
+		problem("unknown state %q", a.State)
+	}
+	if a.Zip == "" {
+		problem("no zip")
+	} else if z, ok := NormalizeZip(a.Zip); ok {
+		a.Zip = z
+		if _, ok := states[a.State]; ok && !ZipMatchesState(z, a.State) {
+			problem("zip %s isn't in %s", z, a.State)
+		}
+	} else {
+		problem("bad zip %q", a.Zip)
+	}
+	return a, problems
+}
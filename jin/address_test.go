@@ -0,0 +1,91 @@
+package jin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeLine(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                          "",
+		"123 Main Street":           "123 MAIN ST",
+		"123 main st.":              "123 MAIN ST",
+		"100 Front Street":          "100 FRONT ST",
+		"12 Lower Road":             "12 LOWER RD",
+		"55 Upper Mountain Avenue":  "55 UPPER MOUNTAIN AVE",
+		"200 West End Avenue":       "200 WEST END AVE",
+		"200 West 57th Street":      "200 W 57TH ST",
+		"10 East Main Street":       "10 EAST MAIN ST",
+		"9 South Street":            "9 SOUTH ST",
+		"12 Main Street West":       "12 MAIN ST W",
+		"5 Avenue North":            "5 AVENUE NORTH",
+		"1 Park Avenue, Suite 200":  "1 PARK AVE STE 200",
+		"12 Main St Apartment 4B":   "12 MAIN ST APT 4B",
+		"12 Main St W Floor 3":      "12 MAIN ST W FL 3",
+		"12 Main St Rear":           "12 MAIN ST REAR",
+		"30 Lot Road":               "30 LOT RD",
+		"44 Unit Street Unit 5":     "44 UNIT ST UNIT 5",
+		"123 Broadway #4":           "123 BROADWAY #4",
+		"123 Broadway Apt. 4":       "123 BROADWAY APT 4",
+		"7 Upper Drive Front # 2":   "7 UPPER DR FRNT # 2",
+		"Apartment 4B":              "APT 4B",
+		"Suite 200":                 "STE 200",
+		"#12":                       "#12",
+		"Front":                     "FRONT",
+		"Rear Building":             "REAR BUILDING",
+		"Floor 2":                   "FL 2",
+		"80 Mount Vernon Boulevard": "80 MOUNT VERNON BLVD",
+	} {
+		if got := normalizeLine(in); got != want {
+			t.Errorf("normalizeLine(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for _, c := range []struct {
+		in       PostalAddress
+		want     PostalAddress
+		problems int
+	}{
+		{
+			PostalAddress{Address1: "Apt 3", Address2: "100 Front Street", City: "new york", State: "new york", Zip: "10038"},
+			PostalAddress{Address1: "100 FRONT ST", Address2: "APT 3", City: "NEW YORK", State: "NY", Zip: "10038"},
+			0,
+		},
+		{
+			PostalAddress{Address1: "P.O. Box 12", City: "Newark", State: "NJ", Zip: "7102"},
+			PostalAddress{Address1: "PO BOX 12", City: "NEWARK", State: "NJ", Zip: "07102"},
+			0,
+		},
+		{
+			PostalAddress{Address1: "Homeless", City: "New York", State: "NY", Zip: "90210"},
+			PostalAddress{Address1: "HOMELESS", City: "NEW YORK", State: "NY", Zip: "90210"},
+			3, // no street number, placeholder, zip not in ny
+		},
+	} {
+		got, problems := NormalizeAddress(c.in)
+		if !reflect.DeepEqual(got, c.want) || len(problems) != c.problems {
+			t.Errorf("NormalizeAddress(%v) = %v, %q", c.in, got, problems)
+		}
+	}
+}
+
+func TestNormalizeZip(t *testing.T) {
+	for in, want := range map[string]string{
+		"10038":      "10038",
+		"7102":       "07102",
+		"100381234":  "10038-1234",
+		"10038-1234": "10038-1234",
+		"7102-1234":  "07102-1234",
+	} {
+		if got, ok := NormalizeZip(in); !ok || got != want {
+			t.Errorf("NormalizeZip(%q) = %q, %v", in, got, ok)
+		}
+	}
+	for _, in := range []string{"", "00000", "1234567", "abcde"} {
+		if _, ok := NormalizeZip(in); ok {
+			t.Errorf("NormalizeZip(%q) passed", in)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package jin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/xoba/sms/saws"
+)
+
+// CampaignDir holds one json definition per named campaign.
+const CampaignDir = "campaigns"
+
+// DefaultCampaign is the original outreach run, whose receipts predate
+// campaigns and live directly under "receipts/".
+const DefaultCampaign = "default"
+
+// Campaign is a named mailing with its own message, config and receipt
+// namespace, so the same contact list can be used for distinct outreach runs.
+type Campaign struct {
+	Name     string
+	Subject  string  `json:",omitempty"` // email subject
+	Message  string  `json:",omitempty"` // path to message text
+	HTML     string  `json:",omitempty"` // path to html email template, if any
+	TwimlURL string  `json:",omitempty"`
+	Quantity int     `json:",omitempty"` // default for -q
+	Hertz    float64 `json:",omitempty"` // default for -f
+	Budget   float64 `json:",omitempty"` // default for -budget
+	Order    string  `json:",omitempty"` // default for -order
+	Escalate string  `json:",omitempty"` // delay, like 72h, before trying other ways to reach patients who haven't replied
+	Quotas   Quotas  `json:",omitempty"` // default for -quota
+	Deadline string  `json:",omitempty"` // words of the message bolded in html email, like "before sept 30th"
+
+	Attachments     []string `json:",omitempty"` // paths of files to attach, like pdf forms
+	Inline          []string `json:",omitempty"` // paths of images, referenced in html as cid:<base name>
+	ReplyTo         string   `json:",omitempty"`
+	ListUnsubscribe string   `json:",omitempty"` // mailto: or https: url
+
+	// Language is that of the files above; translations sit alongside
+	// them, like message.es.txt, as found by Localized.
+	Language  string            `json:",omitempty"`
+	Subjects  map[string]string `json:",omitempty"` // by language
+	Deadlines map[string]string `json:",omitempty"` // by language
+	Voices    map[string]Voice  `json:",omitempty"` // by language, overriding the defaults
+}
+
+func (c Campaign) String() string {
+	buf, _ := json.Marshal(c)
+	return string(buf)
+}
+
+// Key returns the campaign's own store key for name.
+func (c Campaign) Key(name string) string {
+	if c.Name == DefaultCampaign {
+		return name
+	}
+	return path.Join("campaigns", c.Name, name)
+}
+
+// ReceiptPrefix is where receipts for this campaign are stored.
+func (c Campaign) ReceiptPrefix() string {
+	return c.Key("receipts")
+}
+
+func (c Campaign) LoadMessage() (string, error) {
+	return LoadMessageFile(c.Message)
+}
+
+// HTMLData is what the html email template is executed with.
+type HTMLData struct {
+	Subject    string
+	Text       string          // the plain text message
+	Paragraphs []template.HTML // of Text, with phone numbers and emails linked and the deadline bolded
+}
+
+// contactLink matches the email addresses and phone numbers in a message.
+var contactLink = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+|\(?\b\d{3}\)?[-. ]?\d{3}[-. ]\d{4}\b`)
+
+// linkParagraph escapes a paragraph of the plain text message for html,
+// making its email addresses and phone numbers clickable and the
+// deadline, if any, bold.
+func linkParagraph(p, deadline string) template.HTML {
+	p = template.HTMLEscapeString(strings.Join(strings.Fields(p), " "))
+	if deadline = template.HTMLEscapeString(strings.Join(strings.Fields(deadline), " ")); deadline != "" {
+		p = strings.ReplaceAll(p, deadline, "<strong>"+deadline+"</strong>")
+	}
+	p = contactLink.ReplaceAllStringFunc(p, func(s string) string {
+		if strings.Contains(s, "@") {
+			return fmt.Sprintf(`<a href="mailto:%s">%s</a>`, s, s)
+		}
+		n, err := CleanNumber(s)
+		if err != nil {
+			return s
+		}
+		return fmt.Sprintf(`<a href="tel:%s">%s</a>`, n, s)
+	})
+	return template.HTML(p)
+}
+
+// RenderHTML executes the campaign's html template on text, the
+// (possibly localized) plain text message, returning "" if it has none.
+// The template lays out .Paragraphs rather than carrying its own wording,
+// so both parts of an email always say the same thing.
+func (c Campaign) RenderHTML(text string) (string, error) {
+	if c.HTML == "" {
+		return "", nil
+	}
+	t, err := template.ParseFiles(c.HTML)
+	if err != nil {
+		return "", err
+	}
+	w := new(bytes.Buffer)
+	data := HTMLData{Subject: c.Subject, Text: text}
+	for _, p := range strings.Split(text, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			data.Paragraphs = append(data.Paragraphs, linkParagraph(p, c.Deadline))
+		}
+	}
+	if err := t.Execute(w, data); err != nil {
+		return "", err
+	}
+	return w.String(), nil
+}
+
+// Email assembles the campaign's email to the given address, with text
+// as the plain part.
+func (c Campaign) Email(to, text string) (*saws.Email, error) {
+	html, err := c.RenderHTML(text)
+	if err != nil {
+		return nil, err
+	}
+	e := saws.Email{
+		From:    EmailSender,
+		To:      to,
+		ReplyTo: c.ReplyTo,
+		Subject: c.Subject,
+		Text:    text,
+		HTML:    html,
+	}
+	if c.ListUnsubscribe != "" {
+		e.Headers = map[string]string{"List-Unsubscribe": "<" + c.ListUnsubscribe + ">"}
+	}
+	load := func(name string) (saws.Attachment, error) {
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			return saws.Attachment{}, fmt.Errorf("can't load attachment: %w", err)
+		}
+		return saws.NewAttachment(name, buf), nil
+	}
+	for _, n := range c.Attachments {
+		a, err := load(n)
+		if err != nil {
+			return nil, err
+		}
+		e.Attachments = append(e.Attachments, a)
+	}
+	for _, n := range c.Inline {
+		a, err := load(n)
+		if err != nil {
+			return nil, err
+		}
+		a.ContentID = a.Name
+		e.Inline = append(e.Inline, a)
+	}
+	return &e, nil
+}
+
+func (c Campaign) Validate() error {
+	switch {
+	case c.Name == "":
+		return fmt.Errorf("campaign has no name")
+	case strings.ContainsAny(c.Name, "/ "):
+		return fmt.Errorf("illegal campaign name: %q", c.Name)
+	case c.Subject == "":
+		return fmt.Errorf("campaign %q has no subject", c.Name)
+	case c.Message == "":
+		return fmt.Errorf("campaign %q has no message", c.Name)
+	case c.TwimlURL == "":
+		return fmt.Errorf("campaign %q has no twiml url", c.Name)
+	case strings.ContainsAny(c.ReplyTo+c.ListUnsubscribe, "\r\n<>"):
+		return fmt.Errorf("campaign %q has an illegal header", c.Name)
+	}
+	if _, err := c.EscalateAfter(); err != nil {
+		return err
+	}
+	for _, n := range append(c.Attachments, c.Inline...) {
+		if _, err := os.Stat(n); err != nil {
+			return fmt.Errorf("campaign %q: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+func newDefaultCampaign() Campaign {
+	return Campaign{
+		Name:     DefaultCampaign,
+		Subject:  EmailSubject,
+		Message:  "message.txt",
+		HTML:     "message.html",
+		TwimlURL: TwimlURL,
+		Deadline: "ASAP before sept 30th",
+	}
+}
+
+// LoadCampaign reads campaigns/<name>.json, filling in unset fields from
+// the default campaign.
+func LoadCampaign(name string) (*Campaign, error) {
+	c := newDefaultCampaign()
+	if name == "" || name == DefaultCampaign {
+		return &c, nil
+	}
+	buf, err := os.ReadFile(filepath.Join(CampaignDir, name+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("can't load campaign %q: %w", name, err)
+	}
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, fmt.Errorf("can't unmarshal campaign %q: %w", name, err)
+	}
+	if c.Name != name {
+		return nil, fmt.Errorf("campaign file %q is named %q", name, c.Name)
+	}
+	// a deadline belongs to its message
+	if def := newDefaultCampaign(); c.Message != def.Message && c.Deadline == def.Deadline {
+		c.Deadline = ""
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ListCampaigns returns the default campaign followed by every named
+// campaign in CampaignDir, sorted by name.
+func ListCampaigns() ([]Campaign, error) {
+	names, err := filepath.Glob(filepath.Join(CampaignDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	out := []Campaign{newDefaultCampaign()}
+	for _, n := range names {
+		c, err := LoadCampaign(strings.TrimSuffix(filepath.Base(n), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *c)
+	}
+	return out, nil
+}
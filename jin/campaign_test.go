@@ -0,0 +1,152 @@
+package jin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLinkParagraph(t *testing.T) {
+	got := string(linkParagraph("Text # 516-500-1279,\nemail dr2127588851@gmail.com <or> call (212)-688-8887", ""))
+	want := `Text # <a href="tel:+15165001279">516-500-1279</a>, email <a href="mailto:dr2127588851@gmail.com">dr2127588851@gmail.com</a> &lt;or&gt; call <a href="tel:+12126888887">(212)-688-8887</a>`
+	if got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+}
+
+// The html part must carry the wording of whatever text it's given, so a
+// translated email isn't sent with the english html.
+func TestEmailHTMLFollowsText(t *testing.T) {
+	for _, name := range []string{"../message.html", "../campaigns/letterhead.html"} {
+		c := Campaign{Name: "test", Subject: "Aviso", HTML: name}
+		text := "Oficina de la Dra. Qiu\n\nTexto 516-500-1279\n\nLa doctora cierra\nsu consultorio.\n\nGracias"
+		e, err := c.Email("patient@example.com", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{"Oficina de la Dra. Qiu", "La doctora cierra su consultorio.", "Gracias", `href="tel:+15165001279"`} {
+			if !strings.Contains(e.HTML, p) {
+				t.Errorf("%s: html lacks %q", name, p)
+			}
+		}
+		if strings.Contains(e.HTML, "Please") {
+			t.Errorf("%s: html has english wording of its own", name)
+		}
+	}
+}
+
+func TestLocalizedHTML(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		name = filepath.Join(dir, name)
+		if err := os.WriteFile(name, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	c := Campaign{
+		Name:     "test",
+		Subject:  "Notice",
+		Subjects: map[string]string{"es": "Aviso", "fr": "Avis"},
+		Message:  write("message.txt", "hello"),
+		HTML:     write("message.html", "{{range .Paragraphs}}<p>{{.}}</p>{{end}}"),
+	}
+	write("message.es.txt", "hola")
+	write("message.fr.txt", "bonjour")
+	write("message.fr.html", "<p>bonjour</p>")
+	es := c.Localized("es")
+	if err := es.Check("email"); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := es.LoadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := es.Email("patient@example.com", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.HTML != "<p>hola</p>" || e.Subject != "Aviso" {
+		t.Fatalf("got %q, %q", e.Subject, e.HTML)
+	}
+	if err := c.Localized("fr").Check("email"); err != nil {
+		t.Fatal(err)
+	}
+	// a template with wording of its own is caught before sending
+	write("message.fr.html", "<p>hello</p>")
+	if err := c.Localized("fr").Check("email"); err == nil {
+		t.Fatal("passed an html template that ignores the message")
+	}
+	d := NewEmail("patient@example.com")
+	d.Language = "fr"
+	err = c.CheckLanguages([]Decision{d})
+	if err == nil || !strings.Contains(err.Error(), "fr by email") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// The deadline stands out in the html email, wherever the text wraps it,
+// in every language that has one.
+func TestDeadline(t *testing.T) {
+	got := string(linkParagraph("please come ASAP before\nsept 30th, or call 516-500-1279", "ASAP before sept 30th"))
+	want := `please come <strong>ASAP before sept 30th</strong>, or call <a href="tel:+15165001279">516-500-1279</a>`
+	if got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		name = filepath.Join(dir, name)
+		if err := os.WriteFile(name, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	c := Campaign{
+		Name:      "test",
+		Subject:   "Notice",
+		Subjects:  map[string]string{"es": "Aviso"},
+		Message:   write("message.txt", "Office\n\nText us\n\nplease come before\nsept 30th"),
+		HTML:      "../message.html",
+		Deadline:  "before sept 30th",
+		Deadlines: map[string]string{"es": "antes del 30 de sept"},
+	}
+	write("message.es.txt", "Oficina\n\nTexto\n\nvenga antes del 30 de sept")
+	for _, c := range []Campaign{c, c.Localized("es")} {
+		if err := c.Check("email"); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := c.LoadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		html, err := c.RenderHTML(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "<strong>" + c.Deadline + "</strong>"; !strings.Contains(html, want) {
+			t.Errorf("%s html lacks %s", c.language(), want)
+		}
+	}
+	c.Deadline = "before oct 31st"
+	if err := c.Check("email"); err == nil {
+		t.Fatal("passed a deadline the message doesn't give")
+	}
+}
+
+func TestDefaultDeadline(t *testing.T) {
+	c := newDefaultCampaign()
+	c.Message, c.HTML = "../"+c.Message, "../"+c.HTML
+	msg, err := c.LoadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	html, err := c.RenderHTML(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html, "<strong>ASAP before sept 30th</strong>") {
+		t.Fatal("the default email doesn't bold its deadline")
+	}
+}
@@ -0,0 +1,119 @@
+package jin
+
+import (
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/kevinburke/twilio-go"
+)
+
+// Prices in dollars, for estimates and for receipts that don't say what
+// they cost.
+const (
+	EmailPrice      = 0.10 / 1000 // ses, per message
+	SMSSegmentPrice = 0.0075
+	CallMinutePrice = 0.0130
+	CallMinutes     = 3           // what a call is assumed to last
+	LetterPrice     = 0.73 + 0.10 // postage and printing
+)
+
+// SMSSegments is how many parts an sms is billed as: 160 characters, or
+// 153 per part when split, in the gsm alphabet, and 70 or 67 otherwise.
+func SMSSegments(msg string) int {
+	single, multi := 160, 153
+	for _, r := range msg {
+		if r >= 0x80 {
+			single, multi = 70, 67
+			break
+		}
+	}
+	n := utf8.RuneCountInString(msg)
+	if n <= single {
+		return 1
+	}
+	return int(math.Ceil(float64(n) / float64(multi)))
+}
+
+// Estimator returns a function estimating what carrying out a decision
+// will cost, with each language's message loaded once.
+func (c Campaign) Estimator() func(Decision) float64 {
+	segments := make(map[string]int)
+	return func(d Decision) float64 {
+		switch d.Type() {
+		case "email":
+			return EmailPrice
+		case "phone":
+			return CallMinutePrice * CallMinutes
+		case "mail":
+			return LetterPrice
+		case "sms":
+			lang := d.language()
+			n, ok := segments[lang]
+			if !ok {
+				msg, err := c.Localized(lang).LoadMessage()
+				if err != nil {
+					n = 1
+				} else {
+					n = SMSSegments(msg)
+				}
+				segments[lang] = n
+			}
+			return SMSSegmentPrice * float64(n)
+		}
+		return 0
+	}
+}
+
+// twilio reports prices as negative amounts, once known
+func twilioPrice(p string) (float64, bool) {
+	if p == "" {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(p, 64)
+	if err != nil {
+		return 0, false
+	}
+	return math.Abs(f), true
+}
+
+// Cost is what the receipt's message actually cost, if the provider said
+// so: twilio's price, once it has one, or ses's flat price per message,
+// which is charged whether or not the message is later delivered.
+func (r Receipt) Cost() (float64, bool) {
+	switch c := r.Content.(type) {
+	case *twilio.Message:
+		return twilioPrice(c.Price)
+	case *twilio.Call:
+		return twilioPrice(c.Price)
+	case *ses.SendEmailOutput, *ses.SendRawEmailOutput:
+		return EmailPrice, true
+	case PrintedLetter:
+		return LetterPrice, true
+	}
+	if !r.Successful {
+		// nothing was sent
+		return 0, true
+	}
+	return 0, false
+}
+
+// priceWindow is how long twilio may take to price a message or call.
+const priceWindow = 7 * 24 * time.Hour
+
+// PriceDue reports whether the receipt is for a twilio message or call
+// that twilio hadn't priced yet when it was stored, and may have by now.
+func (r Receipt) PriceDue(now time.Time) bool {
+	if now.Sub(r.Time) > priceWindow {
+		return false
+	}
+	switch c := r.Content.(type) {
+	case *twilio.Message:
+		return c.Price == ""
+	case *twilio.Call:
+		return c.Price == ""
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package jin
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/kevinburke/twilio-go"
+)
+
+func roundTrip(t *testing.T, r Receipt) Receipt {
+	t.Helper()
+	buf, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Receipt
+	if err := json.Unmarshal(buf, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// Receipts read back from the store have the content they were written
+// with, not maps.
+func TestReceiptContentTypes(t *testing.T) {
+	phone := NewPhone("+12125550123")
+	sms := NewSMS("+12125550123")
+	email := NewEmail("patient@example.com")
+	letter := Decision{Mail: &PostalAddress{Name: "Jane Doe"}}
+	for _, c := range []struct {
+		d       Decision
+		content interface{}
+	}{
+		{sms, &twilio.Message{Sid: "SM1", Price: "-0.00750"}},
+		{phone, &twilio.Call{Sid: "CA1", Price: "-0.013", QueueTime: twilio.TwilioDurationMS(time.Second)}},
+		{email, &ses.SendRawEmailOutput{MessageId: aws.String("0100-abc")}},
+		{email, OutboxMessage{ID: "email-1", Type: "email", To: "patient@example.com"}},
+		{letter, PrintedLetter{ID: "mail-1", Letter: Letter{Subject: "Notice"}}},
+		{sms, "illegal number"},
+		{sms, nil},
+		{email, map[string]interface{}{"unknown": "shape"}},
+	} {
+		got := roundTrip(t, Receipt{Decision: c.d, Content: c.content}).Content
+		if reflect.TypeOf(got) != reflect.TypeOf(c.content) {
+			t.Errorf("%T read back as %T", c.content, got)
+		}
+	}
+	r := roundTrip(t, Receipt{Decision: phone, Content: &twilio.Call{Sid: "CA1", Price: "-0.013"}})
+	if r.MessageID() != "CA1" {
+		t.Fatalf("got id %q", r.MessageID())
+	}
+}
+
+func TestReceiptCost(t *testing.T) {
+	email := NewEmail("patient@example.com")
+	sms := NewSMS("+12125550123")
+	for name, c := range map[string]struct {
+		r    Receipt
+		cost float64
+		ok   bool
+	}{
+		"priced sms":     {Receipt{Decision: sms, Successful: true, Content: &twilio.Message{Price: "-0.0150"}}, 0.015, true},
+		"unpriced sms":   {Receipt{Decision: sms, Successful: true, Content: &twilio.Message{}}, 0, false},
+		"failed sms":     {Receipt{Decision: sms, Successful: false, Content: &twilio.Message{Price: "-0.0075"}}, 0.0075, true},
+		"email":          {Receipt{Decision: email, Successful: true, Content: &ses.SendEmailOutput{}}, EmailPrice, true},
+		"bounced email":  {Receipt{Decision: email, Successful: false, Content: &ses.SendRawEmailOutput{}}, EmailPrice, true},
+		"letter":         {Receipt{Successful: true, Content: PrintedLetter{}}, LetterPrice, true},
+		"illegal number": {Receipt{Decision: sms, Successful: false, Content: "illegal number"}, 0, true},
+		"assumed sent":   {Receipt{Decision: email, Successful: true, Content: "assumed sent when reconciling"}, 0, false},
+	} {
+		cost, ok := roundTrip(t, c.r).Cost()
+		if math.Abs(cost-c.cost) > 1e-9 || ok != c.ok {
+			t.Errorf("%s: got %v, %v; want %v, %v", name, cost, ok, c.cost, c.ok)
+		}
+	}
+}
+
+func TestPriceDue(t *testing.T) {
+	now := time.Now()
+	for name, c := range map[string]struct {
+		r   Receipt
+		due bool
+	}{
+		"unpriced":             {Receipt{Time: now, Content: &twilio.Message{}}, true},
+		"priced":               {Receipt{Time: now, Content: &twilio.Message{Price: "-0.0075"}}, false},
+		"call":                 {Receipt{Time: now, Content: &twilio.Call{}}, true},
+		"too old":              {Receipt{Time: now.Add(-8 * 24 * time.Hour), Content: &twilio.Message{}}, false},
+		"not priced by twilio": {Receipt{Time: now, Content: &ses.SendEmailOutput{}}, false},
+	} {
+		if got := c.r.PriceDue(now); got != c.due {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+}
+
+func TestSMSSegments(t *testing.T) {
+	for _, c := range []struct {
+		n     int
+		ascii bool
+		want  int
+	}{
+		{160, true, 1}, {161, true, 2}, {306, true, 2}, {307, true, 3},
+		{70, false, 1}, {71, false, 2}, {134, false, 2}, {135, false, 3},
+	} {
+		r := "a"
+		if !c.ascii {
+			r = "é"
+		}
+		msg := ""
+		for i := 0; i < c.n; i++ {
+			msg += r
+		}
+		if got := SMSSegments(msg); got != c.want {
+			t.Errorf("%d ascii=%v: got %d segments, want %d", c.n, c.ascii, got, c.want)
+		}
+	}
+}
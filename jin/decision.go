@@ -4,18 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/kevinburke/twilio-go"
-	"github.com/xoba/sms/saws"
-	"github.com/xoba/sms/stw"
 )
 
 func NewEmail(e Addr) Decision {
@@ -32,7 +32,18 @@ func NewSMS(e Phone) Decision {
 }
 
 type Decision struct {
-	Phone, Email, SMS *string `json:",omitempty"`
+	Phone, Email, SMS *string        `json:",omitempty"`
+	Mail              *PostalAddress `json:",omitempty"`
+	Campaign          string         `json:",omitempty"`
+	Patient           string         `json:",omitempty"` // ContactInfo.ID
+	Language          string         `json:",omitempty"` // ContactInfo.Language
+}
+
+func (d Decision) language() string {
+	if d.Language == "" {
+		return DefaultLanguage
+	}
+	return d.Language
 }
 
 // makes sure to not send for real
@@ -44,18 +55,77 @@ func (d *Decision) SetDebugging(phone, email string) {
 		d.SMS = aws.String(phone)
 	case d.Email != nil:
 		d.Email = aws.String(email)
+	case d.Mail != nil:
+		d.Mail, d.Email = nil, aws.String(email)
 	default:
-		panic(fmt.Errorf("illegal decision: %v", d))
+		panic(fmt.Errorf("illegal decision for patient %q", d.Patient))
 	}
 }
 
+// KeyVersion prefixes every decision key. Bump it whenever Canonical
+// changes, along with a migration from the previous version.
+const KeyVersion = "v2"
+
+// Canonical is the explicit identity of a decision: key version, channel,
+// normalized address and campaign. Unlike the json encoding, it doesn't
+// change when fields are added to Decision.
+func (d Decision) Canonical() string {
+	campaign := d.Campaign
+	if campaign == "" {
+		campaign = DefaultCampaign
+	}
+	return strings.Join([]string{KeyVersion, d.Type(), d.Address(), campaign}, "|")
+}
+
+// Key names the decision's receipt; the canonical form is hashed to keep
+// addresses out of object names.
 func (d Decision) Key() string {
+	h := sha256.Sum256([]byte(d.Canonical()))
+	return fmt.Sprintf("%s-%x.json", KeyVersion, h[:16])
+}
+
+// LegacyKey is the md5 of the json encoding used for receipts written
+// before KeyVersion existed.
+func (d Decision) LegacyKey() string {
 	h := md5.New()
 	e := json.NewEncoder(h)
-	e.Encode(d)
+	e.Encode(struct {
+		Phone, Email, SMS *string `json:",omitempty"`
+	}{d.Phone, d.Email, d.SMS})
 	return fmt.Sprintf("%x.json", h.Sum(nil))
 }
 
+// IsLegacyKey reports whether a receipt key predates KeyVersion.
+func IsLegacyKey(key string) bool {
+	return !strings.HasPrefix(key, KeyVersion+"-")
+}
+
+// Address is the normalized destination of the decision.
+func (d Decision) Address() string {
+	switch {
+	case d.Phone != nil:
+		return normalizePhone(*d.Phone)
+	case d.SMS != nil:
+		return normalizePhone(*d.SMS)
+	case d.Email != nil:
+		return strings.TrimSpace(strings.ToLower(*d.Email))
+	case d.Mail != nil:
+		return strings.ToLower(strings.Join(strings.Fields(d.Mail.String()), " "))
+	}
+	panic("illegal")
+}
+
+// normalizePhone formats a number in E.164. Contacts' numbers already are,
+// with their region applied; only numbers from before regions existed,
+// all in the U.S., lack a country code.
+func normalizePhone(p string) string {
+	n, err := CleanNumber(p)
+	if err != nil {
+		return strings.TrimSpace(p)
+	}
+	return n
+}
+
 const (
 	EmailSender  = "dr2127588851@gmail.com"
 	EmailSubject = "Important message from Dr. Ann Jin Qiu"
@@ -64,11 +134,16 @@ const (
 )
 
 func LoadMessage() (string, error) {
+	return LoadMessageFile("message.txt")
+}
+
+func LoadMessageFile(name string) (string, error) {
 	w := new(bytes.Buffer)
-	f, err := os.Open("message.txt")
+	f, err := os.Open(name)
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
 	s := bufio.NewScanner(f)
 	for s.Scan() {
 		line := strings.TrimSpace(s.Text())
@@ -93,6 +168,101 @@ type Receipt struct {
 	Successful bool
 	Decision   Decision
 	Content    interface{}
+	Events     []Event `json:",omitempty"`
+}
+
+// Event is a later update on a receipt, like a bounce or delivery.
+type Event struct {
+	Time   time.Time
+	Type   string
+	Detail interface{} `json:",omitempty"`
+}
+
+// UnmarshalJSON reads a stored receipt with its content as the type it
+// was written from, like *twilio.Message or PrintedLetter.
+func (r *Receipt) UnmarshalJSON(buf []byte) error {
+	type plain Receipt
+	var x struct {
+		plain
+		Content json.RawMessage
+	}
+	if err := json.Unmarshal(buf, &x); err != nil {
+		return err
+	}
+	content, err := decodeContent(x.Decision, x.Content)
+	if err != nil {
+		return fmt.Errorf("can't unmarshal receipt content: %w", err)
+	}
+	*r = Receipt(x.plain)
+	r.Content = content
+	return nil
+}
+
+// decodeContent recognizes the content of a receipt by its fields.
+func decodeContent(d Decision, raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		// a note, like "illegal number"
+		var v interface{}
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	}
+	has := func(k string) bool {
+		_, ok := fields[k]
+		return ok
+	}
+	switch {
+	case has("sid") && d.Phone != nil:
+		// twilio writes queue_time as a number, but reads it as a string
+		if q := fields["queue_time"]; len(q) > 0 && q[0] != '"' && string(q) != "null" {
+			fields["queue_time"] = json.RawMessage(strconv.Quote(string(q)))
+		}
+		buf, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		c := new(twilio.Call)
+		return c, json.Unmarshal(buf, c)
+	case has("sid"):
+		m := new(twilio.Message)
+		return m, json.Unmarshal(raw, m)
+	case has("MessageId"):
+		o := new(ses.SendRawEmailOutput)
+		return o, json.Unmarshal(raw, o)
+	case has("Letter"):
+		var l PrintedLetter
+		err := json.Unmarshal(raw, &l)
+		return l, err
+	case has("ID") && has("Type"):
+		var m OutboxMessage
+		err := json.Unmarshal(raw, &m)
+		return m, err
+	}
+	var m map[string]interface{}
+	err := json.Unmarshal(raw, &m)
+	return m, err
+}
+
+// MessageID is the provider's id for what was sent, if any.
+func (r Receipt) MessageID() string {
+	switch c := r.Content.(type) {
+	case *ses.SendEmailOutput:
+		return aws.StringValue(c.MessageId)
+	case *ses.SendRawEmailOutput:
+		return aws.StringValue(c.MessageId)
+	case *twilio.Message:
+		return c.Sid
+	case *twilio.Call:
+		return c.Sid
+	case OutboxMessage:
+		return c.ID
+	case PrintedLetter:
+		return c.ID
+	}
+	return ""
 }
 
 func (r Receipt) String() string {
@@ -100,6 +270,47 @@ func (r Receipt) String() string {
 	return string(buf)
 }
 
+// Pending is written before a decision is sent and removed once its
+// receipt is stored, so a crash in between leaves a record to reconcile.
+type Pending struct {
+	Time     time.Time
+	Owner    string
+	Decision Decision
+}
+
+func (p Pending) String() string {
+	buf, _ := json.Marshal(p)
+	return string(buf)
+}
+
+// Find searches the provider's logs for the decision having been carried
+// out since the given time, returning a receipt if so and nil otherwise.
+func (c Decision) Find(p Provider, since time.Time) (*Receipt, error) {
+	var content interface{}
+	var err error
+	switch {
+	case c.Phone != nil:
+		content, err = p.FindCall(*c.Phone, since)
+	case c.SMS != nil:
+		content, err = p.FindSMS(*c.SMS, since)
+	case c.Email != nil:
+		content, err = p.FindEmail(*c.Email, since)
+	case c.Mail != nil:
+		content, err = p.FindLetter(*c.Mail, since)
+	default:
+		return nil, fmt.Errorf("no decision")
+	}
+	if err != nil || content == nil {
+		return nil, err
+	}
+	return &Receipt{
+		Time:       time.Now(),
+		Successful: true,
+		Decision:   c,
+		Content:    content,
+	}, nil
+}
+
 func (c Decision) Host() string {
 	var host string
 	if c.Email != nil {
@@ -110,44 +321,13 @@ func (c Decision) Host() string {
 	return host
 }
 
-var blacklist = []string{
-	"+19176121039",
-}
-
-func IllegalNumber(n string) bool {
-	switch {
-	case strings.HasPrefix(n, "+8"):
-		return true
-	case strings.HasPrefix(n, "+11"):
-		// no U.S. area code starts with "1"
-		return true
-	case strings.HasPrefix(n, "+1787") || strings.HasPrefix(n, "+1939"):
-		// puerto rico
-		return true
-	case strings.HasPrefix(n, "+1211") || strings.HasPrefix(n, "+1735"):
-		// not valid area code!
-		return true
-	case strings.HasPrefix(n, "+15550") || strings.HasPrefix(n, "+15551"):
-		// invalid area code parts
-		return true
-	case len(n) != 12:
-		// at least for now, stay away from dicey numbers
-		return true
-	}
-	for _, b := range blacklist {
-		if n == b {
-			return true
-		}
-	}
-	return false
-}
-
-func (c Decision) Contact(emailSvc *ses.SES, twilioSvc *twilio.Client) (*Receipt, error) {
+func (c Decision) Contact(p Provider, campaign Campaign) (*Receipt, error) {
 	r := Receipt{
 		Time:     time.Now(),
 		Decision: c,
 	}
-	msg, err := LoadMessage()
+	campaign = campaign.Localized(c.language())
+	msg, err := campaign.LoadMessage()
 	if err != nil {
 		return nil, err
 	}
@@ -158,12 +338,14 @@ func (c Decision) Contact(emailSvc *ses.SES, twilioSvc *twilio.Client) (*Receipt
 			// r.Successful == false
 			return &r, nil
 		}
-		call, err := stw.MakeCall(
-			twilioSvc,
-			TwilioNumber,
-			*c.Phone,
-			TwimlURL,
-		)
+		var call interface{}
+		if campaign.TwimlURL != "" {
+			call, err = p.MakeCall(*c.Phone, campaign.TwimlURL)
+		} else if v, ok := campaign.Voice(); ok {
+			call, err = p.Say(*c.Phone, v, msg)
+		} else {
+			err = fmt.Errorf("no %s voice", c.language())
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -174,24 +356,29 @@ func (c Decision) Contact(emailSvc *ses.SES, twilioSvc *twilio.Client) (*Receipt
 			// r.Successful == false
 			return &r, nil
 		}
-		message, err := stw.SendSMS(
-			twilioSvc,
-			TwilioNumber,
-			*c.SMS,
-			msg,
-		)
+		message, err := p.SendSMS(*c.SMS, msg)
 		if err != nil {
 			return nil, err
 		}
 		r.Content = message
 	case c.Email != nil:
-		resp, err := saws.SendEmail(
-			emailSvc,
-			EmailSender,
-			*c.Email,
-			EmailSubject,
-			msg,
-		)
+		e, err := campaign.Email(*c.Email, msg)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.SendEmail(*e)
+		if err != nil {
+			return nil, err
+		}
+		r.Content = resp
+	case c.Mail != nil:
+		resp, err := p.SendLetter(Letter{
+			To:       *c.Mail,
+			Language: c.language(),
+			Date:     r.Time,
+			Subject:  campaign.Subject,
+			Body:     msg,
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -213,6 +400,9 @@ func (c Decision) Type() string {
 	if c.SMS != nil {
 		return "sms"
 	}
+	if c.Mail != nil {
+		return "mail"
+	}
 	panic("illegal")
 }
 
@@ -241,8 +431,14 @@ func (d Decision) Validate() error {
 			return fmt.Errorf("empty sms")
 		}
 	}
+	if d.Mail != nil {
+		nonNil++
+		if d.Mail.Address1 == "" || d.Mail.City == "" || d.Mail.State == "" {
+			return fmt.Errorf("incomplete address")
+		}
+	}
 	if nonNil == 1 {
 		return nil
 	}
-	return fmt.Errorf("bad decision: " + d.String())
+	return fmt.Errorf("bad decision for patient %q: %d channels", d.Patient, nonNil)
 }
@@ -0,0 +1,53 @@
+package jin
+
+import "testing"
+
+// Receipt keys must never change, or runs would contact everyone again;
+// these are the keys of receipts already written.
+func TestKeys(t *testing.T) {
+	flu := NewEmail("jane@example.com")
+	flu.Campaign = "flu"
+	for _, c := range []struct {
+		d                   Decision
+		canonical, key, md5 string
+	}{
+		{
+			NewSMS("+12126888887"),
+			"v2|sms|+12126888887|default",
+			"v2-69363d92252dbf774da004408b20470b.json",
+			"ee397b5ae2961be5e7feb9fb0513fc04.json",
+		},
+		{
+			NewEmail(" Jane@Example.com"),
+			"v2|email|jane@example.com|default",
+			"v2-6d00d6c4fa995b25d6b99d70affccfc6.json",
+			"0da1701a6f171a7af4a4d9a33a5a33bd.json",
+		},
+		{
+			// numbers from before regions lack a country code
+			NewPhone("2126888887"),
+			"v2|phone|+12126888887|default",
+			"v2-54a7dc38fcb311168cc9ab1d167ecbf2.json",
+			"76902209c3419d3d521ffb333808df28.json",
+		},
+		{
+			flu,
+			"v2|email|jane@example.com|flu",
+			"v2-57f34dc7110cda4fbd8c3d3e20b78498.json",
+			"17295edf156e6cd936083a13dcf95f7c.json",
+		},
+	} {
+		if got := c.d.Canonical(); got != c.canonical {
+			t.Errorf("Canonical is %q; want %q", got, c.canonical)
+		}
+		if got := c.d.Key(); got != c.key {
+			t.Errorf("%s: Key is %s; want %s", c.canonical, got, c.key)
+		}
+		if got := c.d.LegacyKey(); got != c.md5 {
+			t.Errorf("%s: LegacyKey is %s; want %s", c.canonical, got, c.md5)
+		}
+		if IsLegacyKey(c.key) || !IsLegacyKey(c.md5) {
+			t.Errorf("%s: IsLegacyKey mixes up %s and %s", c.canonical, c.key, c.md5)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package jin
+
+import (
+	"fmt"
+	"time"
+)
+
+// EscalateAfter is how long to wait for a reply before escalating, or
+// zero if the campaign never does.
+func (c Campaign) EscalateAfter() (time.Duration, error) {
+	if c.Escalate == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.Escalate)
+	if err != nil {
+		return 0, fmt.Errorf("campaign %q has a bad escalation delay: %w", c.Name, err)
+	}
+	return d, nil
+}
+
+// Escalations are the other ways to reach a patient who hasn't replied
+// to what Decisions chose: every email and phone on file, and a letter
+// if there's nothing else.
+func (c ContactInfo) Escalations() ([]Decision, error) {
+	decided, err := c.Decisions()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, d := range decided {
+		seen[d.Canonical()] = true
+	}
+	var out []Decision
+	add := func(d Decision) {
+		if err := d.Validate(); err != nil || seen[d.Canonical()] {
+			return
+		}
+		seen[d.Canonical()] = true
+		d.Patient = c.ID
+		d.Language = c.Language
+		out = append(out, d)
+	}
+	if c.Email != "" && c.ValidateEmail() == nil {
+		add(NewEmail(c.Email))
+	}
+	if c.Mobile != "" && c.LineType(c.Mobile) == MobileLine {
+		add(NewSMS(c.Mobile))
+	}
+	for _, p := range []Phone{c.Mobile, c.Home, c.Office} {
+		if p != "" {
+			add(NewPhone(p))
+		}
+	}
+	if len(out) == 0 && c.HasAddress() && len(c.AddressProblems) == 0 {
+		add(NewLetter(c))
+	}
+	return out, nil
+}
+
+// DueEscalations returns the escalations for patients first contacted at
+// least delay ago, by the time in contacted, who haven't replied.
+func DueEscalations(contacts []ContactInfo, contacted map[string]time.Time, replied map[string]bool, delay time.Duration, now time.Time) ([]Decision, error) {
+	var out []Decision
+	for _, c := range contacts {
+		t, ok := contacted[c.ID]
+		if !ok || replied[c.ID] || now.Sub(t) < delay {
+			continue
+		}
+		list, err := c.Escalations()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, list...)
+	}
+	return out, nil
+}
@@ -0,0 +1,87 @@
+package jin
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEscalations(t *testing.T) {
+	address := ContactInfo{Address1: "1 MAIN ST", City: "NEW YORK", State: "NY", Zip: "10001"}
+	withAddress := func(c ContactInfo) ContactInfo {
+		c.Address1, c.City, c.State, c.Zip = address.Address1, address.City, address.State, address.Zip
+		return c
+	}
+	for _, c := range []struct {
+		name    string
+		contact ContactInfo
+		want    []string
+	}{
+		{
+			"every other way on file",
+			withAddress(ContactInfo{Preferred: Email, Email: "a@example.com", Mobile: "+12126888887", Home: "+12126888888"}),
+			[]string{"sms", "phone", "phone"},
+		},
+		{
+			"a letter when email was the only way",
+			withAddress(ContactInfo{Preferred: Email, Email: "a@example.com"}),
+			[]string{"mail"},
+		},
+		{
+			"no letter for an undeliverable address",
+			func() ContactInfo {
+				c := withAddress(ContactInfo{Preferred: Email, Email: "a@example.com"})
+				c.AddressProblems = []string{"no zip"}
+				return c
+			}(),
+			nil,
+		},
+		{
+			"nothing left after a letter",
+			withAddress(ContactInfo{Preferred: NoneSpecified}),
+			nil,
+		},
+		{
+			"a preferred phone escalates to email",
+			withAddress(ContactInfo{Preferred: Home, Email: "a@example.com", Home: "+12126888888"}),
+			[]string{"email"},
+		},
+	} {
+		c.contact.ID = "p1"
+		list, err := c.contact.Escalations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range list {
+			if d.Patient != "p1" {
+				t.Errorf("%s: escalation for %q", c.name, d.Patient)
+			}
+			got = append(got, d.Type())
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v; want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDueEscalations(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	var contacts []ContactInfo
+	for _, id := range []string{"due", "early", "replied", "never"} {
+		contacts = append(contacts, ContactInfo{ID: id, Preferred: Email, Email: Addr(id + "@example.com"), Home: "+12126888888"})
+	}
+	contacted := map[string]time.Time{
+		"due":     now.Add(-73 * time.Hour),
+		"early":   now.Add(-71 * time.Hour),
+		"replied": now.Add(-100 * time.Hour),
+	}
+	replied := map[string]bool{"replied": true}
+	list, err := DueEscalations(contacts, contacted, replied, 72*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Patient != "due" || list[0].Type() != "phone" {
+		t.Fatalf("got %v", list)
+	}
+}
@@ -0,0 +1,213 @@
+package jin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/xoba/sms/pdf"
+)
+
+// DefaultLanguage is for patients with none given, and of campaigns that
+// don't say otherwise.
+const DefaultLanguage = "en"
+
+// languageNames maps how languages are written in the contact list to
+// their iso 639-1 codes.
+var languageNames = map[string]string{
+	"english":        "en",
+	"spanish":        "es",
+	"español":        "es",
+	"espanol":        "es",
+	"chinese":        "zh",
+	"mandarin":       "zh",
+	"cantonese":      "zh",
+	"russian":        "ru",
+	"korean":         "ko",
+	"french":         "fr",
+	"haitian creole": "ht",
+	"creole":         "ht",
+	"italian":        "it",
+	"polish":         "pl",
+	"portuguese":     "pt",
+	"japanese":       "ja",
+	"arabic":         "ar",
+	"bengali":        "bn",
+	"yiddish":        "yi",
+}
+
+// NormalizeLanguage returns the code for a language name or code, or
+// DefaultLanguage if it's empty.
+func NormalizeLanguage(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return DefaultLanguage, nil
+	}
+	if code, ok := languageNames[s]; ok {
+		return code, nil
+	}
+	for _, code := range languageNames {
+		if s == code {
+			return code, nil
+		}
+	}
+	return "", fmt.Errorf("unknown language: %q", s)
+}
+
+// Voice is a twilio text-to-speech voice.
+type Voice struct {
+	Name   string // like "Polly.Lupe"
+	Locale string // like "es-US"
+}
+
+// voices are the default voices per language; campaigns can override
+// them or add others.
+var voices = map[string]Voice{
+	"en": {"Polly.Joanna", "en-US"},
+	"es": {"Polly.Lupe", "es-US"},
+	"zh": {"Polly.Zhiyu", "cmn-CN"},
+	"ru": {"Polly.Tatyana", "ru-RU"},
+	"ko": {"Polly.Seoyeon", "ko-KR"},
+	"fr": {"Polly.Celine", "fr-FR"},
+	"it": {"Polly.Carla", "it-IT"},
+	"pl": {"Polly.Ewa", "pl-PL"},
+	"pt": {"Polly.Camila", "pt-BR"},
+	"ja": {"Polly.Mizuki", "ja-JP"},
+	"ar": {"Polly.Zeina", "arb"},
+}
+
+// localizedName is the file for a language alongside name, like
+// message.es.txt for message.txt.
+func localizedName(name, lang string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + lang + ext
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// Localized returns the campaign in the given language: its files are
+// the ones named by localizedName, with the html template and
+// attachments falling back to the campaign's own if there's no
+// translation. Html templates take their wording from the localized
+// message, which Check makes sure of. Calls in the campaign's language play its twiml; others
+// are spoken by the language's voice.
+func (c Campaign) Localized(lang string) Campaign {
+	if lang == "" || lang == c.language() {
+		return c
+	}
+	out := c
+	out.Language = lang
+	out.Subject = c.Subjects[lang]
+	out.Deadline = c.Deadlines[lang]
+	out.Message = localizedName(c.Message, lang)
+	if c.HTML != "" && exists(localizedName(c.HTML, lang)) {
+		out.HTML = localizedName(c.HTML, lang)
+	}
+	out.Attachments = nil
+	for _, a := range c.Attachments {
+		if exists(localizedName(a, lang)) {
+			a = localizedName(a, lang)
+		}
+		out.Attachments = append(out.Attachments, a)
+	}
+	out.TwimlURL = ""
+	return out
+}
+
+func (c Campaign) language() string {
+	if c.Language == "" {
+		return DefaultLanguage
+	}
+	return c.Language
+}
+
+// Voice returns the text-to-speech voice for the campaign's language.
+func (c Campaign) Voice() (Voice, bool) {
+	if v, ok := c.Voices[c.language()]; ok {
+		return v, true
+	}
+	v, ok := voices[c.language()]
+	return v, ok
+}
+
+// Check makes sure the campaign, as localized, can reach someone through
+// the given channel.
+func (c Campaign) Check(channel string) error {
+	lang := c.language()
+	if c.Message == "" || !exists(c.Message) {
+		return fmt.Errorf("no %s message %q", lang, c.Message)
+	}
+	switch channel {
+	case "email":
+		if c.Subject == "" {
+			return fmt.Errorf("no %s email subject", lang)
+		}
+		if err := c.checkHTML(); err != nil {
+			return err
+		}
+	case "phone":
+		if c.TwimlURL != "" {
+			return nil
+		}
+		if _, ok := c.Voice(); !ok {
+			return fmt.Errorf("no %s voice", lang)
+		}
+	case "mail":
+		msg, err := c.LoadMessage()
+		if err != nil {
+			return err
+		}
+		if !pdf.Encodable(msg) {
+			return fmt.Errorf("%s message %q can't be printed in a letter", lang, c.Message)
+		}
+	}
+	return nil
+}
+
+// checkHTML makes sure the html email says what the message does, so no
+// one gets wording in another language than their text part.
+func (c Campaign) checkHTML() error {
+	msg, err := c.LoadMessage()
+	if err != nil {
+		return err
+	}
+	html, err := c.RenderHTML(msg)
+	if err != nil {
+		return fmt.Errorf("can't render %s html email: %w", c.language(), err)
+	}
+	for _, p := range strings.Split(msg, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" && !strings.Contains(html, string(linkParagraph(p, c.Deadline))) {
+			return fmt.Errorf("%s html email %q doesn't show the message", c.language(), c.HTML)
+		}
+	}
+	if d := strings.Join(strings.Fields(c.Deadline), " "); d != "" && !strings.Contains(strings.Join(strings.Fields(msg), " "), d) {
+		return fmt.Errorf("%s message %q doesn't contain the deadline %q", c.language(), c.Message, c.Deadline)
+	}
+	return nil
+}
+
+// CheckLanguages makes sure that every language of the decisions has a
+// template for every channel it's used with, returning all that are
+// missing.
+func (c Campaign) CheckLanguages(decisions []Decision) error {
+	used := make(map[[2]string]bool)
+	for _, d := range decisions {
+		used[[2]string{d.language(), d.Type()}] = true
+	}
+	var problems []string
+	for k := range used {
+		if err := c.Localized(k[0]).Check(k[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s by %s: %v", k[0], k[1], err))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("campaign %q is missing translations:\n  %s", c.Name, strings.Join(problems, "\n  "))
+}
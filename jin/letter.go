@@ -0,0 +1,297 @@
+package jin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xoba/sms/pdf"
+)
+
+// PracticeAddress is the return address printed on letters.
+var PracticeAddress = []string{
+	"Office of Dr. Ann Jin Qiu",
+	"Text 516-500-1279, email " + EmailSender,
+}
+
+// PostalAddress is where a letter goes.
+type PostalAddress struct {
+	Name               string `json:",omitempty"`
+	Address1, Address2 string `json:",omitempty"`
+	City, State, Zip   string `json:",omitempty"`
+}
+
+func (c ContactInfo) PostalAddress() PostalAddress {
+	return PostalAddress{
+		Name:     strings.Join(strings.Fields(strings.Join([]string{c.First, c.Middle, c.Last}, " ")), " "),
+		Address1: c.Address1,
+		Address2: c.Address2,
+		City:     c.City,
+		State:    c.State,
+		Zip:      c.Zip,
+	}
+}
+
+// Lines are the address as printed on an envelope.
+func (a PostalAddress) Lines() []string {
+	var out []string
+	for _, s := range []string{a.Name, a.Address1, a.Address2} {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return append(out, strings.TrimSpace(fmt.Sprintf("%s, %s %s", a.City, a.State, a.Zip)))
+}
+
+func (a PostalAddress) String() string {
+	return strings.Join(a.Lines(), ", ")
+}
+
+func NewLetter(c ContactInfo) Decision {
+	a := c.PostalAddress()
+	return Decision{Mail: &a}
+}
+
+// Letter is a personalized letter to one patient.
+type Letter struct {
+	To       PostalAddress
+	Language string `json:",omitempty"`
+	Date     time.Time
+	Subject  string
+	Body     string // the plain text message, paragraphs separated by blank lines
+}
+
+// greetings open letters, by language.
+var greetings = map[string]string{
+	"en": "Dear %s,",
+	"es": "Estimado/a %s:",
+	"fr": "Cher/Chère %s,",
+	"it": "Gentile %s,",
+	"pt": "Prezado/a %s,",
+	"pl": "Szanowny/a %s,",
+}
+
+const (
+	margin   = 72
+	leading  = 15
+	fontSize = 11
+	wrapAt   = 88 // characters of 11pt helvetica across 6.5"
+)
+
+// Render adds the letter to d, starting on a new page. The recipient
+// block sits where a #10 window envelope shows it.
+func (l Letter) Render(d *pdf.Document) {
+	p := d.AddPage()
+	y := float64(pdf.Height - margin)
+	line := func(f pdf.Font, s string) {
+		if y < margin {
+			p = d.AddPage()
+			y = pdf.Height - margin
+		}
+		p.Text(f, fontSize, margin, y, s)
+		y -= leading
+	}
+	for i, s := range PracticeAddress {
+		f := pdf.Regular
+		if i == 0 {
+			f = pdf.Bold
+		}
+		line(f, s)
+	}
+	y = pdf.Height - 2.25*72
+	for _, s := range l.To.Lines() {
+		line(pdf.Regular, s)
+	}
+	y = pdf.Height - 4*72
+	line(pdf.Regular, l.Date.Format("January 2, 2006"))
+	y -= leading
+	if l.Subject != "" {
+		line(pdf.Bold, l.Subject)
+		y -= leading
+	}
+	greeting, ok := greetings[l.Language]
+	if !ok {
+		greeting = "%s,"
+	}
+	line(pdf.Regular, fmt.Sprintf(greeting, l.To.Name))
+	y -= leading
+	for _, para := range strings.Split(l.Body, "\n\n") {
+		if strings.TrimSpace(para) == "" {
+			continue
+		}
+		for _, s := range pdf.Wrap(para, wrapAt) {
+			line(pdf.Regular, s)
+		}
+		y -= leading
+	}
+}
+
+func (l Letter) PDF() []byte {
+	d := new(pdf.Document)
+	l.Render(d)
+	return d.Bytes()
+}
+
+// Mailer sends physical letters.
+type Mailer interface {
+	SendLetter(l Letter) (interface{}, error)
+	FindLetter(to PostalAddress, since time.Time) (interface{}, error)
+}
+
+// PrintBatch is the local stand-in for a mail api: each letter is written
+// to Dir as a pdf with a json record, to be assembled by WriteBatch for
+// printing and mailing by hand. The files hold patients' names and
+// addresses unencrypted, readable only by the owner, so Dir belongs on an
+// encrypted disk and is to be cleared once the letters are mailed.
+type PrintBatch struct {
+	Dir string
+}
+
+type PrintedLetter struct {
+	ID     string
+	Time   time.Time
+	To     PostalAddress
+	Letter Letter
+	Batch  string `json:",omitempty"` // the batch it was printed in, if any
+}
+
+func (b PrintBatch) SendLetter(l Letter) (interface{}, error) {
+	if err := os.MkdirAll(b.Dir, 0700); err != nil {
+		return nil, err
+	}
+	m := PrintedLetter{Time: time.Now(), To: l.To, Letter: l}
+	m.ID = fmt.Sprintf("mail-%d-%d", m.Time.UnixNano(), os.Getpid())
+	if err := os.WriteFile(filepath.Join(b.Dir, m.ID+".pdf"), l.PDF(), 0600); err != nil {
+		return nil, err
+	}
+	if err := b.save(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (b PrintBatch) save(m PrintedLetter) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(b.Dir, m.ID+".json"), buf, 0600)
+}
+
+func (b PrintBatch) letters() ([]PrintedLetter, error) {
+	names, err := filepath.Glob(filepath.Join(b.Dir, "mail-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out []PrintedLetter
+	for _, n := range names {
+		buf, err := os.ReadFile(n)
+		if err != nil {
+			return nil, err
+		}
+		var m PrintedLetter
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return nil, fmt.Errorf("can't unmarshal %s: %w", n, err)
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Time.Before(out[j].Time)
+	})
+	return out, nil
+}
+
+func (b PrintBatch) FindLetter(to PostalAddress, since time.Time) (interface{}, error) {
+	list, err := b.letters()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range list {
+		if m.To == to && !m.Time.Before(since) {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// WriteBatch assembles every letter written since the given time that
+// isn't in an earlier batch into one print-ready pdf, with a csv of
+// mailing labels in the same order, and records the batch name on each
+// so the next batch leaves them out. It returns the number of letters.
+func (b PrintBatch) WriteBatch(batch string, since time.Time, pdfName, csvName string) (int, error) {
+	list, err := b.letters()
+	if err != nil {
+		return 0, err
+	}
+	var todo []PrintedLetter
+	for _, m := range list {
+		if m.Batch == "" && !m.Time.Before(since) {
+			todo = append(todo, m)
+		}
+	}
+	if err := writeBatch(todo, pdfName, csvName); err != nil {
+		return 0, err
+	}
+	for _, m := range todo {
+		m.Batch = batch
+		if err := b.save(m); err != nil {
+			return 0, err
+		}
+	}
+	return len(todo), nil
+}
+
+// Reprint assembles an earlier batch again, returning the number of
+// letters in it.
+func (b PrintBatch) Reprint(batch string, pdfName, csvName string) (int, error) {
+	list, err := b.letters()
+	if err != nil {
+		return 0, err
+	}
+	var todo []PrintedLetter
+	for _, m := range list {
+		if m.Batch == batch {
+			todo = append(todo, m)
+		}
+	}
+	if len(todo) == 0 {
+		return 0, fmt.Errorf("no letters in batch %q", batch)
+	}
+	if err := writeBatch(todo, pdfName, csvName); err != nil {
+		return 0, err
+	}
+	return len(todo), nil
+}
+
+func writeBatch(list []PrintedLetter, pdfName, csvName string) error {
+	d := new(pdf.Document)
+	f, err := os.OpenFile(csvName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"ID", "Name", "Address1", "Address2", "City", "State", "Zip"})
+	for _, m := range list {
+		m.Letter.Render(d)
+		// every letter starts on a fresh sheet when printed duplex
+		if d.Pages()%2 == 1 {
+			d.AddPage()
+		}
+		a := m.To
+		w.Write([]string{m.ID, a.Name, a.Address1, a.Address2, a.City, a.State, a.Zip})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(pdfName, d.Bytes(), 0600)
+}
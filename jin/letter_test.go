@@ -0,0 +1,103 @@
+package jin
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xoba/sms/pdf"
+)
+
+func testLetter(name string) Letter {
+	return Letter{
+		To:      PostalAddress{Name: name, Address1: "100 FRONT ST", City: "NEW YORK", State: "NY", Zip: "10038"},
+		Date:    time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC),
+		Subject: "Notice",
+		Body:    "first paragraph\n\nsecond paragraph",
+	}
+}
+
+func TestLetterRender(t *testing.T) {
+	d := new(pdf.Document)
+	testLetter("Jane Doe").Render(d)
+	if d.Pages() != 1 {
+		t.Fatalf("short letter took %d pages", d.Pages())
+	}
+	long := testLetter("Jane Doe")
+	long.Body = strings.Repeat("a paragraph of some length that goes on\n\n", 60)
+	d = new(pdf.Document)
+	long.Render(d)
+	if d.Pages() < 2 {
+		t.Fatal("long letter didn't continue onto a second page")
+	}
+}
+
+func readLabels(t *testing.T, name string) [][]string {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows[1:]
+}
+
+// Each letter is printed in one batch only, though it can be reprinted.
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	b := PrintBatch{Dir: dir}
+	for _, name := range []string{"Jane Doe", "John Roe"} {
+		if _, err := b.SendLetter(testLetter(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	since := time.Now().Add(-time.Hour)
+	batch := func(name string) (int, string) {
+		pdfName := filepath.Join(dir, "batch-"+name+".pdf")
+		csvName := filepath.Join(dir, "labels-"+name+".csv")
+		n, err := b.WriteBatch(name, since, pdfName, csvName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n, csvName
+	}
+	n, labels := batch("1")
+	if rows := readLabels(t, labels); n != 2 || len(rows) != 2 || rows[0][1] != "Jane Doe" {
+		t.Fatalf("first batch: %d letters, labels %v", n, rows)
+	}
+	if _, err := b.SendLetter(testLetter("Ann Poe")); err != nil {
+		t.Fatal(err)
+	}
+	n, labels = batch("2")
+	if rows := readLabels(t, labels); n != 1 || len(rows) != 1 || rows[0][1] != "Ann Poe" {
+		t.Fatalf("second batch reprinted letters: %d letters, labels %v", n, rows)
+	}
+	if n, _ := batch("3"); n != 0 {
+		t.Fatalf("third batch has %d letters", n)
+	}
+	csvName := filepath.Join(dir, "again.csv")
+	n, err := b.Reprint("1", filepath.Join(dir, "again.pdf"), csvName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := readLabels(t, csvName); n != 2 || len(rows) != 2 {
+		t.Fatalf("reprint: %d letters, labels %v", n, rows)
+	}
+	if _, err := b.Reprint("4", filepath.Join(dir, "x.pdf"), filepath.Join(dir, "x.csv")); err == nil {
+		t.Fatal("reprinted a batch that doesn't exist")
+	}
+	fi, err := os.Stat(csvName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("labels are readable by others: %v", fi.Mode())
+	}
+}
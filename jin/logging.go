@@ -0,0 +1,147 @@
+package jin
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// PIIKeys are the log attributes holding patients' phone numbers, emails,
+// names or addresses, which Redact masks.
+var PIIKeys = map[string]bool{
+	"to":      true,
+	"from":    true,
+	"email":   true,
+	"phone":   true,
+	"mobile":  true,
+	"home":    true,
+	"office":  true,
+	"name":    true,
+	"address": true,
+}
+
+// LogValue logs a decision with its address under "to", for redaction.
+func (d Decision) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("channel", d.Type()),
+		slog.String("to", d.Address()),
+	}
+	if d.Campaign != "" {
+		attrs = append(attrs, slog.String("campaign", d.Campaign))
+	}
+	if d.Patient != "" {
+		attrs = append(attrs, slog.String("patient", d.Patient))
+	}
+	if d.Language != "" {
+		attrs = append(attrs, slog.String("language", d.Language))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (c ContactInfo) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("id", c.ID),
+		slog.String("name", strings.Join(strings.Fields(c.First+" "+c.Middle+" "+c.Last), " ")),
+		slog.String("preferred", string(c.Preferred)),
+	}
+	add := func(k, v string) {
+		if v != "" {
+			attrs = append(attrs, slog.String(k, v))
+		}
+	}
+	add("email", string(c.Email))
+	add("mobile", string(c.Mobile))
+	add("home", string(c.Home))
+	add("office", string(c.Office))
+	if c.HasAddress() {
+		add("address", c.PostalAddress().String())
+	}
+	add("language", c.Language)
+	return slog.GroupValue(attrs...)
+}
+
+// Redact masks the value of a PII attribute, for slog.HandlerOptions:
+// emails keep their first letter and domain, phone numbers their last two
+// digits, and names and addresses the first letter of each word.
+// Errors, under "err", and reasons, under "reason", have any emails and
+// phone numbers in their text masked too.
+func Redact(groups []string, a slog.Attr) slog.Attr {
+	switch {
+	case a.Key == "err" || a.Key == "reason":
+		a.Value = slog.StringValue(MaskText(a.Value.String()))
+	case PIIKeys[a.Key] && a.Value.Kind() == slog.KindString:
+		a.Value = slog.StringValue(Mask(a.Value.String()))
+	}
+	return a
+}
+
+// PII holds a patient's phone number, email, name or address in an error
+// or other message, and prints masked.
+type PII string
+
+func (p PII) String() string {
+	return Mask(string(p))
+}
+
+var piiText = regexp.MustCompile(`[^\s"'<>@]+@[^\s"'<>@]+|\+?\(?\d[\d\-(). ]{5,}\d`)
+
+// MaskText masks the emails and phone numbers within free text, such as
+// an error from a provider, leaving the rest alone. Runs of fewer than ten
+// digits, like dates, aren't taken for phone numbers.
+func MaskText(s string) string {
+	return piiText.ReplaceAllStringFunc(s, func(m string) string {
+		var digits int
+		for _, r := range m {
+			if unicode.IsDigit(r) {
+				digits++
+			}
+		}
+		if !strings.Contains(m, "@") && digits < 10 {
+			return m
+		}
+		return Mask(m)
+	})
+}
+
+// Mask hides most of a phone number, email, name or address the way
+// Redact does, for printing.
+func Mask(s string) string {
+	if s == "" {
+		return s
+	}
+	if i := strings.LastIndexByte(s, '@'); i > 0 {
+		return s[:1] + "***" + s[i:]
+	}
+	var digits int
+	phone := true
+	for _, r := range s {
+		switch {
+		case unicode.IsDigit(r):
+			digits++
+		case !strings.ContainsRune("+-(). ", r):
+			phone = false
+		}
+	}
+	if phone && digits >= 7 {
+		// a phone number
+		var out []rune
+		seen := 0
+		for _, r := range s {
+			if unicode.IsDigit(r) {
+				seen++
+				if seen <= digits-2 {
+					r = '*'
+				}
+			}
+			out = append(out, r)
+		}
+		return string(out)
+	}
+	var words []string
+	for _, w := range strings.Fields(s) {
+		r := []rune(w)
+		words = append(words, string(r[:1])+"***")
+	}
+	return strings.Join(words, " ")
+}
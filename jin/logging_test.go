@@ -0,0 +1,70 @@
+package jin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestMaskText(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{"bad email: \"jane.doe@example.com\"", "bad email: \"j***@example.com\""},
+		{"can't send to +12125551234: queue full", "can't send to +*********34: queue full"},
+		{"call (212) 555-1234 now", "call (***) ***-**34 now"},
+		{"since 2026-10-19, 3 of 12 failed", "since 2026-10-19, 3 of 12 failed"},
+		{"no receipt for v2-0123abcd.json", "no receipt for v2-0123abcd.json"},
+	} {
+		if got := MaskText(c.in); got != c.want {
+			t.Errorf("MaskText(%q) = %q; want %q", c.in, got, c.want)
+		}
+	}
+}
+
+// Errors built around a patient's details don't carry them in the clear.
+func TestErrorsHidePII(t *testing.T) {
+	for _, err := range []error{
+		ContactInfo{Email: "jane.doe@example..com"}.ValidateEmail(),
+		ValidateNumber("2125551234"),
+		func() error { _, err := CleanNumber("call jane"); return err }(),
+		Decision{SMS: aws.String("+12125551234"), Email: aws.String("jane.doe@example.com")}.Validate(),
+		func() error {
+			_, err := ContactInfo{ID: "p1", Preferred: "pigeon", Email: "jane.doe@example.com"}.Decisions()
+			return err
+		}(),
+	} {
+		if err == nil {
+			t.Fatal("no error")
+		}
+		for _, s := range []string{"jane", "doe", "5551234"} {
+			if strings.Contains(err.Error(), s) {
+				t.Errorf("error %q shows %q", err, s)
+			}
+		}
+	}
+}
+
+func TestRedactErrors(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: Redact}))
+	err := fmt.Errorf("sending: %w", errors.New("twilio: +12125551234 is not a mobile number"))
+	log.Error("failed", "err", err, "to", "jane.doe@example.com", "id", "p1")
+	log.Info("suppressed", "reason", "replied STOP from +12125559876")
+	out := buf.String()
+	for _, s := range []string{"5551234", "jane.doe", "5559876"} {
+		if strings.Contains(out, s) {
+			t.Errorf("log shows %q: %s", s, out)
+		}
+	}
+	for _, s := range []string{"+*********34 is not a mobile number", "j***@example.com", "id=p1", "replied STOP from +*********76"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("log lacks %q: %s", s, out)
+		}
+	}
+}
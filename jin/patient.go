@@ -1,14 +1,17 @@
 package jin
 
 import (
+	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ttacon/libphonenumber"
+	"github.com/xoba/sms/store"
 )
 
 type ContactInfo struct {
@@ -21,6 +24,10 @@ type ContactInfo struct {
 	Home                Phone     `json:",omitempty"`
 	Address1, Address2  string    `json:",omitempty"`
 	City, State, Zip    string    `json:",omitempty"`
+	// AddressProblems make the address look undeliverable.
+	AddressProblems []string `json:",omitempty"`
+	Language        string   `json:",omitempty"` // iso 639-1 code
+	Priority        int      `json:",omitempty"` // higher is more urgent
 }
 
 func (c ContactInfo) Host() string {
@@ -33,7 +40,7 @@ var emailRegexp = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0
 
 func (c ContactInfo) ValidateEmail() error {
 	if !emailRegexp.MatchString(string(c.Email)) {
-		return fmt.Errorf("bad email: %q", c.Email)
+		return fmt.Errorf("bad email: %q", PII(c.Email))
 	}
 	return nil
 }
@@ -57,6 +64,8 @@ func (c ContactInfo) Decisions() ([]Decision, error) {
 		if err := d.Validate(); err != nil {
 			return
 		}
+		d.Patient = c.ID
+		d.Language = c.Language
 		out = append(out, d)
 	}
 	none := func() {
@@ -66,7 +75,9 @@ func (c ContactInfo) Decisions() ([]Decision, error) {
 		switch {
 		case c.Mobile != "":
 			add(NewPhone(c.Mobile))
-			add(NewSMS(c.Mobile))
+			if c.LineType(c.Mobile) == MobileLine {
+				add(NewSMS(c.Mobile))
+			}
 		case c.Home != "":
 			add(NewPhone(c.Home))
 		case c.Office != "":
@@ -85,7 +96,7 @@ func (c ContactInfo) Decisions() ([]Decision, error) {
 	case NoneSpecified:
 		none()
 	default:
-		return nil, fmt.Errorf("unknown preferred for %s", c)
+		return nil, fmt.Errorf("unknown preferred %q for %s", c.Preferred, c.ID)
 	}
 	for _, d := range out {
 		if err := d.Validate(); err != nil {
@@ -95,9 +106,32 @@ func (c ContactInfo) Decisions() ([]Decision, error) {
 	if len(out) == 0 {
 		none()
 	}
+	if len(out) == 0 && c.HasAddress() && len(c.AddressProblems) == 0 {
+		// by post only when there's no other way
+		add(NewLetter(c))
+	}
 	return out, nil
 }
 
+// Prefers reports whether the decision is by the patient's preferred
+// method of communication.
+func (c ContactInfo) Prefers(d Decision) bool {
+	phone := func(p Phone) bool {
+		return p != "" && d.Phone != nil && normalizePhone(string(p)) == d.Address()
+	}
+	switch c.Preferred {
+	case Email:
+		return d.Email != nil && d.Address() == strings.TrimSpace(strings.ToLower(string(c.Email)))
+	case Home:
+		return phone(c.Home)
+	case Mobile:
+		return phone(c.Mobile) || (c.Mobile != "" && d.SMS != nil && normalizePhone(string(c.Mobile)) == d.Address())
+	case Office:
+		return phone(c.Office)
+	}
+	return false
+}
+
 func (c ContactInfo) String() string {
 	buf, _ := json.Marshal(c)
 	return string(buf)
@@ -116,10 +150,10 @@ const (
 	NoneSpecified Preferred = "None"
 )
 
-func LoadContacts(svc *s3.S3) ([]ContactInfo, error) {
+func LoadContacts(ctx context.Context, s store.Store) ([]ContactInfo, error) {
 	var contacts []ContactInfo
 
-	lines, err := LoadCSV(svc)
+	lines, err := LoadCSV(ctx, s)
 	if err != nil {
 		return nil, err
 	}
@@ -142,6 +176,13 @@ func LoadContacts(svc *s3.S3) ([]ContactInfo, error) {
 			}
 			return strings.TrimSpace(linex[index])
 		}
+		// optional columns are blank when missing
+		optional := func(name string) string {
+			if _, ok := headerIndex[name]; !ok {
+				return ""
+			}
+			return field(name)
+		}
 		if field("Fake") == "No" { // filter out fake clients (why does this exist?)
 			contact := ContactInfo{
 				ID:       field("Patient Identifier"),
@@ -155,8 +196,26 @@ func LoadContacts(svc *s3.S3) ([]ContactInfo, error) {
 				State:    field("State"),
 				Zip:      field("Postal Code"),
 			}
+			lang, err := NormalizeLanguage(optional("Preferred Language"))
+			if err != nil {
+				return nil, fmt.Errorf("patient %s: %w", contact.ID, err)
+			}
+			contact.Language = lang
+			if p := optional("Priority"); p != "" {
+				n, err := strconv.Atoi(p)
+				if err != nil {
+					return nil, fmt.Errorf("patient %s: bad priority %q", contact.ID, p)
+				}
+				contact.Priority = n
+			}
+			if contact.Address1+contact.City+contact.State+contact.Zip != "" {
+				a, problems := NormalizeAddress(contact.PostalAddress())
+				contact.Address1, contact.Address2 = a.Address1, a.Address2
+				contact.City, contact.State, contact.Zip = a.City, a.State, a.Zip
+				contact.AddressProblems = problems
+			}
 			set := func(value *Phone, name string) error {
-				n, err := CleanNumber(field(name))
+				n, err := CleanNumberIn(field(name), Region(contact.State))
 				if err != nil {
 					return err
 				}
@@ -198,16 +257,12 @@ func LoadContacts(svc *s3.S3) ([]ContactInfo, error) {
 	return contacts, nil
 }
 
-func LoadCSV(svc *s3.S3) ([][]string, error) {
-	resp, err := svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String("drjin"),
-		Key:    aws.String("patients.csv"),
-	})
+func LoadCSV(ctx context.Context, s store.Store) ([][]string, error) {
+	buf, err := s.Get(ctx, "patients.csv")
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	lines, err := csv.NewReader(resp.Body).ReadAll()
+	lines, err := csv.NewReader(bytes.NewReader(buf)).ReadAll()
 	if err != nil {
 		return nil, err
 	}
@@ -215,14 +270,20 @@ func LoadCSV(svc *s3.S3) ([][]string, error) {
 }
 
 func CleanNumber(number string) (string, error) {
+	return CleanNumberIn(number, "US")
+}
+
+// CleanNumberIn formats a number in E.164, taking numbers without a
+// country code to be from the given region.
+func CleanNumberIn(number, region string) (string, error) {
 	if number == "" {
 		return "", nil
 	}
-	reg := regexp.MustCompile(`[^a-zA-Z0-9\+]+`)
-	number = reg.ReplaceAllString(number, "")
-	if !strings.HasPrefix(number, "+") {
-		number = "+1" + number
+	p, err := libphonenumber.Parse(number, region)
+	if err != nil {
+		return "", fmt.Errorf("bad number: %q: %w", PII(number), err)
 	}
+	number = libphonenumber.Format(p, libphonenumber.E164)
 	if err := ValidateNumber(number); err != nil {
 		return "", err
 	}
@@ -235,5 +296,5 @@ func ValidateNumber(phone string) error {
 	if e164.MatchString(phone) {
 		return nil
 	}
-	return fmt.Errorf("bad number: %q", phone)
+	return fmt.Errorf("bad number: %q", PII(phone))
 }
@@ -0,0 +1,104 @@
+package jin
+
+import (
+	"strings"
+
+	"github.com/ttacon/libphonenumber"
+)
+
+// territories maps ContactInfo.State codes of places with their own
+// numbering region; everywhere else defaults to the U.S.
+var territories = map[string]string{
+	"PR": "PR",
+	"VI": "VI",
+	"GU": "GU",
+	"AS": "AS",
+	"MP": "MP",
+}
+
+// Region is the libphonenumber region for numbers written without a
+// country code by a patient in the given state.
+func Region(state string) string {
+	if r, ok := territories[strings.ToUpper(strings.TrimSpace(state))]; ok {
+		return r
+	}
+	return "US"
+}
+
+// allowedRegions are those we contact; puerto rico and other territories
+// are deliberately left out, as is everywhere outside north america.
+var allowedRegions = map[string]bool{
+	"US": true,
+	"CA": true,
+}
+
+// parseNumber parses a number in E.164, as LoadContacts stores them after
+// applying the patient's Region, so the number's own country code decides
+// its region rather than a default.
+func parseNumber(n string) (*libphonenumber.PhoneNumber, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(n), "+") {
+		return nil, false
+	}
+	p, err := libphonenumber.Parse(n, "ZZ")
+	if err != nil {
+		return nil, false
+	}
+	return p, true
+}
+
+// IllegalNumber reports whether a number is invalid, such as one with an
+// unassigned area code or without a country code, or outside the regions
+// we contact.
+func IllegalNumber(n string) bool {
+	p, ok := parseNumber(n)
+	if !ok || !libphonenumber.IsValidNumber(p) {
+		return true
+	}
+	if !allowedRegions[libphonenumber.GetRegionCodeForNumber(p)] {
+		return true
+	}
+	switch {
+	case strings.HasPrefix(n, "+15550") || strings.HasPrefix(n, "+15551"):
+		// invalid area code parts
+		return true
+	}
+	return false
+}
+
+type LineType string
+
+const (
+	Landline    LineType = "landline"
+	MobileLine  LineType = "mobile"
+	UnknownLine LineType = "unknown"
+)
+
+// LineType guesses, offline, what kind of line one of the patient's
+// numbers is. North american numbers don't reveal this by themselves, so
+// then it goes by which column the number was listed in: home and office
+// numbers are taken to be landlines, as is a "mobile" that is also the
+// office number.
+func (c ContactInfo) LineType(p Phone) LineType {
+	n, ok := parseNumber(string(p))
+	if !ok || !libphonenumber.IsValidNumber(n) {
+		return UnknownLine
+	}
+	switch libphonenumber.GetNumberType(n) {
+	case libphonenumber.MOBILE:
+		return MobileLine
+	case libphonenumber.FIXED_LINE:
+		return Landline
+	case libphonenumber.FIXED_LINE_OR_MOBILE:
+	default:
+		return UnknownLine
+	}
+	switch p {
+	case c.Office:
+		return Landline
+	case c.Mobile:
+		return MobileLine
+	case c.Home:
+		return Landline
+	}
+	return UnknownLine
+}
@@ -0,0 +1,79 @@
+package jin
+
+import "testing"
+
+func TestRegion(t *testing.T) {
+	for state, want := range map[string]string{
+		"PR":  "PR",
+		" vi": "VI",
+		"GU":  "GU",
+		"NY":  "US",
+		"":    "US",
+	} {
+		if got := Region(state); got != want {
+			t.Errorf("Region(%q) = %s; want %s", state, got, want)
+		}
+	}
+}
+
+func TestCleanNumberIn(t *testing.T) {
+	for _, c := range []struct {
+		number, region, want string
+		bad                  bool
+	}{
+		{"(212) 688-8887", "US", "+12126888887", false},
+		{"212.688.8887", "US", "+12126888887", false},
+		{"787-725-7000", "PR", "+17877257000", false},
+		{"+44 20 7946 0000", "US", "+442079460000", false},
+		{"", "US", "", false},
+		{"call me", "US", "", true},
+	} {
+		got, err := CleanNumberIn(c.number, c.region)
+		if (err != nil) != c.bad || got != c.want {
+			t.Errorf("CleanNumberIn(%q, %s) = %q, %v; want %q", c.number, c.region, got, err, c.want)
+		}
+	}
+}
+
+func TestIllegalNumber(t *testing.T) {
+	for n, want := range map[string]bool{
+		"+12126888887":   false, // new york
+		"+14169671111":   false, // toronto
+		"+8613800138000": true,  // +8: asia
+		"+11234567890":   true,  // +11: no such area code
+		"+17877257000":   true,  // +1787: puerto rico
+		"+12115551234":   true,  // +1211: a service code, not an area code
+		"+19995551234":   true,  // unassigned area code
+		"+15550123456":   true,
+		"+442079460000":  true, // outside north america
+		"2126888887":     true, // not e.164
+		"":               true,
+	} {
+		if got := IllegalNumber(n); got != want {
+			t.Errorf("IllegalNumber(%q) = %v; want %v", n, got, want)
+		}
+	}
+}
+
+func TestLineType(t *testing.T) {
+	const us, uk = Phone("+12126888887"), Phone("+447911123456")
+	for _, c := range []struct {
+		name    string
+		contact ContactInfo
+		number  Phone
+		want    LineType
+	}{
+		{"mobile column", ContactInfo{Mobile: us}, us, MobileLine},
+		{"home column", ContactInfo{Home: us}, us, Landline},
+		{"office column", ContactInfo{Office: us}, us, Landline},
+		{"mobile that's the office", ContactInfo{Mobile: us, Office: us}, us, Landline},
+		{"a mobile number wherever listed", ContactInfo{Home: uk}, uk, MobileLine},
+		{"a landline number wherever listed", ContactInfo{Mobile: "+442079460000"}, "+442079460000", Landline},
+		{"invalid", ContactInfo{Mobile: "+11234567890"}, "+11234567890", UnknownLine},
+		{"unlisted", ContactInfo{}, us, UnknownLine},
+	} {
+		if got := c.contact.LineType(c.number); got != c.want {
+			t.Errorf("%s: got %s; want %s", c.name, got, c.want)
+		}
+	}
+}
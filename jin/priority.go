@@ -0,0 +1,122 @@
+package jin
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prioritizer ranks a decision; lower ranks are contacted first.
+type Prioritizer func(Decision) float64
+
+// Orders are the prioritizers that can be named with -order, given
+// the contacts the decisions came from and a cost estimate.
+var Orders = map[string]func(contacts []ContactInfo, estimate func(Decision) float64) Prioritizer{
+	// no preference, just the seeded tie-break
+	"random": func([]ContactInfo, func(Decision) float64) Prioritizer {
+		return func(Decision) float64 { return 0 }
+	},
+	// patients who asked to be reached this way
+	"preferred": func(contacts []ContactInfo, _ func(Decision) float64) Prioritizer {
+		byID := contactsByID(contacts)
+		return func(d Decision) float64 {
+			if c, ok := byID[d.Patient]; ok && c.Prefers(d) {
+				return 0
+			}
+			return 1
+		}
+	},
+	"cheapest": func(_ []ContactInfo, estimate func(Decision) float64) Prioritizer {
+		return estimate
+	},
+	// patients with fewest decisions, so those with a single way to be
+	// reached aren't left for last
+	"sole": func(contacts []ContactInfo, _ func(Decision) float64) Prioritizer {
+		n := make(map[string]int)
+		for _, c := range contacts {
+			decisions, err := c.Decisions()
+			if err != nil {
+				continue
+			}
+			n[c.ID] = len(decisions)
+		}
+		return func(d Decision) float64 {
+			return float64(n[d.Patient])
+		}
+	},
+	// the csv's Priority column, highest first
+	"priority": func(contacts []ContactInfo, _ func(Decision) float64) Prioritizer {
+		byID := contactsByID(contacts)
+		return func(d Decision) float64 {
+			return -float64(byID[d.Patient].Priority)
+		}
+	},
+}
+
+func contactsByID(contacts []ContactInfo) map[string]ContactInfo {
+	m := make(map[string]ContactInfo)
+	for _, c := range contacts {
+		m[c.ID] = c
+	}
+	return m
+}
+
+// OrderNames lists the orders, sorted.
+func OrderNames() []string {
+	var out []string
+	for k := range Orders {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ParseOrder returns the prioritizers for a comma-separated list of
+// orders, like "sole,cheapest", each breaking ties in the one before.
+func ParseOrder(order string, contacts []ContactInfo, estimate func(Decision) float64) ([]Prioritizer, error) {
+	var out []Prioritizer
+	for _, name := range strings.Split(order, ",") {
+		f, ok := Orders[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown order %q; want some of %v", name, OrderNames())
+		}
+		out = append(out, f(contacts, estimate))
+	}
+	return out, nil
+}
+
+// Prioritize sorts decisions by the prioritizers in turn. Remaining ties
+// are broken by a hash of the seed and the decision's key, so the same
+// seed always gives the same order.
+func Prioritize(decisions []Decision, seed int64, prioritizers ...Prioritizer) {
+	type ranked struct {
+		d     Decision
+		ranks []float64
+		tie   uint64
+	}
+	list := make([]ranked, len(decisions))
+	for i, d := range decisions {
+		r := ranked{d: d}
+		for _, p := range prioritizers {
+			r.ranks = append(r.ranks, p(d))
+		}
+		h := sha256.Sum256([]byte(strconv.FormatInt(seed, 10) + "|" + d.Key()))
+		r.tie = binary.BigEndian.Uint64(h[:8])
+		list[i] = r
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		for k := range a.ranks {
+			if a.ranks[k] != b.ranks[k] {
+				return a.ranks[k] < b.ranks[k]
+			}
+		}
+		return a.tie < b.tie
+	})
+	for i, r := range list {
+		decisions[i] = r.d
+	}
+}
@@ -0,0 +1,94 @@
+package jin
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func patients(decisions []Decision) []string {
+	var out []string
+	for _, d := range decisions {
+		out = append(out, d.Patient+" "+d.Type())
+	}
+	return out
+}
+
+func emailDecision(patient string) Decision {
+	d := NewEmail(Addr(patient + "@example.com"))
+	d.Patient = patient
+	return d
+}
+
+// The seed alone decides how ties fall, whatever order the decisions
+// come in.
+func TestPrioritizeSeeded(t *testing.T) {
+	var decisions []Decision
+	for i := 0; i < 20; i++ {
+		decisions = append(decisions, emailDecision(fmt.Sprintf("p%d", i)))
+	}
+	order := func(seed int64, reverse bool) []string {
+		list := append([]Decision(nil), decisions...)
+		if reverse {
+			for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+				list[i], list[j] = list[j], list[i]
+			}
+		}
+		Prioritize(list, seed)
+		return patients(list)
+	}
+	a := order(1, false)
+	if b := order(1, true); !reflect.DeepEqual(a, b) {
+		t.Fatalf("same seed, different orders:\n%v\n%v", a, b)
+	}
+	if c := order(2, false); reflect.DeepEqual(a, c) {
+		t.Fatalf("seeds 1 and 2 gave the same order %v", a)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	contacts := []ContactInfo{
+		{ID: "low", Priority: 1, Preferred: NoneSpecified, Email: "low@example.com", Home: "+12126888887"},
+		{ID: "high", Priority: 9, Preferred: NoneSpecified, Email: "high@example.com"},
+		{ID: "mid", Priority: 5, Preferred: Email, Email: "mid@example.com", Home: "+12126888888"},
+	}
+	var decisions []Decision
+	for _, c := range contacts {
+		list, err := c.Decisions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decisions = append(decisions, list...)
+	}
+	estimate := func(d Decision) float64 {
+		return map[string]float64{"email": 0.01, "phone": 0.05}[d.Type()]
+	}
+	for _, c := range []struct {
+		order string
+		want  []string
+	}{
+		// highest priority first, ties by seed
+		{"priority,cheapest", []string{"high email", "mid email", "low email", "low phone"}},
+		// those with a single way to be reached first
+		{"sole,priority,cheapest", []string{"high email", "mid email", "low email", "low phone"}},
+		{"cheapest,priority", []string{"high email", "mid email", "low email", "low phone"}},
+		// what patients asked for first
+		{"preferred,priority,cheapest", []string{"mid email", "high email", "low email", "low phone"}},
+	} {
+		prioritizers, err := ParseOrder(c.order, contacts, estimate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := append([]Decision(nil), decisions...)
+		Prioritize(list, 1, prioritizers...)
+		if got := patients(list); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v; want %v", c.order, got, c.want)
+		}
+	}
+	if _, err := ParseOrder("random, sole", contacts, estimate); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseOrder("priority,newest", contacts, estimate); err == nil {
+		t.Fatal("parsed an unknown order")
+	}
+}
@@ -0,0 +1,290 @@
+package jin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/kevinburke/twilio-go"
+	"github.com/xoba/sms/saws"
+	"github.com/xoba/sms/stw"
+)
+
+// ErrUnknown means a provider can't tell whether a message was sent.
+var ErrUnknown = errors.New("provider can't tell")
+
+// Provider carries out decisions, returning the provider's response for
+// the receipt. The Find methods search the provider's logs for a message
+// sent since the given time, returning nil if there is none.
+type Provider interface {
+	Mailer
+
+	MakeCall(to, twimlURL string) (interface{}, error)
+	// Say calls to speak text, rather than play a twiml url.
+	Say(to string, v Voice, text string) (interface{}, error)
+	SendSMS(to, body string) (interface{}, error)
+	SendEmail(e saws.Email) (interface{}, error)
+
+	FindCall(to string, since time.Time) (interface{}, error)
+	FindSMS(to string, since time.Time) (interface{}, error)
+	FindEmail(to string, since time.Time) (interface{}, error)
+
+	// Inbound lists sms replies received since the given time.
+	Inbound(since time.Time) ([]InboundMessage, error)
+
+	// Refresh returns the provider's latest record of what was sent, as
+	// in a receipt's Content, like a twilio message with its final price.
+	Refresh(content interface{}) (interface{}, error)
+}
+
+type InboundMessage struct {
+	ID   string
+	Time time.Time
+	From string
+	Body string
+}
+
+// Live contacts patients for real, through Twilio, SES and Mail.
+type Live struct {
+	SES    *ses.SES
+	Twilio *twilio.Client
+	Mail   Mailer
+}
+
+func (l Live) SendLetter(m Letter) (interface{}, error) {
+	if l.Mail == nil {
+		return nil, fmt.Errorf("no mailer")
+	}
+	return l.Mail.SendLetter(m)
+}
+
+func (l Live) FindLetter(to PostalAddress, since time.Time) (interface{}, error) {
+	if l.Mail == nil {
+		return nil, ErrUnknown
+	}
+	return l.Mail.FindLetter(to, since)
+}
+
+func (l Live) MakeCall(to, twimlURL string) (interface{}, error) {
+	return stw.MakeCall(l.Twilio, TwilioNumber, to, twimlURL)
+}
+
+func (l Live) Say(to string, v Voice, text string) (interface{}, error) {
+	return stw.Say(l.Twilio, TwilioNumber, to, v.Name, v.Locale, text)
+}
+
+func (l Live) SendSMS(to, body string) (interface{}, error) {
+	return stw.SendSMS(l.Twilio, TwilioNumber, to, body)
+}
+
+// SendEmail uses a raw message only when the email needs one, for
+// attachments or extra headers.
+func (l Live) SendEmail(e saws.Email) (interface{}, error) {
+	if e.NeedsRaw() {
+		return saws.SendRawEmail(l.SES, e)
+	}
+	return saws.SendEmail(l.SES, e.From, e.To, e.Subject, e.Text, e.HTML)
+}
+
+func (l Live) FindCall(to string, since time.Time) (interface{}, error) {
+	calls, err := stw.FindCalls(l.Twilio, TwilioNumber, to, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range calls {
+		if c.DateCreated.Valid && !c.DateCreated.Time.Before(since) {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (l Live) FindSMS(to string, since time.Time) (interface{}, error) {
+	messages, err := stw.FindMessages(l.Twilio, TwilioNumber, to, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		if m.DateCreated.Valid && !m.DateCreated.Time.Before(since) {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+func (l Live) Inbound(since time.Time) ([]InboundMessage, error) {
+	messages, err := stw.FindMessages(l.Twilio, "", TwilioNumber, since)
+	if err != nil {
+		return nil, err
+	}
+	var out []InboundMessage
+	for _, m := range messages {
+		if m.Direction != twilio.DirectionInbound || !m.DateCreated.Valid || m.DateCreated.Time.Before(since) {
+			continue
+		}
+		out = append(out, InboundMessage{
+			ID:   m.Sid,
+			Time: m.DateCreated.Time,
+			From: string(m.From),
+			Body: m.Body,
+		})
+	}
+	return out, nil
+}
+
+func (l Live) Refresh(content interface{}) (interface{}, error) {
+	switch c := content.(type) {
+	case *twilio.Message:
+		return stw.GetMessage(l.Twilio, c.Sid)
+	case *twilio.Call:
+		return stw.GetCall(l.Twilio, c.Sid)
+	}
+	return content, nil
+}
+
+// FindEmail always fails, since SES keeps no searchable log of sent mail,
+// and a message's id is only known once SendEmail returns, which is just
+// what an interrupted run lost. Reconcile needs -assume to settle email
+// entries.
+func (l Live) FindEmail(to string, since time.Time) (interface{}, error) {
+	return nil, ErrUnknown
+}
+
+// Outbox is a local stand-in for Live, writing each message to a json
+// file in Dir instead of sending it.
+type Outbox struct {
+	Dir string
+}
+
+type OutboxMessage struct {
+	ID      string
+	Time    time.Time
+	Type    string
+	To      string
+	Subject string `json:",omitempty"`
+	Body    string `json:",omitempty"`
+	HTML    string `json:",omitempty"`
+	URL     string `json:",omitempty"`
+	Voice   string `json:",omitempty"`
+	// Files lists attachments and inline images of an email, whose
+	// full MIME form is written alongside as <ID>.eml.
+	Files []saws.Attachment `json:",omitempty"`
+}
+
+func (o Outbox) write(m OutboxMessage, raw []byte) (interface{}, error) {
+	if err := os.MkdirAll(o.Dir, 0700); err != nil {
+		return nil, err
+	}
+	m.Time = time.Now()
+	m.ID = fmt.Sprintf("%s-%d-%d", m.Type, m.Time.UnixNano(), os.Getpid())
+	if raw != nil {
+		if err := os.WriteFile(filepath.Join(o.Dir, m.ID+".eml"), raw, 0600); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(o.Dir, m.ID+".json"), buf, 0600); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (o Outbox) MakeCall(to, twimlURL string) (interface{}, error) {
+	return o.write(OutboxMessage{Type: "phone", To: to, URL: twimlURL}, nil)
+}
+
+func (o Outbox) Say(to string, v Voice, text string) (interface{}, error) {
+	return o.write(OutboxMessage{Type: "phone", To: to, Body: text, Voice: v.Name}, nil)
+}
+
+func (o Outbox) SendSMS(to, body string) (interface{}, error) {
+	return o.write(OutboxMessage{Type: "sms", To: to, Body: body}, nil)
+}
+
+// SendEmail renders the email as SES would get it, so that size limits
+// apply here too.
+func (o Outbox) SendEmail(e saws.Email) (interface{}, error) {
+	raw, err := e.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	m := OutboxMessage{Type: "email", To: e.To, Subject: e.Subject, Body: e.Text, HTML: e.HTML}
+	m.Files = append(append(m.Files, e.Attachments...), e.Inline...)
+	return o.write(m, raw)
+}
+
+func (o Outbox) SendLetter(l Letter) (interface{}, error) {
+	return PrintBatch{Dir: o.Dir}.SendLetter(l)
+}
+
+func (o Outbox) FindLetter(to PostalAddress, since time.Time) (interface{}, error) {
+	return PrintBatch{Dir: o.Dir}.FindLetter(to, since)
+}
+
+func (o Outbox) find(typ, to string, since time.Time) (interface{}, error) {
+	names, err := filepath.Glob(filepath.Join(o.Dir, typ+"-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		buf, err := os.ReadFile(n)
+		if err != nil {
+			return nil, err
+		}
+		var m OutboxMessage
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return nil, fmt.Errorf("can't unmarshal %s: %w", n, err)
+		}
+		if m.To == to && !m.Time.Before(since) {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+func (o Outbox) FindCall(to string, since time.Time) (interface{}, error) {
+	return o.find("phone", to, since)
+}
+
+func (o Outbox) FindSMS(to string, since time.Time) (interface{}, error) {
+	return o.find("sms", to, since)
+}
+
+func (o Outbox) FindEmail(to string, since time.Time) (interface{}, error) {
+	return o.find("email", to, since)
+}
+
+// Refresh has nothing newer, since nothing was sent.
+func (o Outbox) Refresh(content interface{}) (interface{}, error) {
+	return content, nil
+}
+
+// Inbound reads replies left as json files in the "inbound" subdirectory.
+func (o Outbox) Inbound(since time.Time) ([]InboundMessage, error) {
+	names, err := filepath.Glob(filepath.Join(o.Dir, "inbound", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out []InboundMessage
+	for _, n := range names {
+		buf, err := os.ReadFile(n)
+		if err != nil {
+			return nil, err
+		}
+		var m InboundMessage
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return nil, fmt.Errorf("can't unmarshal %s: %w", n, err)
+		}
+		if !m.Time.Before(since) {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
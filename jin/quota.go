@@ -0,0 +1,140 @@
+package jin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xoba/sms/store"
+)
+
+// QuotaPrefix is where each day's sends are counted by channel, one
+// object per send, so that counts hold across restarts and campaigns.
+const QuotaPrefix = "quotas"
+
+// Quotas are the most sends a day by channel: phone, sms, email or mail.
+// Channels without a quota are unlimited.
+type Quotas map[string]int
+
+var channels = map[string]bool{"phone": true, "sms": true, "email": true, "mail": true}
+
+// ParseQuotas parses quotas like "phone=200,sms=500,email=2000".
+func ParseQuotas(s string) (Quotas, error) {
+	q := make(Quotas)
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(x, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad quota %q", x)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad quota %q", x)
+		}
+		if !channels[k] {
+			return nil, fmt.Errorf("bad quota %q: no such channel %q", x, k)
+		}
+		q[k] = n
+	}
+	return q, nil
+}
+
+func (q Quotas) String() string {
+	var list []string
+	for k, v := range q {
+		list = append(list, fmt.Sprintf("%s=%d", k, v))
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// Allows reports whether another send on the channel fits in the quota,
+// given what's been used today.
+func (q Quotas) Allows(used map[string]int, channel string) bool {
+	n, ok := q[channel]
+	return !ok || used[channel] < n
+}
+
+func day(t time.Time) string {
+	return t.Local().Format("2006-01-02")
+}
+
+// QuotaUsed counts the day's sends by channel.
+func QuotaUsed(ctx context.Context, s store.Store, t time.Time) (map[string]int, error) {
+	keys, err := s.List(ctx, path.Join(QuotaPrefix, day(t))+"/")
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]int)
+	for _, k := range keys {
+		// quotas/<day>/<channel>/<key>
+		used[path.Base(path.Dir(k))]++
+	}
+	return used, nil
+}
+
+// ReserveQuota takes one of the day's numbered slots under
+// quotas/<day>/<channel>/ for a send on a channel with a quota, returning
+// the slot's key, or ok false if none are left. Slots are created, never
+// overwritten, so runners of any campaign share them without going over.
+// Channels without a quota need no slot, and get an empty key. Delete the
+// slot if nothing ends up sent.
+func (q Quotas) ReserveQuota(ctx context.Context, s store.Store, channel string, t time.Time) (key string, ok bool, err error) {
+	if _, limited := q[channel]; !limited {
+		return "", true, nil
+	}
+	dir := path.Join(QuotaPrefix, day(t), channel)
+	for tries := 0; tries < 100; tries++ {
+		keys, err := s.List(ctx, dir+"/")
+		if err != nil {
+			return "", false, err
+		}
+		taken := make(map[int]bool)
+		for _, k := range keys {
+			if n, err := strconv.Atoi(strings.TrimPrefix(path.Base(k), "slot-")); err == nil {
+				taken[n] = true
+			}
+		}
+		if !q.Allows(map[string]int{channel: len(taken)}, channel) {
+			return "", false, nil
+		}
+		lost := false
+		for n := 0; n < q[channel]; n++ {
+			if taken[n] {
+				continue
+			}
+			key = path.Join(dir, fmt.Sprintf("slot-%06d", n))
+			err := s.Create(ctx, key, []byte(t.Format(time.RFC3339)))
+			if errors.Is(err, store.ErrExists) {
+				// somebody else took it; look again
+				lost = true
+				break
+			} else if err != nil {
+				return "", false, err
+			}
+			return key, true, nil
+		}
+		if !lost {
+			return "", false, nil
+		}
+	}
+	return "", false, fmt.Errorf("can't reserve a %s quota slot", channel)
+}
+
+// UseQuota counts a send against the quota for the day it was made, for
+// channels that don't reserve a slot beforehand.
+func UseQuota(ctx context.Context, s store.Store, r Receipt) error {
+	key := path.Join(QuotaPrefix, day(r.Time), r.Decision.Type(), r.Decision.Key())
+	err := s.Create(ctx, key, []byte(r.Time.Format(time.RFC3339)))
+	if errors.Is(err, store.ErrExists) {
+		return nil
+	}
+	return err
+}
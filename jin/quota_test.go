@@ -0,0 +1,149 @@
+package jin
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseQuotas(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want Quotas
+		bad  bool
+	}{
+		{"", Quotas{}, false},
+		{"phone=200,sms=500, email=2000,", Quotas{"phone": 200, "sms": 500, "email": 2000}, false},
+		{"mail=0", Quotas{"mail": 0}, false},
+		{"sms", nil, true},
+		{"sms=lots", nil, true},
+		{"sms=-1", nil, true},
+		{"fax=10", nil, true},
+	} {
+		q, err := ParseQuotas(c.in)
+		if c.bad {
+			if err == nil {
+				t.Errorf("ParseQuotas(%q) = %v; want an error", c.in, q)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(q, c.want) {
+			t.Errorf("ParseQuotas(%q) = %v, %v; want %v", c.in, q, err, c.want)
+		}
+	}
+	if s := (Quotas{"sms": 5, "email": 10}).String(); s != "email=10,sms=5" {
+		t.Errorf("String is %q", s)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	q := Quotas{"sms": 2, "mail": 0}
+	for _, c := range []struct {
+		channel string
+		used    int
+		want    bool
+	}{
+		{"sms", 0, true},
+		{"sms", 1, true},
+		{"sms", 2, false},
+		{"sms", 3, false},
+		{"mail", 0, false},
+		{"email", 1000, true},
+	} {
+		if got := q.Allows(map[string]int{c.channel: c.used}, c.channel); got != c.want {
+			t.Errorf("Allows %d %s = %v; want %v", c.used, c.channel, got, c.want)
+		}
+	}
+}
+
+func TestQuotaUsed(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	today := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+	tomorrow := today.AddDate(0, 0, 1)
+	for i, r := range []Receipt{
+		{Time: today, Decision: NewSMS("+12125550100")},
+		{Time: today, Decision: NewSMS("+12125550101")},
+		{Time: today, Decision: NewEmail("a@example.com")},
+		{Time: tomorrow, Decision: NewSMS("+12125550102")},
+	} {
+		if err := UseQuota(ctx, s, r); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// counting the same send twice is harmless
+			if err := UseQuota(ctx, s, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, c := range []struct {
+		t    time.Time
+		want map[string]int
+	}{
+		{today, map[string]int{"sms": 2, "email": 1}},
+		{tomorrow, map[string]int{"sms": 1}},
+		{today.AddDate(0, 0, -1), map[string]int{}},
+	} {
+		used, err := QuotaUsed(ctx, s, c.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(used, c.want) {
+			t.Errorf("used %v on %s; want %v", used, day(c.t), c.want)
+		}
+	}
+}
+
+// Runners reserving at once get no more slots than the quota between
+// them, and a released slot can be taken again.
+func TestReserveQuota(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	q := Quotas{"sms": 5}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+
+	var mu sync.Mutex
+	var slots []string
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, ok, err := q.ReserveQuota(ctx, s, "sms", now)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				slots = append(slots, key)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(slots) != 5 {
+		t.Fatalf("reserved %d slots of 5", len(slots))
+	}
+	if used, err := QuotaUsed(ctx, s, now); err != nil || used["sms"] != 5 {
+		t.Fatalf("used %v, %v", used, err)
+	}
+	if _, ok, err := q.ReserveQuota(ctx, s, "sms", now); ok || err != nil {
+		t.Fatalf("reserved past the quota: %v", err)
+	}
+	if err := s.Delete(ctx, slots[2]); err != nil {
+		t.Fatal(err)
+	}
+	if key, ok, err := q.ReserveQuota(ctx, s, "sms", now); !ok || err != nil || key != slots[2] {
+		t.Fatalf("got %q, %v, %v; want the released slot %s", key, ok, err, slots[2])
+	}
+	if _, ok, err := q.ReserveQuota(ctx, s, "sms", now.AddDate(0, 0, 1)); !ok || err != nil {
+		t.Fatalf("no slot the next day: %v", err)
+	}
+	if key, ok, err := q.ReserveQuota(ctx, s, "email", now); key != "" || !ok || err != nil {
+		t.Fatalf("got %q, %v, %v for a channel without a quota", key, ok, err)
+	}
+}
@@ -0,0 +1,321 @@
+package jin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xoba/sms/store"
+)
+
+// ReplyPrefix and PatientPrefix are where replies and what we've learned
+// from them about each patient are stored.
+const (
+	ReplyPrefix   = "replies"
+	PatientPrefix = "patients"
+)
+
+// PCP is a patient's new primary care provider, where records go.
+type PCP struct {
+	Name  string `json:",omitempty"`
+	Phone string `json:",omitempty"`
+	Fax   string `json:",omitempty"`
+}
+
+func (p PCP) String() string {
+	buf, _ := json.Marshal(p)
+	return string(buf)
+}
+
+// Reply is a message from a patient, by sms or email, with the PCP
+// details parsed from it. Parses with Problems need a human to review
+// them before they're attached to the patient.
+type Reply struct {
+	ID       string
+	Time     time.Time
+	Channel  string // sms or email
+	From     string
+	Body     string
+	Patient  string   `json:",omitempty"` // ContactInfo.ID, if the sender is known
+	PCP      PCP      `json:",omitempty"`
+	Problems []string `json:",omitempty"`
+	Reviewed bool     `json:",omitempty"`
+}
+
+func (r Reply) Key() string {
+	return path.Join(ReplyPrefix, safeKey(r.ID)+".json")
+}
+
+func safeKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == '@':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// NeedsReview reports whether the parse is low-confidence and hasn't
+// been looked at.
+func (r Reply) NeedsReview() bool {
+	return len(r.Problems) > 0 && !r.Reviewed
+}
+
+var (
+	// quoted text and what follows a reply header is our own message,
+	// which mentions a doctor and her number
+	quoteStart = regexp.MustCompile(`(?im)^(>|on .+ wrote:|-+ ?original message ?-+|from: )`)
+
+	numberRegexp = regexp.MustCompile(`(?:\+?1[\s.-]*)?\(?\d{3}\)?[\s.-]*\d{3}[\s.-]*\d{4}`)
+	faxLabel     = regexp.MustCompile(`(?i)\bfax\b|\bf\s*[:#]`)
+	phoneLabel   = regexp.MustCompile(`(?i)\b(phone|tel|telephone|ph|office|call|number|cell|p)\b\s*[:#]?`)
+
+	nameLabel   = regexp.MustCompile(`(?i)\b(?:(?:new\s+)?(?:pcp|doctor|physician|provider)(?:'?s)?(?:\s+name)?|name)\s*(?:is|:|-)\s*([^\n,;:]+)`)
+	doctorTitle = regexp.MustCompile(`\b(?:Dr\.?|Doctor)\s+([A-Z][A-Za-z'-]+(?:\s+[A-Z]\.)?(?:\s+[A-Z][A-Za-z'-]+)?)`)
+	mdSuffix    = regexp.MustCompile(`\b([A-Z][A-Za-z'-]+(?:\s+[A-Z]\.)?\s+[A-Z][A-Za-z'-]+),?\s+M\.?D\.?\b`)
+	nameEnd     = regexp.MustCompile(`(?i)\s*(\d|\(|\bphone\b|\btel\b|\bfax\b|\band\b|\bat\b|\bwith\b|\bin\b).*$`)
+)
+
+// unquoted drops quoted text from a reply.
+func unquoted(body string) string {
+	if loc := quoteStart.FindStringIndex(body); loc != nil {
+		return body[:loc[0]]
+	}
+	return body
+}
+
+// ParsePCP extracts a PCP name, phone and fax from a reply, returning the
+// problems that make the parse low-confidence, if any.
+func ParsePCP(body string) (PCP, []string) {
+	var pcp PCP
+	var problems []string
+	body = unquoted(body)
+
+	// numbers are labeled by the text just before them on the same line
+	var unlabeled []string
+	for _, loc := range numberRegexp.FindAllStringIndex(body, -1) {
+		n, err := CleanNumber(body[loc[0]:loc[1]])
+		if err != nil || IllegalNumber(n) {
+			problems = append(problems, fmt.Sprintf("bad number %q", body[loc[0]:loc[1]]))
+			continue
+		}
+		before := body[:loc[0]]
+		if i := strings.LastIndexAny(before, "\n"); i >= 0 {
+			before = before[i+1:]
+		}
+		if len(before) > 24 {
+			before = before[len(before)-24:]
+		}
+		switch {
+		case faxLabel.MatchString(before):
+			if pcp.Fax != "" && pcp.Fax != n {
+				problems = append(problems, "several fax numbers")
+			}
+			pcp.Fax = n
+		case phoneLabel.MatchString(before):
+			if pcp.Phone != "" && pcp.Phone != n {
+				problems = append(problems, "several phone numbers")
+			}
+			pcp.Phone = n
+		default:
+			unlabeled = append(unlabeled, n)
+		}
+	}
+	// unlabeled numbers fill in phone then fax, as the message asks
+	for _, n := range unlabeled {
+		switch {
+		case n == pcp.Phone || n == pcp.Fax:
+		case pcp.Phone == "":
+			pcp.Phone = n
+			problems = append(problems, "unlabeled phone")
+		case pcp.Fax == "":
+			pcp.Fax = n
+			problems = append(problems, "unlabeled fax")
+		default:
+			problems = append(problems, fmt.Sprintf("extra number %s", n))
+		}
+	}
+
+	names := make(map[string]bool)
+	var list []string
+	add := func(s string) {
+		s = strings.TrimSpace(nameEnd.ReplaceAllString(s, ""))
+		s = strings.Trim(s, " .-")
+		if s == "" || names[strings.ToLower(s)] {
+			return
+		}
+		names[strings.ToLower(s)] = true
+		list = append(list, s)
+	}
+	for _, m := range nameLabel.FindAllStringSubmatch(body, -1) {
+		add(m[1])
+	}
+	labeled := len(list) > 0
+	for _, m := range doctorTitle.FindAllStringSubmatch(body, -1) {
+		if !labeled {
+			add("Dr. " + m[1])
+		}
+	}
+	for _, m := range mdSuffix.FindAllStringSubmatch(body, -1) {
+		if !labeled {
+			add(m[1] + " MD")
+		}
+	}
+	switch {
+	case len(list) == 0:
+		problems = append(problems, "no name")
+	case len(list) > 1:
+		problems = append(problems, fmt.Sprintf("several names: %s", strings.Join(list, "; ")))
+		pcp.Name = list[0]
+	default:
+		pcp.Name = list[0]
+	}
+	if pcp.Phone == "" {
+		problems = append(problems, "no phone")
+	}
+	if pcp.Fax == "" {
+		problems = append(problems, "no fax")
+	}
+	sort.Strings(problems)
+	return pcp, problems
+}
+
+// PatientRecord is what replies have told us about a patient.
+type PatientRecord struct {
+	ID      string
+	PCP     *PCP      `json:",omitempty"`
+	Updated time.Time `json:",omitempty"`
+	Replies []string  `json:",omitempty"` // ids of replies from the patient
+}
+
+func patientKey(id string) string {
+	return path.Join(PatientPrefix, safeKey(id)+".json")
+}
+
+// LoadPatientRecord returns an empty record if there's none yet.
+func LoadPatientRecord(ctx context.Context, s store.Store, id string) (*PatientRecord, error) {
+	buf, err := s.Get(ctx, patientKey(id))
+	if errors.Is(err, store.ErrNotFound) {
+		return &PatientRecord{ID: id}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var r PatientRecord
+	if err := json.Unmarshal(buf, &r); err != nil {
+		return nil, fmt.Errorf("can't unmarshal patient %s: %w", id, err)
+	}
+	return &r, nil
+}
+
+func (r PatientRecord) Save(ctx context.Context, s store.Store) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, patientKey(r.ID), buf)
+}
+
+// RepliedPatients returns the ids of patients who have replied.
+func RepliedPatients(ctx context.Context, s store.Store) (map[string]bool, error) {
+	keys, err := s.List(ctx, PatientPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]bool)
+	for _, k := range keys {
+		buf, err := s.Get(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		var r PatientRecord
+		if err := json.Unmarshal(buf, &r); err != nil {
+			return nil, fmt.Errorf("can't unmarshal %s: %w", k, err)
+		}
+		if len(r.Replies) > 0 {
+			out[r.ID] = true
+		}
+	}
+	return out, nil
+}
+
+// AttachReply adds the reply to its patient's record, taking its PCP if
+// the parse needs no review or has been reviewed.
+func AttachReply(ctx context.Context, s store.Store, reply Reply) (*PatientRecord, error) {
+	if reply.Patient == "" {
+		return nil, fmt.Errorf("reply %s is from an unknown sender", reply.ID)
+	}
+	r, err := LoadPatientRecord(ctx, s, reply.Patient)
+	if err != nil {
+		return nil, err
+	}
+	seen := false
+	for _, id := range r.Replies {
+		seen = seen || id == reply.ID
+	}
+	if !seen {
+		r.Replies = append(r.Replies, reply.ID)
+	}
+	if !reply.NeedsReview() && reply.PCP != (PCP{}) {
+		pcp := reply.PCP
+		r.PCP = &pcp
+		r.Updated = reply.Time
+	}
+	return r, r.Save(ctx, s)
+}
+
+// SaveReply stores a reply, failing with store.ErrExists if it was
+// already ingested.
+func SaveReply(ctx context.Context, s store.Store, r Reply, create bool) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if create {
+		return s.Create(ctx, r.Key(), buf)
+	}
+	return s.Put(ctx, r.Key(), buf)
+}
+
+func LoadReply(ctx context.Context, s store.Store, key string) (*Reply, error) {
+	buf, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var r Reply
+	if err := json.Unmarshal(buf, &r); err != nil {
+		return nil, fmt.Errorf("can't unmarshal %s: %w", key, err)
+	}
+	return &r, nil
+}
+
+// Senders maps the normalized phone numbers and email addresses of
+// patients to their ids.
+func Senders(contacts []ContactInfo) map[string]string {
+	m := make(map[string]string)
+	for _, c := range contacts {
+		for _, p := range []Phone{c.Mobile, c.Home, c.Office} {
+			if p != "" {
+				m[normalizePhone(string(p))] = c.ID
+			}
+		}
+		if c.Email != "" {
+			m[strings.ToLower(strings.TrimSpace(string(c.Email)))] = c.ID
+		}
+	}
+	return m
+}
+
+// Sender finds the patient a reply came from.
+func Sender(senders map[string]string, from string) string {
+	if strings.Contains(from, "@") {
+		return senders[strings.ToLower(strings.TrimSpace(from))]
+	}
+	return senders[normalizePhone(from)]
+}
@@ -0,0 +1,236 @@
+package jin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/xoba/sms/store"
+)
+
+// SuppressionPrefix holds the suppression list, shared by all campaigns.
+const SuppressionPrefix = "suppressions"
+
+type SuppressionKind string
+
+const (
+	SuppressPhone   SuppressionKind = "phone"
+	SuppressEmail   SuppressionKind = "email"
+	SuppressPatient SuppressionKind = "patient"
+)
+
+// Suppression is a phone number, email address or patient that must never
+// be contacted again.
+type Suppression struct {
+	Kind   SuppressionKind
+	Value  string
+	Reason string
+	Time   time.Time
+}
+
+func (s Suppression) String() string {
+	buf, _ := json.Marshal(s)
+	return string(buf)
+}
+
+// NewSuppression normalizes value, so that it matches decisions.
+func NewSuppression(kind SuppressionKind, value, reason string) (*Suppression, error) {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case SuppressPhone:
+		n, err := CleanNumber(value)
+		if err != nil {
+			return nil, err
+		}
+		value = n
+	case SuppressEmail:
+		value = strings.ToLower(value)
+	case SuppressPatient:
+	default:
+		return nil, fmt.Errorf("illegal suppression kind: %q", kind)
+	}
+	if value == "" {
+		return nil, fmt.Errorf("empty %s suppression", kind)
+	}
+	return &Suppression{
+		Kind:   kind,
+		Value:  value,
+		Reason: reason,
+		Time:   time.Now(),
+	}, nil
+}
+
+// suppressionKey hashes the value to keep addresses out of object names.
+func suppressionKey(kind SuppressionKind, value string) string {
+	h := sha256.Sum256([]byte(string(kind) + "|" + value))
+	return path.Join(SuppressionPrefix, fmt.Sprintf("%s-%x.json", kind, h[:16]))
+}
+
+func (s Suppression) Key() string {
+	return suppressionKey(s.Kind, s.Value)
+}
+
+func AddSuppression(ctx context.Context, st store.Store, s Suppression) error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := st.Create(ctx, s.Key(), buf); err != nil && !errors.Is(err, store.ErrExists) {
+		return err
+	}
+	return nil
+}
+
+func RemoveSuppression(ctx context.Context, st store.Store, kind SuppressionKind, value string) error {
+	s, err := NewSuppression(kind, value, "")
+	if err != nil {
+		return err
+	}
+	if _, err := st.Get(ctx, s.Key()); err != nil {
+		return err
+	}
+	return st.Delete(ctx, s.Key())
+}
+
+// legacySuppressions were hard-coded before the suppression list existed,
+// and are added to it once, the first time it is loaded.
+var legacySuppressions = []string{
+	"+19176121039",
+}
+
+// legacyMarker records that the legacy suppressions were migrated, so
+// that removing them sticks.
+const legacyMarker = "migrations/legacy-suppressions"
+
+// migrateSuppressions adds the legacy suppressions unless the marker says
+// they were, whatever else the list already holds; adding one already
+// there is harmless.
+func migrateSuppressions(ctx context.Context, st store.Store) error {
+	if _, err := st.Get(ctx, legacyMarker); err == nil {
+		return nil
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	for _, n := range legacySuppressions {
+		s, err := NewSuppression(SuppressPhone, n, "legacy blacklist")
+		if err != nil {
+			return err
+		}
+		if err := AddSuppression(ctx, st, *s); err != nil {
+			return err
+		}
+	}
+	err := st.Create(ctx, legacyMarker, []byte(time.Now().UTC().Format(time.RFC3339)))
+	if err != nil && !errors.Is(err, store.ErrExists) {
+		return err
+	}
+	return nil
+}
+
+func LoadSuppressions(ctx context.Context, st store.Store) ([]Suppression, error) {
+	if err := migrateSuppressions(ctx, st); err != nil {
+		return nil, err
+	}
+	keys, err := st.List(ctx, SuppressionPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	var out []Suppression
+	for _, k := range keys {
+		buf, err := st.Get(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		var s Suppression
+		if err := json.Unmarshal(buf, &s); err != nil {
+			return nil, fmt.Errorf("can't unmarshal %s: %w", k, err)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// suppressionKeys are where suppressions of the decision would be.
+func (d Decision) suppressionKeys() []string {
+	var out []string
+	switch {
+	case d.Phone != nil, d.SMS != nil:
+		out = append(out, suppressionKey(SuppressPhone, d.Address()))
+	case d.Email != nil:
+		out = append(out, suppressionKey(SuppressEmail, d.Address()))
+	}
+	if id := strings.TrimSpace(d.Patient); id != "" {
+		out = append(out, suppressionKey(SuppressPatient, id))
+	}
+	return out
+}
+
+// Suppressed checks the list loaded by LoadSuppressions.
+func (d Decision) Suppressed(list []Suppression) *Suppression {
+	keys := make(map[string]bool)
+	for _, k := range d.suppressionKeys() {
+		keys[k] = true
+	}
+	for _, s := range list {
+		if keys[s.Key()] {
+			return &s
+		}
+	}
+	return nil
+}
+
+// CheckSuppressed looks the decision up directly in the store, to catch
+// suppressions added since the list was loaded.
+func (d Decision) CheckSuppressed(ctx context.Context, st store.Store) (*Suppression, error) {
+	for _, k := range d.suppressionKeys() {
+		buf, err := st.Get(ctx, k)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var s Suppression
+		if err := json.Unmarshal(buf, &s); err != nil {
+			return nil, fmt.Errorf("can't unmarshal %s: %w", k, err)
+		}
+		return &s, nil
+	}
+	return nil, nil
+}
+
+var stopRegexp = regexp.MustCompile(`(?i)^\s*(stop|stopall|unsubscribe|cancel|end|quit)[\s.!]*$`)
+
+// IsStop reports whether an sms reply opts out of further messages, using
+// the same single-word keywords as Twilio.
+func IsStop(body string) bool {
+	return stopRegexp.MatchString(body)
+}
+
+// SuppressStops adds the senders of STOP replies among messages to the
+// suppression list, returning how many replies were STOPs.
+func SuppressStops(ctx context.Context, st store.Store, messages []InboundMessage) (int, error) {
+	var n int
+	for _, m := range messages {
+		if !IsStop(m.Body) {
+			continue
+		}
+		n++
+		x, err := NewSuppression(SuppressPhone, m.From, fmt.Sprintf("replied %q to sms (%s)", m.Body, m.ID))
+		if err != nil {
+			slog.Warn("can't suppress", "id", m.ID, "err", err)
+			continue
+		}
+		x.Time = m.Time
+		if err := AddSuppression(ctx, st, *x); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
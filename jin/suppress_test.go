@@ -0,0 +1,109 @@
+package jin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xoba/sms/store"
+)
+
+func newTestStore(t *testing.T) store.Store {
+	t.Helper()
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLegacySuppressionsMigrateOnce(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	list, err := LoadSuppressions(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(legacySuppressions) {
+		t.Fatalf("loaded %d suppressions, want the legacy ones", len(list))
+	}
+	if err := RemoveSuppression(ctx, s, SuppressPhone, legacySuppressions[0]); err != nil {
+		t.Fatal(err)
+	}
+	if list, err = LoadSuppressions(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(legacySuppressions)-1 {
+		t.Fatalf("removed legacy suppression came back: %v", list)
+	}
+}
+
+// A list started by a bounce, a stop or by hand before it was first
+// loaded still gets the legacy suppressions.
+func TestLegacySuppressionsInUse(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	x, err := NewSuppression(SuppressEmail, "Jane@Example.com", "asked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddSuppression(ctx, s, *x); err != nil {
+		t.Fatal(err)
+	}
+	list, err := LoadSuppressions(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1+len(legacySuppressions) {
+		t.Fatalf("got %v, want the list in use and the legacy ones", list)
+	}
+	suppressed := make(map[string]bool)
+	for _, x := range list {
+		suppressed[x.Value] = true
+	}
+	for _, v := range append([]string{"jane@example.com"}, legacySuppressions...) {
+		if !suppressed[v] {
+			t.Errorf("%s isn't suppressed", v)
+		}
+	}
+}
+
+func TestIsStop(t *testing.T) {
+	for body, want := range map[string]bool{
+		"STOP":             true,
+		" stop. ":          true,
+		"Unsubscribe!":     true,
+		"quit":             true,
+		"don't stop":       false,
+		"stop calling me":  false,
+		"my pcp is Dr. Li": false,
+	} {
+		if got := IsStop(body); got != want {
+			t.Errorf("IsStop(%q) = %v", body, got)
+		}
+	}
+}
+
+func TestSuppressStops(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	n, err := SuppressStops(ctx, s, []InboundMessage{
+		{ID: "SM1", Time: time.Now(), From: "+12125550123", Body: "Stop"},
+		{ID: "SM2", Time: time.Now(), From: "+12125550124", Body: "Dr. Li, 212-555-0199"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("%d stops, want 1", n)
+	}
+	for number, want := range map[string]bool{"+12125550123": true, "+12125550124": false} {
+		x, err := NewSMS(Phone(number)).CheckSuppressed(ctx, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (x != nil) != want {
+			t.Errorf("%s suppressed: %v", number, x)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package jin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/xoba/sms/store"
+)
+
+// TransferPrefix is where records transfers are kept, one per patient.
+const TransferPrefix = "transfers"
+
+// TransferState is how far a patient's chart has got to their new PCP.
+type TransferState string
+
+const (
+	Requested   TransferState = "requested"
+	PCPReceived TransferState = "pcp-received"
+	Authorized  TransferState = "authorized"
+	Sent        TransferState = "sent"
+	Confirmed   TransferState = "confirmed"
+	NoTransfer  TransferState = ""
+)
+
+// TransferStates lists the states in order.
+var TransferStates = []TransferState{Requested, PCPReceived, Authorized, Sent, Confirmed}
+
+func (s TransferState) index() int {
+	for i, x := range TransferStates {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func ParseTransferState(s string) (TransferState, error) {
+	t := TransferState(s)
+	if t.index() < 0 {
+		return "", fmt.Errorf("unknown transfer state %q; want one of %v", s, TransferStates)
+	}
+	return t, nil
+}
+
+// Transfer tracks one patient's records on their way to a new PCP.
+type Transfer struct {
+	Patient string // ContactInfo.ID
+	State   TransferState
+	PCP     *PCP `json:",omitempty"`
+	History []TransferEvent
+}
+
+type TransferEvent struct {
+	Time  time.Time
+	State TransferState
+	By    string
+	Note  string `json:",omitempty"`
+}
+
+func (t Transfer) String() string {
+	buf, _ := json.Marshal(t)
+	return string(buf)
+}
+
+// Updated is when the transfer last changed state.
+func (t Transfer) Updated() time.Time {
+	if len(t.History) == 0 {
+		return time.Time{}
+	}
+	return t.History[len(t.History)-1].Time
+}
+
+// HasDestination reports whether we know where the records go.
+func (t Transfer) HasDestination() bool {
+	return t.PCP != nil && (t.PCP.Fax != "" || t.PCP.Phone != "")
+}
+
+func transferKey(patient string) string {
+	return path.Join(TransferPrefix, safeKey(patient)+".json")
+}
+
+// LoadTransfer returns nil if the patient has none.
+func LoadTransfer(ctx context.Context, s store.Store, patient string) (*Transfer, error) {
+	buf, err := s.Get(ctx, transferKey(patient))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var t Transfer
+	if err := json.Unmarshal(buf, &t); err != nil {
+		return nil, fmt.Errorf("can't unmarshal transfer for %s: %w", patient, err)
+	}
+	return &t, nil
+}
+
+// LoadTransfers returns every transfer, by patient.
+func LoadTransfers(ctx context.Context, s store.Store) (map[string]*Transfer, error) {
+	keys, err := s.List(ctx, TransferPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]*Transfer)
+	for _, k := range keys {
+		buf, err := s.Get(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		var t Transfer
+		if err := json.Unmarshal(buf, &t); err != nil {
+			return nil, fmt.Errorf("can't unmarshal %s: %w", k, err)
+		}
+		out[t.Patient] = &t
+	}
+	return out, nil
+}
+
+func (t Transfer) save(ctx context.Context, s store.Store) error {
+	buf, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, transferKey(t.Patient), buf)
+}
+
+// UpdateTransfer applies f to the patient's transfer, or a new one, and
+// saves it if f reports a change, all under a claim on the patient's
+// transfer so that concurrent updates don't undo each other.
+func UpdateTransfer(ctx context.Context, s store.Store, patient string, f func(*Transfer) (bool, error)) (*Transfer, error) {
+	claim, err := store.Await(ctx, s, path.Join("claims", TransferPrefix, safeKey(patient)), time.Minute, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("can't claim transfer for %s: %w", patient, err)
+	}
+	defer claim.Release(context.WithoutCancel(ctx))
+	t, err := LoadTransfer(ctx, s, patient)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		t = &Transfer{Patient: patient}
+	}
+	changed, err := f(t)
+	if err != nil || !changed {
+		return t, err
+	}
+	return t, t.save(ctx, s)
+}
+
+// Advance moves the transfer forward to the given state, creating it if
+// need be. States may be skipped but never undone, and nothing past
+// requested is allowed without a destination. Advancing to the current
+// state does nothing but update the pcp, if one is given.
+func (t *Transfer) Advance(to TransferState, pcp *PCP, by, note string) (bool, error) {
+	if to.index() < 0 {
+		return false, fmt.Errorf("unknown transfer state %q", to)
+	}
+	var changed bool
+	if pcp != nil && (t.PCP == nil || *t.PCP != *pcp) {
+		t.PCP = pcp
+		changed = true
+	}
+	switch {
+	case to == t.State:
+		return changed, nil
+	case t.State != NoTransfer && to.index() < t.State.index():
+		return false, fmt.Errorf("transfer for %s is already %s", t.Patient, t.State)
+	case to.index() > Requested.index() && !t.HasDestination():
+		return false, fmt.Errorf("transfer for %s has no destination pcp", t.Patient)
+	}
+	t.State = to
+	t.History = append(t.History, TransferEvent{Time: time.Now(), State: to, By: by, Note: note})
+	return true, nil
+}
@@ -0,0 +1,120 @@
+package jin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xoba/sms/store"
+)
+
+func TestTransferAdvance(t *testing.T) {
+	x := &Transfer{Patient: "p1"}
+	if ok, err := x.Advance(Requested, nil, "op", ""); !ok || err != nil {
+		t.Fatalf("request: %v, %v", ok, err)
+	}
+	if _, err := x.Advance(PCPReceived, nil, "op", ""); err == nil {
+		t.Fatal("advanced without a destination")
+	}
+	pcp := &PCP{Name: "Dr. Li", Fax: "+12126888887"}
+	if ok, err := x.Advance(Authorized, pcp, "op", "skipped a state"); !ok || err != nil {
+		t.Fatalf("authorize: %v, %v", ok, err)
+	}
+	if _, err := x.Advance(Requested, nil, "op", ""); err == nil {
+		t.Fatal("went back a state")
+	}
+	if ok, err := x.Advance(Authorized, nil, "op", ""); ok || err != nil {
+		t.Fatalf("same state: %v, %v", ok, err)
+	}
+	// a corrected pcp is a change even in the same state
+	fixed := &PCP{Name: "Dr. Li", Fax: "+12126888888"}
+	if ok, err := x.Advance(Authorized, fixed, "op", ""); !ok || err != nil || x.PCP.Fax != fixed.Fax {
+		t.Fatalf("correcting the pcp: %v, %v", ok, err)
+	}
+	if len(x.History) != 2 || x.History[1].Note != "skipped a state" {
+		t.Fatalf("history %v", x.History)
+	}
+	if _, err := ParseTransferState("lost"); err == nil {
+		t.Fatal("parsed an unknown state")
+	}
+}
+
+// slowStore widens the window for lost updates.
+type slowStore struct {
+	store.Store
+}
+
+func (s slowStore) Put(ctx context.Context, key string, value []byte) error {
+	time.Sleep(5 * time.Millisecond)
+	return s.Store.Put(ctx, key, value)
+}
+
+func TestUpdateTransferConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := slowStore{newTestStore(t)}
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = UpdateTransfer(ctx, s, "p1", func(t *Transfer) (bool, error) {
+				t.History = append(t.History, TransferEvent{Time: time.Now(), By: fmt.Sprint(i)})
+				return true, nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	x, err := LoadTransfer(ctx, s, "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(x.History) != n {
+		t.Fatalf("kept %d of %d updates", len(x.History), n)
+	}
+	all, err := LoadTransfers(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Fatalf("loaded %d transfers", len(all))
+	}
+}
+
+// cancelStore fails deletes once ctx is done, as a remote store would.
+type cancelStore struct {
+	store.Store
+}
+
+func (s cancelStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.Delete(ctx, key)
+}
+
+// The claim is released even when ctx is done by the end of the update,
+// rather than left to expire.
+func TestUpdateTransferReleases(t *testing.T) {
+	s := cancelStore{newTestStore(t)}
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := UpdateTransfer(ctx, s, "p1", func(*Transfer) (bool, error) {
+		cancel()
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := UpdateTransfer(ctx, s, "p1", func(*Transfer) (bool, error) { return false, nil }); err != nil {
+		t.Fatalf("claim left behind: %v", err)
+	}
+}
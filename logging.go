@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/xoba/sms/jin"
+)
+
+// setupLogging makes the default logger, and so the log package too,
+// write at the configured level as text or json, with patients' details
+// masked unless -unsafe-log is given.
+func setupLogging(c Config) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return fmt.Errorf("bad log level %q: %w", c.LogLevel, err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if !c.UnsafeLog {
+		opts.ReplaceAttr = jin.Redact
+	}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if c.LogJSON {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// pii masks a patient's phone number, email, name or address for printing,
+// as in the logs.
+func (c Config) pii(s string) string {
+	if c.UnsafeLog {
+		return s
+	}
+	return jin.Mask(s)
+}
+
+// piiText masks the emails and phone numbers within free text for
+// printing, as in the logs.
+func (c Config) piiText(s string) string {
+	if c.UnsafeLog {
+		return s
+	}
+	return jin.MaskText(s)
+}
@@ -1,27 +1,31 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"math"
-	"math/rand"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"sort"
-	"sync"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/kevinburke/twilio-go"
+	"github.com/xoba/sms/audit"
 	"github.com/xoba/sms/jin"
 	"github.com/xoba/sms/saws"
+	"github.com/xoba/sms/store"
 	"github.com/xoba/sms/stw"
 	"github.com/xoba/sms/task"
 	"golang.org/x/time/rate"
@@ -29,17 +33,41 @@ import (
 
 func main() {
 	if err := Run(); err != nil {
-		log.Fatal(err)
+		slog.Error("failed", "err", err)
+		os.Exit(1)
 	}
 }
 
 type Config struct {
-	Profile  string  `json:",omitempty"`
-	Quantity int     `json:",omitempty"`
-	Hertz    float64 `json:",omitempty"`
-	Mode     string  // test, dev, prod, or logs, or count
-	Prod     bool    `json:",omitempty"`
-	Verbose  bool    `json:",omitempty"`
+	Profile   string        `json:",omitempty"`
+	Quantity  int           `json:",omitempty"`
+	Hertz     float64       `json:",omitempty"`
+	Budget    float64       `json:",omitempty"` // dollars the campaign may spend in all, if non-zero
+	Quotas    jin.Quotas    `json:",omitempty"` // most sends a day by channel, across campaigns
+	Order     string        `json:",omitempty"` // comma-separated prioritizers, like sole,cheapest
+	Seed      int64         // breaks ties in the order
+	Mode      string        // test, dev, prod, logs, count, campaigns, migrate, reconcile, suppress, sns, preview, letters, addresses, replies, transfers, daemon, encrypt, or audit
+	Campaign  string        `json:",omitempty"`
+	Store     string        `json:",omitempty"` // local directory instead of s3
+	Outbox    string        `json:",omitempty"` // local directory instead of twilio and ses
+	Postal    string        `json:",omitempty"` // local directory for letters to print and mail
+	Inbox     string        `json:",omitempty"` // local directory of emails received, as .eml files
+	Deadline  string        `json:",omitempty"` // date by which records must have somewhere to go
+	Assume    string        `json:",omitempty"` // sent or unsent, for unresolvable pending entries
+	Since     time.Duration `json:",omitempty"` // how far back to look for replies
+	Listen    string        `json:",omitempty"` // address for http endpoints
+	Poll      time.Duration `json:",omitempty"` // how often the daemon wakes up
+	Metrics   string        `json:",omitempty"` // address for /metrics and /healthz, if any
+	LogLevel  string        `json:",omitempty"` // debug, info, warn or error
+	LogJSON   bool          `json:",omitempty"`
+	UnsafeLog bool          `json:",omitempty"` // log patients' details unmasked
+	Keyfile   string        `json:",omitempty"` // local master key for encrypting the store
+	KMSKey    string        `json:",omitempty"` // aws kms key for encrypting the store, instead
+	Prod      bool          `json:",omitempty"`
+	Verbose   bool          `json:",omitempty"`
+
+	campaign *jin.Campaign
+	audit    *audit.Log
 }
 
 func (c Config) String() string {
@@ -51,16 +79,109 @@ func (c Config) AWSSession() (*session.Session, error) {
 	return saws.NewSessionFromProfile(c.Profile)
 }
 
+// OpenStore opens the store, encrypting what's written to it and
+// decrypting what's read if there's a key.
+func (c Config) OpenStore() (store.Store, error) {
+	s, err := store.Open(c.Store, func() (*store.S3, error) {
+		session, err := c.AWSSession()
+		if err != nil {
+			return nil, err
+		}
+		return store.NewS3(s3.New(session), store.Bucket), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	e := store.Encrypted{Store: s}
+	switch {
+	case c.Keyfile != "" && c.KMSKey != "":
+		return nil, fmt.Errorf("can't use both -keyfile and -kms")
+	case c.Keyfile != "":
+		k, err := store.LoadKeyfile(c.Keyfile)
+		if err != nil {
+			return nil, err
+		}
+		e.KMS = k
+	case c.KMSKey != "":
+		session, err := c.AWSSession()
+		if err != nil {
+			return nil, err
+		}
+		e.KMS = saws.KMS{Svc: kms.New(session), KeyID: c.KMSKey}
+	}
+	return e, nil
+}
+
+func (c Config) Provider(ctx context.Context, s store.Store) (jin.Provider, error) {
+	if c.Outbox != "" {
+		return jin.Outbox{Dir: c.Outbox}, nil
+	}
+	session, err := c.AWSSession()
+	if err != nil {
+		return nil, err
+	}
+	// twilio-go doesn't retry, but the aws sdk does, as many as three times
+	session.Handlers.Complete.PushBack(countRetries("ses"))
+	creds, err := stw.LoadCredentials(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	return jin.Live{
+		SES:    ses.New(session),
+		Twilio: creds.NewClient(),
+		Mail:   jin.PrintBatch{Dir: c.Postal},
+	}, nil
+}
+
 func Run() error {
 	var config Config
 	flag.BoolVar(&config.Verbose, "v", false, "whether to run verbosely or not")
 	flag.StringVar(&config.Profile, "p", "", "aws iam profile to use, if any")
-	flag.StringVar(&config.Mode, "m", "dev", "mode: test, dev, or prod, logs, or count")
-	flag.IntVar(&config.Quantity, "q", 0, "max quantity of folks to reach out to")
+	flag.StringVar(&config.Mode, "m", "dev", "mode: test, dev, or prod, logs, count, campaigns, migrate, reconcile, suppress, sns, preview, letters, addresses, replies, transfers, daemon, encrypt, or audit")
+	flag.StringVar(&config.Campaign, "c", jin.DefaultCampaign, "campaign to run")
+	flag.StringVar(&config.Store, "s", "", "local directory to use as the store, instead of s3")
+	flag.StringVar(&config.Outbox, "o", "", "local directory to write messages to, instead of sending them")
+	flag.StringVar(&config.Postal, "postal", "letters", "local directory to write letters to, for printing and mailing")
+	flag.StringVar(&config.Inbox, "inbox", "inbox", "local directory of emails received from patients, as .eml files")
+	flag.StringVar(&config.Deadline, "deadline", "", "date, like 2006-01-02, by which every patient's records need a destination")
+	flag.StringVar(&config.Assume, "assume", "", "when reconciling, treat entries the provider can't resolve as sent or unsent; SES keeps no log to search, so email entries always need this")
+	flag.DurationVar(&config.Since, "since", 30*24*time.Hour, "how far back to look for replies")
+	flag.StringVar(&config.Listen, "listen", ":8080", "address to listen on for http")
+	flag.DurationVar(&config.Poll, "poll", time.Minute, "how often the daemon checks for work")
+	flag.StringVar(&config.Metrics, "metrics", "", "address to serve prometheus metrics and health on, if any, like :9090")
+	flag.StringVar(&config.LogLevel, "log-level", "info", "log level: debug, info, warn or error; -v makes it debug")
+	flag.BoolVar(&config.LogJSON, "log-json", false, "whether to log as json lines")
+	flag.BoolVar(&config.UnsafeLog, "unsafe-log", false, "log patients' phone numbers, emails, names and addresses unmasked")
+	flag.StringVar(&config.Keyfile, "keyfile", "", "file holding the master key to encrypt the store with, if any")
+	flag.StringVar(&config.KMSKey, "kms", "", "aws kms key id, arn or alias to encrypt the store with, if any")
+	flag.IntVar(&config.Quantity, "q", 0, "max quantity of folks to reach out to, per day for the daemon")
 	flag.Float64Var(&config.Hertz, "f", 1, "max frequency of contact, hertz")
+	flag.Float64Var(&config.Budget, "budget", 0, "max dollars to spend on the campaign, across all runs, if non-zero")
+	flag.Func("quota", "most sends a day by channel, across campaigns, like phone=200,sms=500,email=2000", func(s string) (err error) {
+		config.Quotas, err = jin.ParseQuotas(s)
+		return err
+	})
+	flag.StringVar(&config.Order, "order", "random", fmt.Sprintf("order to contact in: comma-separated %s, each breaking ties in the one before", strings.Join(jin.OrderNames(), ", ")))
+	flag.Int64Var(&config.Seed, "seed", 0, "seed for breaking ties in the order, so runs are reproducible")
 	flag.Parse()
 
-	var f func(Config) error
+	campaign, err := jin.LoadCampaign(config.Campaign)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	config.useCampaign(campaign, set)
+	if !set["log-level"] && config.Verbose {
+		config.LogLevel = "debug"
+	}
+	if err := setupLogging(config); err != nil {
+		return err
+	}
+
+	var f func(context.Context, Config) error
 	switch config.Mode {
 	case "test":
 		config.Prod = false
@@ -71,43 +192,83 @@ func Run() error {
 	case "prod":
 		config.Prod = true
 		f = ContactPatients
+	case "daemon":
+		config.Prod = true
+		f = Daemon
 	case "logs":
 		config.Prod = false
 		f = FindLogs
 	case "count":
 		f = CountReceipts
+	case "campaigns":
+		f = ListCampaigns
+	case "migrate":
+		f = MigrateKeys
+	case "reconcile":
+		f = Reconcile
+	case "suppress":
+		f = Suppress
+	case "sns":
+		f = ServeSNS
+	case "preview":
+		f = Preview
+	case "letters":
+		f = PrintLetters
+	case "addresses":
+		f = CheckAddresses
+	case "replies":
+		f = Replies
+	case "transfers":
+		f = Transfers
+	case "encrypt":
+		f = Encrypt
+	case "audit":
+		f = Audit
 	default:
 		return fmt.Errorf("illegal mode: %q", config.Mode)
 	}
-	log.Printf("running with config %s\n", config)
-	return f(config)
+	slog.Info("running", "config", config.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		slog.Warn("finishing what's in flight, interrupt again to abort", "signal", sig.String())
+		// a second signal kills us the usual way
+		signal.Stop(sigs)
+		cancel()
+	}()
+	if config.Metrics != "" {
+		if err := ServeMetrics(ctx, config.Metrics); err != nil {
+			return err
+		}
+	}
+	if err := f(ctx, config); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
 }
 
-func loadReceipts(c Config) (map[string]bool, error) {
-	session, err := c.AWSSession()
+func loadReceipts(ctx context.Context, s store.Store, campaign jin.Campaign) (map[string]bool, error) {
+	keys, err := s.List(ctx, campaign.ReceiptPrefix()+"/")
 	if err != nil {
 		return nil, err
 	}
 	m := make(map[string]bool)
-	svc := s3.New(session)
-	f := func(x *s3.ListObjectsV2Output, b bool) bool {
-		for _, o := range x.Contents {
-			m[path.Base(*o.Key)] = true
-		}
-		return true
-	}
-	i := &s3.ListObjectsV2Input{
-		Bucket: aws.String("drjin"),
-		Prefix: aws.String("receipts/"),
-	}
-	if err := svc.ListObjectsV2Pages(i, f); err != nil {
-		return nil, err
+	for _, k := range keys {
+		m[path.Base(k)] = true
 	}
 	return m, nil
 }
 
-func CountReceipts(c Config) error {
-	m, err := loadReceipts(c)
+func CountReceipts(ctx context.Context, c Config) error {
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	m, err := loadReceipts(ctx, s, *c.campaign)
 	if err != nil {
 		return err
 	}
@@ -115,62 +276,90 @@ func CountReceipts(c Config) error {
 	return nil
 }
 
-func FindLogs(c Config) error {
-	const errorSid = "SM8f7fbe3e0351431c8e6013164060d9db"
-	session, err := c.AWSSession()
+// ListCampaigns prints every campaign along with its progress against
+// the current contact list.
+func ListCampaigns(ctx context.Context, c Config) error {
+	campaigns, err := jin.ListCampaigns()
 	if err != nil {
 		return err
 	}
-	svc := s3.New(session)
-
-	fetch := func(key string) (*jin.Receipt, error) {
-		resp, err := svc.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String("drjin"),
-			Key:    aws.String(key),
-		})
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	info, err := jin.LoadContacts(ctx, s)
+	if err != nil {
+		return err
+	}
+	var decisions int
+	for _, i := range info {
+		list, err := i.Decisions()
 		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-		dec := json.NewDecoder(resp.Body)
-		var r jin.Receipt
-		if err := dec.Decode(&r); err != nil {
-			return nil, fmt.Errorf("can't unmarshal %s: %w", key, err)
+			return err
 		}
-		return &r, nil
+		decisions += len(list)
 	}
-
-	types := make(map[string]int)
-
-	f := func(x *s3.ListObjectsV2Output, b bool) bool {
-		for _, o := range x.Contents {
-			fmt.Printf("got key %q\n", *o.Key)
-			r, err := fetch(*o.Key)
-			if err != nil {
-				log.Fatalf("can't get %q: %v", *o.Key, err)
-			}
-			types[r.Decision.Type()]++
-			m, ok := r.Content.(map[string]interface{})
-			if ok {
-				sid, ok := m["sid"].(string)
-				if ok && sid == errorSid {
-					fmt.Println(r)
-				}
-			}
+	for _, campaign := range campaigns {
+		m, err := loadReceipts(ctx, s, campaign)
+		if err != nil {
+			return err
 		}
-		return true
+		var pct float64
+		if decisions > 0 {
+			pct = 100 * float64(len(m)) / float64(decisions)
+		}
+		fmt.Printf("%-20s %5d / %5d receipts (%.1f%%); %s\n", campaign.Name, len(m), decisions, pct, campaign.Message)
 	}
-	i := &s3.ListObjectsV2Input{
-		Bucket: aws.String("drjin"),
-		Prefix: aws.String("receipts/"),
+	return nil
+}
+
+func FindLogs(ctx context.Context, c Config) error {
+	const errorSid = "SM8f7fbe3e0351431c8e6013164060d9db"
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
 	}
-	if err := svc.ListObjectsV2Pages(i, f); err != nil {
+	keys, err := s.List(ctx, c.campaign.ReceiptPrefix()+"/")
+	if err != nil {
 		return err
 	}
+	types := make(map[string]int)
+	for _, k := range keys {
+		fmt.Printf("got key %q\n", k)
+		r, err := getReceipt(ctx, s, k)
+		if err != nil {
+			return fmt.Errorf("can't get %q: %w", k, err)
+		}
+		types[r.Decision.Type()]++
+		if m, ok := r.Content.(*twilio.Message); ok && m.Sid == errorSid {
+			fmt.Printf("%s to %s: %s\n", m.Sid, c.pii(r.Decision.Address()), m.ErrorMessage)
+		}
+	}
 	fmt.Printf("types = %v\n", types)
 	return nil
 }
 
+// useCampaign applies the campaign's settings, except those given on the
+// command line, by flag name in set.
+func (c *Config) useCampaign(campaign *jin.Campaign, set map[string]bool) {
+	c.campaign = campaign
+	if !set["q"] && campaign.Quantity > 0 {
+		c.Quantity = campaign.Quantity
+	}
+	if !set["f"] && campaign.Hertz > 0 {
+		c.Hertz = campaign.Hertz
+	}
+	if !set["budget"] && campaign.Budget > 0 {
+		c.Budget = campaign.Budget
+	}
+	if !set["quota"] && campaign.Quotas != nil {
+		c.Quotas = campaign.Quotas
+	}
+	if !set["order"] && campaign.Order != "" {
+		c.Order = campaign.Order
+	}
+}
+
 func WithinWorkingHours() bool {
 	if h := time.Now().Hour(); h >= 9 && h <= 17 {
 		return true
@@ -178,32 +367,54 @@ func WithinWorkingHours() bool {
 	return false
 }
 
-func WaitForWorkingHours() {
+// waitForWorkingHours is WaitForWorkingHours, for Send, which tests stand
+// in for.
+var waitForWorkingHours = WaitForWorkingHours
+
+func WaitForWorkingHours(ctx context.Context) error {
 	for {
 		if WithinWorkingHours() {
-			return
+			return nil
+		}
+		slog.Info("waiting for working hours")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Minute):
 		}
-		log.Println("waiting for working hours")
-		time.Sleep(time.Minute)
 	}
 }
 
-func ContactPatients(c Config) error {
+func ContactPatients(ctx context.Context, c Config) error {
 	if c.Hertz > 2 {
 		return fmt.Errorf("too fast")
 	}
-	session, err := c.AWSSession()
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	provider, err := c.Provider(ctx, s)
 	if err != nil {
 		return err
 	}
-	creds, err := stw.LoadCredentials(s3.New(session))
+	if c.audit, err = startAudit(ctx, c, s); err != nil {
+		return err
+	}
+	info, err := jin.LoadContacts(ctx, s)
 	if err != nil {
 		return err
 	}
-	info, err := jin.LoadContacts(s3.New(session))
+	allDecisions, err := Plan(ctx, c, s, info)
 	if err != nil {
 		return err
 	}
+	_, err = Send(ctx, c, s, provider, newReceiptCache(s, *c.campaign), allDecisions, c.Quantity)
+	return err
+}
+
+// Plan decides how to contact each patient, leaving out bad email hosts
+// and suppressed addresses, in the order to contact them.
+func Plan(ctx context.Context, c Config, s store.Store, info []jin.ContactInfo) ([]jin.Decision, error) {
 	dumpSortedMap := func(name string, m map[string]int) {
 		if !c.Verbose {
 			return
@@ -234,39 +445,30 @@ func ContactPatients(c Config) error {
 		states[i.State]++
 		preferred[string(i.Preferred)]++
 		hosts[i.Host()]++
-		if c.Verbose {
-			fmt.Println(i)
-		}
+		slog.Debug("contact", "contact", i)
 		if i.Email != "" {
 			if err := i.ValidateEmail(); err != nil {
-				return err
+				return nil, err
 			}
 		}
 		decisions, err := i.Decisions()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(decisions) == 0 {
 			noDecisions++
 		}
+		for i := range decisions {
+			decisions[i].Campaign = c.campaign.Name
+		}
 		allDecisions = append(allDecisions, decisions...)
-		if c.Verbose {
-			for _, d := range decisions {
-				fmt.Printf("  %s\n", d)
-				actions[d.Type()]++
-			}
+		for _, d := range decisions {
+			slog.Debug("decision", "decision", d)
+			actions[d.Type()]++
 		}
 	}
 
 	{
-		badHosts := make(map[string]bool)
-		lock := new(sync.Mutex)
-		update := func(host string) {
-			lock.Lock()
-			defer lock.Unlock()
-			badHosts[host] = true
-		}
-
 		/*
 			"debvoise.com" not found
 			"solusp.com" not found
@@ -281,39 +483,45 @@ func ContactPatients(c Config) error {
 			"nyc.rrcom" not found --- nyc.rr.com?
 		*/
 
-		var tasks []task.Task
+		var list []string
 		for h := range hosts {
-			if h == "" {
-				continue
+			if h != "" {
+				list = append(list, h)
 			}
-			h := h
-			tasks = append(tasks, func() error {
+		}
+		pool := task.Pool[string, bool]{
+			Threads: 20,
+			Func: func(ctx context.Context, h string) (bool, error) {
 				if c.Verbose {
 					fmt.Printf("host %q\n", h)
 				}
-				_, err := net.LookupMX(h)
-				if err != nil {
-					if nerr, ok := err.(*net.DNSError); ok && nerr.IsNotFound {
-						update(h)
-						if c.Verbose {
-							fmt.Printf("%q not found\n", h)
-						}
-					} else {
-						return err
+				_, err := net.DefaultResolver.LookupMX(ctx, h)
+				if nerr, ok := err.(*net.DNSError); ok && nerr.IsNotFound {
+					if c.Verbose {
+						fmt.Printf("%q not found\n", h)
 					}
+					return false, nil
 				}
-				return nil
-			})
+				return err == nil, err
+			},
 		}
-
-		if errs := task.Run(tasks, 20); len(errs) > 0 {
-			return fmt.Errorf("first error %w; %v", errs[0], errs)
+		badHosts := make(map[string]bool)
+		for _, r := range pool.Map(ctx, list) {
+			if r.Err != nil {
+				return nil, fmt.Errorf("can't look up %q: %w", r.In, r.Err)
+			}
+			if !r.Out {
+				badHosts[r.In] = true
+			}
 		}
 
 		var filtered []jin.Decision
 		for _, d := range allDecisions {
 			if badHosts[d.Host()] {
-				fmt.Printf("skipping bad host in %s\n", d)
+				slog.Info("skipping bad host", "decision", d)
+				if err := c.audit.Append(ctx, audit.Skipped, auditDecision(d, "reason", "bad email host")); err != nil {
+					return nil, err
+				}
 				continue
 			}
 			filtered = append(filtered, d)
@@ -321,16 +529,35 @@ func ContactPatients(c Config) error {
 		allDecisions = filtered
 	}
 
-	if c.Verbose {
-		const minutes = 3
-		msg, err := jin.LoadMessage()
+	{
+		suppressions, err := jin.LoadSuppressions(ctx, s)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		pricing := map[string]float64{
-			"email": 0.10 / 1000,
-			"phone": 0.0130 * minutes,                          // per minute
-			"sms":   0.0075 * math.Ceil(float64(len(msg))/140), // sms segments
+		var filtered []jin.Decision
+		for _, d := range allDecisions {
+			if x := d.Suppressed(suppressions); x != nil {
+				slog.Info("skipping suppressed", "decision", d, "reason", x.Reason)
+				if err := c.audit.Append(ctx, audit.Skipped, auditDecision(d, "reason", "suppressed: "+jin.MaskText(x.Reason))); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			filtered = append(filtered, d)
+		}
+		allDecisions = filtered
+	}
+
+	// every patient must get the message in their own language
+	if err := c.campaign.CheckLanguages(allDecisions); err != nil {
+		return nil, err
+	}
+
+	estimate := c.campaign.Estimator()
+	if c.Verbose {
+		pricing := make(map[string]float64)
+		for _, d := range allDecisions {
+			pricing[d.Type()] += estimate(d)
 		}
 		dumpSortedMap("hosts", hosts)
 		fmt.Printf("has email: %v\n", hasEmail)
@@ -340,17 +567,18 @@ func ContactPatients(c Config) error {
 		fmt.Printf("%d no-decision contacts, %d total decisions; %v\n", noDecisions, len(allDecisions), actions)
 		var total float64
 		for k, v := range pricing {
-			n := actions[k]
-			c := v * float64(n)
-			total += c
-			fmt.Printf("cost for %d %s: $%.2f\n", n, k, c)
+			total += v
+			fmt.Printf("cost for %d %s: $%.2f\n", actions[k], k, v)
 		}
 		fmt.Printf("total estimated cost for %d decisions: $%.2f\n", len(allDecisions), total)
 	}
 
-	rand.Shuffle(len(allDecisions), func(i, j int) {
-		allDecisions[i], allDecisions[j] = allDecisions[j], allDecisions[i]
-	})
+	prioritizers, err := jin.ParseOrder(c.Order, info, estimate)
+	if err != nil {
+		return nil, err
+	}
+	jin.Prioritize(allDecisions, c.Seed, prioritizers...)
+	fmt.Printf("contacting in %s order, with seed %d\n", c.Order, c.Seed)
 
 	uniqueDecisions := make(map[string]bool)
 	for _, d := range allDecisions {
@@ -358,131 +586,321 @@ func ContactPatients(c Config) error {
 	}
 
 	fmt.Printf("%d / %d unique decisions\n", len(uniqueDecisions), len(allDecisions))
+	return allDecisions, nil
+}
+
+// Send contacts up to quantity of the decisions not yet done, in order,
+// returning how many it made. Spend so far is added up from the receipts
+// in the cache, brought up to date once the run lock is held.
+func Send(ctx context.Context, c Config, s store.Store, provider jin.Provider, cache *receiptCache, allDecisions []jin.Decision, quantity int) (int, error) {
+	estimate := c.campaign.Estimator()
 
 	dt := time.Duration(1 / c.Hertz * float64(time.Second))
 	fmt.Printf("running with limit dt = %v\n", dt)
 	limiter := rate.NewLimiter(rate.Every(dt), 1)
 
-	receipts, err := loadReceipts(c)
+	lock, err := store.NewLock(ctx, s, c.campaign.Key("lock"), store.Owner(), time.Minute)
+	if errors.Is(err, store.ErrClaimed) {
+		return 0, fmt.Errorf("campaign %q is being run by somebody else", c.campaign.Name)
+	} else if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+
+	receipts, err := loadReceipts(ctx, s, *c.campaign)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	fmt.Printf("there are %d receipts\n", len(receipts))
-	availableContacts := len(allDecisions) - len(receipts)
-	fmt.Printf("approximately %d decisions to go\n", availableContacts)
-	if availableContacts > c.Quantity {
-		availableContacts = c.Quantity
+	var availableContacts int
+	var projected float64
+	for _, d := range allDecisions {
+		if !receipts[d.Key()] && !receipts[d.LegacyKey()] {
+			availableContacts++
+			projected += estimate(d)
+		}
+	}
+	fmt.Printf("%d decisions to go\n", availableContacts)
+	queueDepth.Set(float64(availableContacts), c.campaign.Name)
+	all, err := cache.update(ctx)
+	if err != nil {
+		return 0, err
+	}
+	spent := spend(all, estimate)
+	fmt.Printf("spent $%.2f so far, with $%.2f more projected to finish\n", spent, projected)
+	spendGauge.Set(spent, c.campaign.Name)
+	if c.Budget > 0 {
+		fmt.Printf("$%.2f of the $%.2f budget remains\n", c.Budget-spent, c.Budget)
+	}
+	used, err := jin.QuotaUsed(ctx, s, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if len(c.Quotas) > 0 {
+		fmt.Printf("used %v of today's quotas, %s\n", used, c.Quotas)
+	}
+	if availableContacts > quantity {
+		availableContacts = quantity
 	}
 
 	var contactsMade int
+	var quotaDay string
+	var overQuota map[string]bool
+	defer func() {
+		fmt.Println()
+		if ctx.Err() != nil {
+			fmt.Printf("interrupted; ")
+		}
+		fmt.Printf("made %d of %d contacts this run", contactsMade, availableContacts)
+		if c.Budget > 0 {
+			fmt.Printf("; $%.2f of the $%.2f budget remains", c.Budget-spent, c.Budget)
+		}
+		fmt.Println()
+	}()
 	for _, d := range allDecisions {
-		if contactsMade >= c.Quantity {
+		if contactsMade >= quantity || ctx.Err() != nil {
 			break
 		}
+		if err := lock.Err(); err != nil {
+			return contactsMade, fmt.Errorf("lost run lock: %w", err)
+		}
 		if c.Prod {
-			WaitForWorkingHours()
+			if err := waitForWorkingHours(ctx); err != nil {
+				break
+			}
 		}
 		if !c.Prod {
 			d.SetDebugging("+19176086254", "mra@xoba.com")
 			if d.SMS == nil {
 				continue
 			}
-			log.Printf("--> updated decision: %s", d)
+			slog.Debug("updated decision", "decision", d)
 		}
-		if receipts[d.Key()] {
+		if receipts[d.Key()] || receipts[d.LegacyKey()] {
 			continue
 		}
-		fmt.Println()
-		log.Printf("%d/%d. decision: %s", 1+contactsMade, availableContacts, d)
-		done, err := alreadyDone(session, d)
+		if today := time.Now().Format("2006-01-02"); today != quotaDay {
+			// a run waiting past midnight starts on the new day's quotas
+			quotaDay, overQuota = today, make(map[string]bool)
+		}
+		if overQuota[d.Type()] {
+			continue
+		}
+		if err := c.audit.Append(ctx, audit.Considered, auditDecision(d)); err != nil {
+			return contactsMade, err
+		}
+		if cost := estimate(d); c.Budget > 0 && spent+cost > c.Budget {
+			slog.Warn("stopping, since the next contact would exceed the budget", "cost", cost, "decision", d)
+			if err := c.audit.Append(ctx, audit.Skipped, auditDecision(d, "reason", "over budget")); err != nil {
+				return contactsMade, err
+			}
+			break
+		}
+		// a slot is taken before sending, for the day it is now, so that
+		// runs of other campaigns can't overshoot the quota with us
+		slot, ok, err := c.Quotas.ReserveQuota(ctx, s, d.Type(), time.Now())
 		if err != nil {
-			return err
+			return contactsMade, err
 		}
-		if done {
-			log.Printf("already done: %s", d)
+		if !ok {
+			overQuota[d.Type()] = true
+			slog.Info("daily quota reached", "channel", d.Type())
+			if err := c.audit.Append(ctx, audit.Skipped, auditDecision(d, "reason", "daily quota reached")); err != nil {
+				return contactsMade, err
+			}
 			continue
 		}
-		r, err := d.Contact(ses.New(session), creds.NewClient())
+		fmt.Println()
+		slog.Info("contacting", "n", 1+contactsMade, "of", availableContacts, "decision", d)
+		r, err := contact(ctx, s, provider, *c.campaign, c.audit, d)
 		if err != nil {
-			return err
+			// the send may have happened, so the slot stays taken
+			return contactsMade, err
 		}
-		if err := markDone(session, r); err != nil {
-			return err
+		if r == nil {
+			if slot != "" {
+				if err := s.Delete(context.WithoutCancel(ctx), slot); err != nil {
+					return contactsMade, err
+				}
+			}
+			continue
+		}
+		if slot == "" {
+			if err := jin.UseQuota(ctx, s, *r); err != nil {
+				return contactsMade, err
+			}
+		}
+		cost, ok := r.Cost()
+		if !ok {
+			cost = estimate(d)
 		}
+		spent += cost
 		contactsMade++
-		log.Printf("finished and marked %s\n", d)
-		if err := limiter.Wait(context.Background()); err != nil {
-			return err
+		spendGauge.Set(spent, c.campaign.Name)
+		queueDepth.Set(float64(availableContacts-contactsMade), c.campaign.Name)
+		slog.Info("finished and marked", "decision", d)
+		start := time.Now()
+		err = limiter.Wait(ctx)
+		limiterWait.Add(time.Since(start).Seconds())
+		if err != nil {
+			break
 		}
 	}
 
-	return nil
+	return contactsMade, nil
 }
 
-func alreadyDone(session *session.Session, d jin.Decision) (bool, error) {
-	resp, err := s3.New(session).GetObject(&s3.GetObjectInput{
-		Bucket: aws.String("drjin"),
-		Key:    aws.String(path.Join("receipts", d.Key())),
+// contact claims the decision, so that no other runner can act on it
+// concurrently, then sends it unless a receipt already exists, returning
+// the new receipt if it sent anything. Once the send begins it runs to
+// completion even if ctx is cancelled, so that its receipt gets written.
+func contact(ctx context.Context, s store.Store, p jin.Provider, campaign jin.Campaign, a *audit.Log, d jin.Decision) (*jin.Receipt, error) {
+	skip := func(outcome, reason string) (*jin.Receipt, error) {
+		sends.Inc(d.Type(), outcome)
+		return nil, a.Append(ctx, audit.Skipped, auditDecision(d, "reason", reason))
+	}
+	claim, err := store.Claim(ctx, s, path.Join(campaign.Key("claims"), d.Key()), store.Owner(), 5*time.Minute)
+	if errors.Is(err, store.ErrClaimed) {
+		slog.Info("claimed by another runner", "decision", d)
+		return skip("claimed", "claimed by another runner")
+	} else if err != nil {
+		return nil, err
+	}
+	defer claim.Release(context.WithoutCancel(ctx))
+	done, err := alreadyDone(ctx, s, campaign, d)
+	if err != nil {
+		return nil, err
+	}
+	if done {
+		slog.Info("already done", "decision", d)
+		return skip("done", "already done")
+	}
+	// catch suppressions added since the run started
+	if x, err := d.CheckSuppressed(ctx, s); err != nil {
+		return nil, err
+	} else if x != nil {
+		slog.Info("suppressed", "decision", d, "reason", x.Reason)
+		return skip("suppressed", "suppressed: "+jin.MaskText(x.Reason))
+	}
+	ctx = context.WithoutCancel(ctx)
+	// the pending entry outlives a crash or failure during the send, and
+	// blocks re-sending until reconciled
+	pending := path.Join(campaign.Key("pending"), d.Key())
+	buf, err := json.Marshal(jin.Pending{
+		Time:     time.Now(),
+		Owner:    store.Owner(),
+		Decision: d,
 	})
-	if aerr, ok := err.(awserr.Error); ok {
-		switch aerr.Code() {
-		case s3.ErrCodeNoSuchKey:
-			return false, nil
-		default:
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Create(ctx, pending, buf); errors.Is(err, store.ErrExists) {
+		slog.Warn("pending from an earlier run, needs reconciling", "decision", d)
+		return skip("pending", "pending from an earlier run")
+	} else if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	r, err := d.Contact(p, campaign)
+	latency.Observe(time.Since(start).Seconds(), d.Type())
+	if err != nil {
+		sends.Inc(d.Type(), "error")
+		if err := a.Append(ctx, audit.Sent, auditDecision(d, "error", jin.MaskText(err.Error()))); err != nil {
+			slog.Error("can't audit", "err", err)
+		}
+		return nil, err
+	}
+	if r.Successful {
+		sends.Inc(d.Type(), "sent")
+	} else {
+		sends.Inc(d.Type(), "failed")
+	}
+	if err := a.Append(ctx, audit.Sent, auditDecision(d, "successful", r.Successful, "message", r.MessageID())); err != nil {
+		return nil, err
+	}
+	if err := markDone(ctx, s, campaign, r); err != nil {
+		return nil, err
+	}
+	if err := s.Delete(ctx, pending); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// alreadyDone checks for a receipt under either the current or the legacy
+// key, so unmigrated receipts still prevent re-contacting anyone.
+func alreadyDone(ctx context.Context, s store.Store, campaign jin.Campaign, d jin.Decision) (bool, error) {
+	for _, key := range []string{d.Key(), d.LegacyKey()} {
+		_, err := getReceipt(ctx, s, path.Join(campaign.ReceiptPrefix(), key))
+		switch {
+		case err == nil:
+			return true, nil
+		case !errors.Is(err, store.ErrNotFound):
 			return false, err
 		}
 	}
-	defer resp.Body.Close()
-	dec := json.NewDecoder(resp.Body)
+	return false, nil
+}
+
+func getReceipt(ctx context.Context, s store.Store, key string) (*jin.Receipt, error) {
+	buf, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	var r jin.Receipt
-	if err := dec.Decode(&r); err != nil {
-		return false, fmt.Errorf("can't unmarshal %s: %w", d.Key(), err)
+	if err := json.Unmarshal(buf, &r); err != nil {
+		return nil, fmt.Errorf("can't unmarshal %s: %w", key, err)
 	}
-	return true, nil
+	return &r, nil
 }
 
-func markDone(session *session.Session, r *jin.Receipt) error {
+func markDone(ctx context.Context, s store.Store, campaign jin.Campaign, r *jin.Receipt) error {
 	buf, err := json.MarshalIndent(r, "", "  ")
 	if err != nil {
 		return err
 	}
-	if _, err := s3.New(session).PutObject(&s3.PutObjectInput{
-		Bucket: aws.String("drjin"),
-		Key:    aws.String(path.Join("receipts", r.Decision.Key())),
-		Body:   bytes.NewReader(buf),
-	}); err != nil {
+	key := path.Join(campaign.ReceiptPrefix(), r.Decision.Key())
+	if err := s.Put(ctx, key, buf); err != nil {
 		return err
 	}
+	if id := r.MessageID(); id != "" {
+		return s.Put(ctx, messageKey(id), []byte(key))
+	}
 	return nil
 }
 
-func init() {
-	rand.Seed(time.Now().UTC().UnixNano())
+// messageKey indexes receipts by the provider's message id, so that
+// later notifications can find them.
+func messageKey(id string) string {
+	return path.Join("messages", id)
 }
 
-func TestMode(c Config) error {
+func TestMode(ctx context.Context, c Config) error {
 	sess, err := c.AWSSession()
 	if err != nil {
 		return fmt.Errorf("can't create session: %w", err)
 	}
-	creds, err := stw.LoadCredentials(s3.New(sess))
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	creds, err := stw.LoadCredentials(ctx, s)
 	if err != nil {
 		return err
 	}
 
-	msg, err := jin.LoadMessage()
+	msg, err := c.campaign.LoadMessage()
 	if err != nil {
 		return err
 	}
+	e, err := c.campaign.Email("mra@xoba.com", msg)
+	if err != nil {
+		return err
+	}
+	e.From = "mra@xoba.com"
 
 	if true {
-		resp, err := saws.SendEmail(
-			ses.New(sess),
-			"mra@xoba.com",
-			"mra@xoba.com",
-			jin.EmailSubject,
-			msg,
-		)
+		resp, err := jin.Live{SES: ses.New(sess)}.SendEmail(*e)
 		if err != nil {
 			return err
 		}
@@ -494,7 +912,7 @@ func TestMode(c Config) error {
 			creds.NewClient(),
 			jin.TwilioNumber,
 			"+19176086254",
-			jin.TwimlURL,
+			c.campaign.TwimlURL,
 		)
 		if err != nil {
 			return err
@@ -518,3 +936,212 @@ func TestMode(c Config) error {
 
 	return nil
 }
+
+// Preview writes the campaign's html email to a local file, named by the
+// first argument or preview.html by default.
+func Preview(ctx context.Context, c Config) error {
+	msg, err := c.campaign.LoadMessage()
+	if err != nil {
+		return err
+	}
+	html, err := c.campaign.RenderHTML(msg)
+	if err != nil {
+		return err
+	}
+	if html == "" {
+		return fmt.Errorf("campaign %q has no html email", c.campaign.Name)
+	}
+	name := "preview.html"
+	if flag.NArg() > 0 {
+		name = flag.Arg(0)
+	}
+	if err := os.WriteFile(name, []byte(html), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", name)
+	return nil
+}
+
+// PrintLetters assembles letters written since -since and not yet
+// printed into a pdf for printing and a csv of mailing labels, in the
+// postal directory or the outbox. With a batch name as argument, it
+// assembles that earlier batch again.
+func PrintLetters(ctx context.Context, c Config) error {
+	dir := c.Postal
+	if c.Outbox != "" {
+		dir = c.Outbox
+	}
+	batch := time.Now().Format("20060102-150405")
+	if flag.NArg() > 0 {
+		batch = flag.Arg(0)
+	}
+	pdfName := filepath.Join(dir, "batch-"+batch+".pdf")
+	csvName := filepath.Join(dir, "labels-"+batch+".csv")
+	b := jin.PrintBatch{Dir: dir}
+	var n int
+	var err error
+	if flag.NArg() > 0 {
+		n, err = b.Reprint(batch, pdfName, csvName)
+	} else {
+		n, err = b.WriteBatch(batch, time.Now().Add(-c.Since), pdfName, csvName)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d letters to %s, labels to %s\n", n, pdfName, csvName)
+	fmt.Printf("these hold patients' names and addresses unencrypted; delete them once mailed\n")
+	return nil
+}
+
+// CheckAddresses lists patients whose addresses look undeliverable.
+func CheckAddresses(ctx context.Context, c Config) error {
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	contacts, err := jin.LoadContacts(ctx, s)
+	if err != nil {
+		return err
+	}
+	var n int
+	for _, i := range contacts {
+		if len(i.AddressProblems) == 0 {
+			continue
+		}
+		n++
+		fmt.Printf("%s: %s\n", i.ID, c.pii(i.PostalAddress().String()))
+		for _, p := range i.AddressProblems {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	fmt.Printf("%d of %d addresses look undeliverable\n", n, len(contacts))
+	return nil
+}
+
+// readReceipts reads all of the campaign's receipts.
+func readReceipts(ctx context.Context, s store.Store, campaign jin.Campaign) ([]*jin.Receipt, error) {
+	keys, err := s.List(ctx, campaign.ReceiptPrefix()+"/")
+	if err != nil {
+		return nil, err
+	}
+	m, err := getReceipts(ctx, s, keys)
+	if err != nil {
+		return nil, err
+	}
+	var out []*jin.Receipt
+	for _, k := range keys {
+		out = append(out, m[k])
+	}
+	return out, nil
+}
+
+// getReceipts reads the receipts at keys, by key.
+func getReceipts(ctx context.Context, s store.Store, keys []string) (map[string]*jin.Receipt, error) {
+	pool := task.Pool[string, *jin.Receipt]{
+		Threads: 20,
+		Func: func(ctx context.Context, key string) (*jin.Receipt, error) {
+			return getReceipt(ctx, s, key)
+		},
+	}
+	out := make(map[string]*jin.Receipt)
+	for _, r := range pool.Map(ctx, keys) {
+		if r.Err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", r.In, r.Err)
+		}
+		out[r.In] = r.Out
+	}
+	return out, nil
+}
+
+// receiptRefresh is how often a receiptCache reads every receipt again,
+// to pick up changes to ones it has, like bounces recorded from SES.
+const receiptRefresh = time.Hour
+
+// receiptCache keeps a campaign's receipts between daemon passes, reading
+// only new ones each time besides an occasional full refresh, since every
+// read of an encrypted store is a KMS decrypt.
+type receiptCache struct {
+	s        store.Store
+	campaign jin.Campaign
+	receipts map[string]*jin.Receipt // by key
+	read     time.Time               // when all were last read
+}
+
+func newReceiptCache(s store.Store, campaign jin.Campaign) *receiptCache {
+	return &receiptCache{s: s, campaign: campaign, receipts: make(map[string]*jin.Receipt)}
+}
+
+// update reads the receipts stored since the last update, or all of them
+// if it's time for a refresh, returning the campaign's receipts.
+func (rc *receiptCache) update(ctx context.Context) ([]*jin.Receipt, error) {
+	keys, err := rc.s.List(ctx, rc.campaign.ReceiptPrefix()+"/")
+	if err != nil {
+		return nil, err
+	}
+	all := time.Since(rc.read) > receiptRefresh
+	var todo []string
+	for _, k := range keys {
+		if _, ok := rc.receipts[k]; all || !ok {
+			todo = append(todo, k)
+		}
+	}
+	m, err := getReceipts(ctx, rc.s, todo)
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		rc.receipts = make(map[string]*jin.Receipt)
+		rc.read = time.Now()
+	}
+	for k, r := range m {
+		rc.receipts[k] = r
+	}
+	var out []*jin.Receipt
+	for _, k := range keys {
+		out = append(out, rc.receipts[k])
+	}
+	receiptReads.Add(float64(len(todo)))
+	return out, nil
+}
+
+// refreshPrices asks twilio again about the receipts it hadn't priced when
+// they were stored, saving the price on those it has priced since, so that
+// spend counts what was actually charged. It returns how many it priced.
+func refreshPrices(ctx context.Context, s store.Store, p jin.Provider, campaign jin.Campaign, receipts []*jin.Receipt) (int, error) {
+	var n int
+	for _, r := range receipts {
+		if !r.PriceDue(time.Now()) {
+			continue
+		}
+		content, err := p.Refresh(r.Content)
+		if err != nil {
+			return n, fmt.Errorf("can't refresh %s: %w", r.MessageID(), err)
+		}
+		priced := *r
+		priced.Content = content
+		if _, ok := priced.Cost(); !ok {
+			continue
+		}
+		key := path.Join(campaign.ReceiptPrefix(), r.Decision.Key())
+		if _, err := changeReceipt(ctx, s, key, func(r *jin.Receipt) { r.Content = content }); err != nil {
+			return n, err
+		}
+		r.Content = content
+		n++
+	}
+	return n, nil
+}
+
+// spend adds up what the receipts cost, estimating those whose provider
+// didn't say.
+func spend(receipts []*jin.Receipt, estimate func(jin.Decision) float64) float64 {
+	var total float64
+	for _, r := range receipts {
+		cost, ok := r.Cost()
+		if !ok {
+			cost = estimate(r.Decision)
+		}
+		total += cost
+	}
+	return total
+}
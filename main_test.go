@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/kevinburke/twilio-go"
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/metrics"
+	"github.com/xoba/sms/store"
+)
+
+// pricer is a provider whose twilio has since priced every message.
+type pricer struct {
+	jin.Outbox
+	refreshed int
+}
+
+func (p *pricer) Refresh(content interface{}) (interface{}, error) {
+	p.refreshed++
+	m := *content.(*twilio.Message)
+	m.Price = "-0.0075"
+	return &m, nil
+}
+
+func TestRefreshPrices(t *testing.T) {
+	ctx := context.Background()
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	campaign := jin.Campaign{Name: jin.DefaultCampaign}
+	var receipts []*jin.Receipt
+	for i, price := range []string{"", "-0.0150"} {
+		r := &jin.Receipt{
+			Time:       time.Now(),
+			Successful: true,
+			Decision:   jin.NewSMS(jin.Phone(fmt.Sprintf("+121255501%02d", i))),
+			Content:    &twilio.Message{Sid: fmt.Sprintf("SM%d", i), Price: price},
+		}
+		if err := markDone(ctx, s, campaign, r); err != nil {
+			t.Fatal(err)
+		}
+		receipts = append(receipts, r)
+	}
+	p := new(pricer)
+	n, err := refreshPrices(ctx, s, p, campaign, receipts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || p.refreshed != 1 {
+		t.Fatalf("priced %d, refreshed %d; want just the unpriced one", n, p.refreshed)
+	}
+	all, err := readReceipts(ctx, s, campaign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := spend(all, func(jin.Decision) float64 { return 1 })
+	if spent < 0.0224 || spent > 0.0226 {
+		t.Fatalf("spent %v, want the two twilio prices", spent)
+	}
+	// once priced, a receipt isn't asked about again
+	if n, err = refreshPrices(ctx, s, p, campaign, receipts); n != 0 || err != nil || p.refreshed != 1 {
+		t.Fatalf("priced %d again, %v", n, err)
+	}
+}
+
+// countingStore counts reads.
+type countingStore struct {
+	store.Store
+	gets atomic.Int64
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.gets.Add(1)
+	return s.Store.Get(ctx, key)
+}
+
+func TestReceiptCache(t *testing.T) {
+	ctx := context.Background()
+	dir, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &countingStore{Store: dir}
+	campaign := jin.Campaign{Name: jin.DefaultCampaign}
+	add := func(i int) {
+		r := &jin.Receipt{Time: time.Now(), Successful: true, Decision: jin.NewEmail(jin.Addr(fmt.Sprintf("p%d@example.com", i)))}
+		if err := markDone(ctx, s, campaign, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		add(i)
+	}
+	cache := newReceiptCache(s, campaign)
+	update := func(want, reads int) {
+		t.Helper()
+		s.gets.Store(0)
+		list, err := cache.update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.gets.Load(); len(list) != want || got != int64(reads) {
+			t.Fatalf("got %d receipts with %d reads, want %d with %d", len(list), got, want, reads)
+		}
+	}
+	update(3, 3)
+	update(3, 0)
+	add(3)
+	update(4, 1)
+	cache.read = time.Now().Add(-2 * receiptRefresh)
+	update(4, 4)
+}
+
+func TestCountRetries(t *testing.T) {
+	var b strings.Builder
+	scrape := func() string {
+		b.Reset()
+		metrics.Default.WriteTo(&b)
+		return b.String()
+	}
+	count := countRetries("test")
+	count(&request.Request{RetryCount: 0})
+	if strings.Contains(scrape(), `provider="test"`) {
+		t.Fatal("counted a request that wasn't retried")
+	}
+	count(&request.Request{RetryCount: 2})
+	count(&request.Request{RetryCount: 1})
+	if !strings.Contains(scrape(), `sms_provider_retries_total{provider="test"} 3`+"\n") {
+		t.Fatalf("retries not counted:\n%s", b.String())
+	}
+}
+
+func TestHealthzMasksErrors(t *testing.T) {
+	defer setHealth(nil)
+	setHealth(fmt.Errorf("sending: twilio: +12125551234 is unreachable"))
+	w := httptest.NewRecorder()
+	healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, "5551234") || !strings.Contains(body, "unreachable") {
+		t.Fatalf("got %q", body)
+	}
+}
+
+// A run stops before the contact that would take it over budget.
+func TestSendBudget(t *testing.T) {
+	ctx := context.Background()
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := waitForWorkingHours
+	waitForWorkingHours = func(context.Context) error { return nil }
+	defer func() { waitForWorkingHours = wait }()
+
+	message := filepath.Join(t.TempDir(), "message.txt")
+	if err := os.WriteFile(message, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	campaign := jin.Campaign{Name: "test", Message: message, Subject: "hello"}
+	c := Config{Prod: true, Hertz: 1000, Budget: 2.5 * jin.EmailPrice, campaign: &campaign}
+	var decisions []jin.Decision
+	for i := 0; i < 5; i++ {
+		decisions = append(decisions, jin.NewEmail(jin.Addr(fmt.Sprintf("p%d@example.com", i))))
+	}
+	outbox := jin.Outbox{Dir: t.TempDir()}
+	n, err := Send(ctx, c, s, outbox, newReceiptCache(s, campaign), decisions, len(decisions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("made %d contacts; want 2 within the budget", n)
+	}
+	if sent, err := filepath.Glob(filepath.Join(outbox.Dir, "*.json")); err != nil || len(sent) != 2 {
+		t.Fatalf("sent %d, %v", len(sent), err)
+	}
+	// what's spent counts against the next run
+	if n, err := Send(ctx, c, s, outbox, newReceiptCache(s, campaign), decisions, len(decisions)); err != nil || n != 0 {
+		t.Fatalf("made %d more contacts, %v", n, err)
+	}
+}
+
+// The campaign's settings apply unless given on the command line.
+func TestUseCampaign(t *testing.T) {
+	campaign := &jin.Campaign{Name: "test", Budget: 20, Quantity: 7, Order: "cheapest"}
+	var c Config
+	c.useCampaign(campaign, map[string]bool{})
+	if c.Budget != 20 || c.Quantity != 7 || c.Order != "cheapest" || c.campaign != campaign {
+		t.Fatalf("got %+v", c)
+	}
+	c = Config{Budget: 5, Quantity: 3}
+	c.useCampaign(campaign, map[string]bool{"budget": true, "q": true})
+	if c.Budget != 5 || c.Quantity != 3 || c.Order != "cheapest" {
+		t.Fatalf("got %+v", c)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/metrics"
+)
+
+var (
+	sends        = metrics.NewCounter("sms_sends_total", "Decisions tried, by channel and outcome.", "channel", "outcome")
+	latency      = metrics.NewHistogram("sms_provider_latency_seconds", "Time taken by the provider to send.", metrics.DefaultBuckets, "channel")
+	retries      = metrics.NewCounter("sms_provider_retries_total", "Requests to a provider retried after failing, by provider.", "provider")
+	passFailures = metrics.NewCounter("sms_daemon_failures_total", "Daemon passes that failed, to be tried again next poll.")
+	limiterWait  = metrics.NewCounter("sms_limiter_wait_seconds_total", "Time spent waiting on the rate limiter.")
+	queueDepth   = metrics.NewGauge("sms_queue_depth", "Decisions left to make in the current run.", "campaign")
+	spendGauge   = metrics.NewGauge("sms_spend_dollars", "What the campaign has spent.", "campaign")
+	receiptReads = metrics.NewCounter("sms_receipt_reads_total", "Receipts read from the store by the daemon and runs.")
+)
+
+// countRetries counts the retries the aws sdk made for a request, as a
+// session's Complete handler.
+func countRetries(provider string) func(*request.Request) {
+	return func(r *request.Request) {
+		if r.RetryCount > 0 {
+			retries.Add(float64(r.RetryCount), provider)
+		}
+	}
+}
+
+// health is what /healthz reports: the last error from a daemon pass,
+// if any.
+var health struct {
+	sync.Mutex
+	err error
+}
+
+func setHealth(err error) {
+	health.Lock()
+	defer health.Unlock()
+	health.err = err
+}
+
+func healthz(w http.ResponseWriter, _ *http.Request) {
+	health.Lock()
+	err := health.err
+	health.Unlock()
+	if err != nil {
+		http.Error(w, jin.MaskText(err.Error()), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// ServeMetrics serves /metrics and /healthz on addr until ctx is done.
+func ServeMetrics(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	mux.HandleFunc("/healthz", healthz)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	go server.Serve(ln)
+	slog.Info("serving metrics", "url", addr+"/metrics")
+	return nil
+}
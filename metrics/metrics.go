@@ -0,0 +1,185 @@
+// Package metrics keeps counters, gauges and histograms and serves them
+// in the prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit latencies in seconds.
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Registry holds metrics in the order they were made.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+// Default is the registry the New functions add to.
+var Default = new(Registry)
+
+type metric struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+	series           map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64   // counters and gauges, or the sum for histograms
+	counts []float64 // per bucket, cumulative
+	count  float64
+}
+
+func (r *Registry) add(name, help, kind string, buckets []float64, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := &metric{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	if len(labels) == 0 {
+		// shows as zero rather than missing until first used
+		m.series[""] = &series{counts: make([]float64, len(buckets))}
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// with runs f on the series for the label values, creating it if need be.
+func (r *Registry) with(m *metric, values []string, f func(*series)) {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("%s wants %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := strings.Join(values, "\xff")
+	s, ok := m.series[k]
+	if !ok {
+		s = &series{values: values, counts: make([]float64, len(m.buckets))}
+		m.series[k] = s
+	}
+	f(s)
+}
+
+type Counter struct {
+	r *Registry
+	m *metric
+}
+
+func NewCounter(name, help string, labels ...string) Counter {
+	return Counter{Default, Default.add(name, help, "counter", nil, labels)}
+}
+
+func (c Counter) Add(v float64, values ...string) {
+	c.r.with(c.m, values, func(s *series) { s.value += v })
+}
+
+func (c Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+type Gauge struct {
+	r *Registry
+	m *metric
+}
+
+func NewGauge(name, help string, labels ...string) Gauge {
+	return Gauge{Default, Default.add(name, help, "gauge", nil, labels)}
+}
+
+func (g Gauge) Set(v float64, values ...string) {
+	g.r.with(g.m, values, func(s *series) { s.value = v })
+}
+
+type Histogram struct {
+	r *Registry
+	m *metric
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) Histogram {
+	return Histogram{Default, Default.add(name, help, "histogram", buckets, labels)}
+}
+
+func (h Histogram) Observe(v float64, values ...string) {
+	h.r.with(h.m, values, func(s *series) {
+		for i, b := range h.m.buckets {
+			if v <= b {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.value += v
+	})
+}
+
+// the text format escapes only these, leaving other text as utf-8
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func labelString(names, values []string, extra ...string) string {
+	var list []string
+	for i, n := range names {
+		list = append(list, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		list = append(list, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(list) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(list, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteTo writes every metric in the prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+	for _, m := range r.metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, helpEscaper.Replace(m.help), m.name, m.kind)
+		var keys []string
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := m.series[k]
+			if m.kind != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", m.name, labelString(m.labels, s.values), formatFloat(s.value))
+				continue
+			}
+			les := append(append([]float64(nil), m.buckets...), math.Inf(1))
+			for i, le := range les {
+				n := s.count
+				if i < len(s.counts) {
+					n = s.counts[i]
+				}
+				fmt.Fprintf(&b, "%s_bucket%s %s\n", m.name, labelString(m.labels, s.values, "le", formatFloat(le)), formatFloat(n))
+			}
+			fmt.Fprintf(&b, "%s_sum%s %s\n", m.name, labelString(m.labels, s.values), formatFloat(s.value))
+			fmt.Fprintf(&b, "%s_count%s %s\n", m.name, labelString(m.labels, s.values), formatFloat(s.count))
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
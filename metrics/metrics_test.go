@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := new(Registry)
+	c := Counter{r, r.add("sends_total", "Sends, by channel.", "counter", nil, []string{"channel"})}
+	g := Gauge{r, r.add("depth", "Queue depth.", "gauge", nil, nil)}
+	h := Histogram{r, r.add("latency_seconds", "Latency.", "histogram", []float64{0.1, 1}, []string{"channel"})}
+	c.Inc("sms")
+	c.Add(2, "email")
+	g.Set(1.5)
+	for _, v := range []float64{0.05, 0.5, 5} {
+		h.Observe(v, "sms")
+	}
+	want := `# HELP sends_total Sends, by channel.
+# TYPE sends_total counter
+sends_total{channel="email"} 2
+sends_total{channel="sms"} 1
+# HELP depth Queue depth.
+# TYPE depth gauge
+depth 1.5
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{channel="sms",le="0.1"} 1
+latency_seconds_bucket{channel="sms",le="1"} 2
+latency_seconds_bucket{channel="sms",le="+Inf"} 3
+latency_seconds_sum{channel="sms"} 5.55
+latency_seconds_count{channel="sms"} 3
+`
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+// Only backslash, double quote and newline are escaped in label values,
+// and backslash and newline in help; everything else stays utf-8.
+func TestEscaping(t *testing.T) {
+	r := new(Registry)
+	c := Counter{r, r.add("x_total", "Back\\slash and\nnewline \"quoted\".", "counter", nil, []string{"name"})}
+	c.Inc("Estimado/a señor \"Qiu\"\\\n北京")
+	var b strings.Builder
+	r.WriteTo(&b)
+	want := `# HELP x_total Back\\slash and\nnewline "quoted".
+# TYPE x_total counter
+x_total{name="Estimado/a señor \"Qiu\"\\\n北京"} 1
+`
+	if b.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	r := new(Registry)
+	c := Counter{r, r.add("y_total", "Y.", "counter", nil, []string{"a", "b"})}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("took the wrong number of label values")
+		}
+	}()
+	c.Inc("a")
+}
+
+func TestConcurrent(t *testing.T) {
+	r := new(Registry)
+	c := Counter{r, r.add("z_total", "Z.", "counter", nil, []string{"n"})}
+	h := Histogram{r, r.add("h", "H.", "histogram", DefaultBuckets, nil)}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc([]string{"a", "b"}[j%2])
+				h.Observe(float64(j) / 10)
+				if j%10 == 0 {
+					w := httptest.NewRecorder()
+					r.ServeHTTP(w, nil)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	var b strings.Builder
+	r.WriteTo(&b)
+	for _, s := range []string{`z_total{n="a"} 400`, `z_total{n="b"} 400`, "h_count 800", `h_bucket{le="+Inf"} 800`} {
+		if !strings.Contains(b.String(), s+"\n") {
+			t.Errorf("missing %q in\n%s", s, b.String())
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/xoba/sms/jin"
+)
+
+// MigrateKeys copies every receipt stored under a legacy md5 key to its
+// versioned key. Legacy objects are left in place; alreadyDone honors both.
+func MigrateKeys(ctx context.Context, c Config) error {
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	prefix := c.campaign.ReceiptPrefix()
+	existing, err := loadReceipts(ctx, s, *c.campaign)
+	if err != nil {
+		return err
+	}
+	var legacy []string
+	for k := range existing {
+		if jin.IsLegacyKey(k) {
+			legacy = append(legacy, k)
+		}
+	}
+	fmt.Printf("%d legacy keys out of %d receipts\n", len(legacy), len(existing))
+	var migrated, skipped int
+	for _, k := range legacy {
+		r, err := getReceipt(ctx, s, path.Join(prefix, k))
+		if err != nil {
+			return err
+		}
+		if got := r.Decision.LegacyKey(); got != k {
+			return fmt.Errorf("receipt %s has legacy key %s", k, got)
+		}
+		r.Decision.Campaign = c.campaign.Name
+		key := r.Decision.Key()
+		if existing[key] {
+			skipped++
+			continue
+		}
+		if c.Verbose {
+			fmt.Printf("%s -> %s\n", k, key)
+		}
+		buf, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := s.Create(ctx, path.Join(prefix, key), buf); err != nil {
+			return err
+		}
+		existing[key] = true
+		migrated++
+	}
+	fmt.Printf("migrated %d, skipped %d already migrated\n", migrated, skipped)
+	return nil
+}
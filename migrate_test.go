@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/store"
+)
+
+// A receipt under its md5 key is copied to its v2 key, once.
+func TestMigrateKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := store.NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	campaign := jin.Campaign{Name: jin.DefaultCampaign}
+	d := jin.NewSMS("+12126888887")
+	buf, err := json.Marshal(jin.Receipt{Time: time.Now(), Successful: true, Decision: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := path.Join(campaign.ReceiptPrefix(), "ee397b5ae2961be5e7feb9fb0513fc04.json")
+	if err := s.Put(ctx, legacy, buf); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Store: dir, campaign: &campaign}
+	for i := 0; i < 2; i++ {
+		if err := MigrateKeys(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := getReceipt(ctx, s, path.Join(campaign.ReceiptPrefix(), "v2-69363d92252dbf774da004408b20470b.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Decision.Campaign != jin.DefaultCampaign || r.Decision.SMS == nil || *r.Decision.SMS != "+12126888887" {
+		t.Fatalf("migrated %v", r.Decision)
+	}
+	receipts, err := loadReceipts(ctx, s, campaign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 2 || !receipts[path.Base(legacy)] {
+		t.Fatalf("got receipts %v; want the legacy one kept alongside", receipts)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/xoba/sms/audit"
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/saws"
+	"github.com/xoba/sms/store"
+)
+
+// snsHandler takes SES bounce, complaint and delivery notifications from
+// SNS, recording them on the matching receipt and suppressing addresses
+// that hard-bounced or complained. SNS may deliver a notification more
+// than once, so each MessageId is handled only once.
+type snsHandler struct {
+	store   store.Store
+	audit   *audit.Log
+	verify  func(saws.SNSMessage) error
+	confirm func(saws.SNSMessage) error
+}
+
+var (
+	errUnverified = errors.New("can't verify")
+	errBadMessage = errors.New("bad message")
+)
+
+func (h snsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m, err := saws.ParseSNSMessage(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// SNS retries only after server errors, which is all that might go
+	// better a second time
+	switch err := h.handle(r.Context(), *m); {
+	case errors.Is(err, errUnverified):
+		slog.Warn("rejecting sns message", "id", m.MessageId, "err", err)
+		http.Error(w, "can't verify message", http.StatusForbidden)
+	case errors.Is(err, errBadMessage):
+		slog.Warn("rejecting sns message", "id", m.MessageId, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		slog.Error("can't handle sns message", "id", m.MessageId, "err", err)
+		http.Error(w, "can't handle message", http.StatusInternalServerError)
+	}
+}
+
+func (h snsHandler) handle(ctx context.Context, m saws.SNSMessage) (err error) {
+	if err := h.verify(m); err != nil {
+		return fmt.Errorf("%w: %v", errUnverified, err)
+	}
+	switch m.Type {
+	case "SubscriptionConfirmation":
+		slog.Info("confirming subscription", "topic", m.TopicArn)
+		if h.confirm == nil {
+			return nil
+		}
+		return h.confirm(m)
+	case "UnsubscribeConfirmation":
+		slog.Info("unsubscribed", "topic", m.TopicArn)
+		return nil
+	case "Notification":
+	default:
+		return fmt.Errorf("%w: unknown type %q", errBadMessage, m.Type)
+	}
+	n, err := saws.ParseSESNotification(m.Message)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBadMessage, err)
+	}
+	if m.MessageId != "" {
+		key := path.Join("sns", m.MessageId)
+		if err := h.store.Create(ctx, key, []byte(m.Timestamp)); errors.Is(err, store.ErrExists) {
+			slog.Info("skipping redelivered sns message", "id", m.MessageId)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// a failure is retried by SNS, which must then be handled again
+		defer func() {
+			if err != nil {
+				if err := h.store.Delete(context.WithoutCancel(ctx), key); err != nil {
+					slog.Error("can't forget sns message", "id", m.MessageId, "err", err)
+				}
+			}
+		}()
+	}
+	kind := n.Kind()
+	slog.Info("ses notification", "kind", kind, "id", n.Mail.MessageId)
+	var suppress []string
+	var reason string
+	failed := false
+	switch kind {
+	case "Bounce":
+		if n.Bounce != nil && n.Bounce.BounceType == "Permanent" {
+			failed = true
+			for _, r := range n.Bounce.BouncedRecipients {
+				suppress = append(suppress, r.EmailAddress)
+			}
+			reason = "hard bounce"
+			if len(n.Bounce.BouncedRecipients) > 0 && n.Bounce.BouncedRecipients[0].DiagnosticCode != "" {
+				reason += ": " + n.Bounce.BouncedRecipients[0].DiagnosticCode
+			}
+		}
+	case "Complaint":
+		if n.Complaint != nil {
+			for _, r := range n.Complaint.ComplainedRecipients {
+				suppress = append(suppress, r.EmailAddress)
+			}
+			reason = strings.TrimSpace("complaint " + n.Complaint.ComplaintFeedbackType)
+		}
+	}
+	for _, addr := range suppress {
+		x, err := jin.NewSuppression(jin.SuppressEmail, addr, fmt.Sprintf("%s (ses %s)", reason, n.Mail.MessageId))
+		if err != nil {
+			return err
+		}
+		if err := jin.AddSuppression(ctx, h.store, *x); err != nil {
+			return err
+		}
+	}
+	return h.updateReceipt(ctx, n.Mail.MessageId, jin.Event{
+		Time:   time.Now(),
+		Type:   kind,
+		Detail: n,
+	}, failed)
+}
+
+// updateReceipt adds the event to the receipt for the message, if we have
+// one; notifications for mail sent outside of a campaign are only logged.
+// It holds the decision's claim meanwhile, so that simultaneous events,
+// or a run sending the decision, don't overwrite each other.
+func (h snsHandler) updateReceipt(ctx context.Context, id string, e jin.Event, failed bool) error {
+	if id == "" {
+		return nil
+	}
+	buf, err := h.store.Get(ctx, messageKey(id))
+	if errors.Is(err, store.ErrNotFound) {
+		slog.Warn("no receipt for ses message", "id", id)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r, err := changeReceipt(ctx, h.store, string(buf), func(r *jin.Receipt) {
+		r.Events = append(r.Events, e)
+		if failed {
+			r.Successful = false
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return h.audit.Append(ctx, audit.Status, auditDecision(r.Decision, "status", e.Type, "message", id, "successful", r.Successful))
+}
+
+// claimReceipt takes the claim on the decision whose receipt is at key,
+// the same one a run holds while sending it, waiting a while for others
+// to finish with it.
+func claimReceipt(ctx context.Context, s store.Store, key string) (*store.Lease, error) {
+	// <campaign>/receipts/<decision> is claimed at <campaign>/claims/<decision>
+	claims := path.Join(path.Dir(path.Dir(key)), "claims", path.Base(key))
+	return store.Await(ctx, s, claims, time.Minute, 10*time.Second)
+}
+
+// changeReceipt applies f to the receipt at key while holding its claim.
+func changeReceipt(ctx context.Context, s store.Store, key string, f func(*jin.Receipt)) (*jin.Receipt, error) {
+	claim, err := claimReceipt(ctx, s, key)
+	if err != nil {
+		return nil, err
+	}
+	defer claim.Release(context.WithoutCancel(ctx))
+	r, err := getReceipt(ctx, s, key)
+	if err != nil {
+		return nil, err
+	}
+	f(r)
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return r, s.Put(ctx, key, buf)
+}
+
+// ServeSNS listens for SNS notifications at /sns.
+func ServeSNS(ctx context.Context, c Config) error {
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	a, err := startAudit(ctx, c, s)
+	if err != nil {
+		return err
+	}
+	v := new(saws.SNSVerifier)
+	mux := http.NewServeMux()
+	mux.Handle("/sns", snsHandler{
+		store:  s,
+		audit:  a,
+		verify: v.Verify,
+		confirm: func(m saws.SNSMessage) error {
+			return saws.ConfirmSubscription(nil, m)
+		},
+	})
+	server := &http.Server{Addr: c.Listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	slog.Info("listening for sns notifications", "url", c.Listen+"/sns")
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
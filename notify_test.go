@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/saws"
+	"github.com/xoba/sms/saws/snstest"
+	"github.com/xoba/sms/store"
+)
+
+// the message id of the email in testdata/sns
+const sesMessageID = "0100017f3a8b2c1d-5e6f7a8b-9c0d-4e1f-a2b3-c4d5e6f7a8b9-000000"
+
+// slowStore widens the window for lost updates.
+type slowStore struct {
+	store.Store
+}
+
+func (s slowStore) Put(ctx context.Context, key string, value []byte) error {
+	time.Sleep(5 * time.Millisecond)
+	return s.Store.Put(ctx, key, value)
+}
+
+type snsTest struct {
+	t       *testing.T
+	s       store.Store
+	h       snsHandler
+	signer  *snstest.Signer
+	receipt string // key
+}
+
+func newSNSTest(t *testing.T) *snsTest {
+	t.Helper()
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := snstest.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &saws.SNSVerifier{Client: signer.Client()}
+	campaign := jin.Campaign{Name: jin.DefaultCampaign}
+	d := jin.NewEmail("patient@example.com")
+	r := &jin.Receipt{
+		Time:       time.Now(),
+		Successful: true,
+		Decision:   d,
+		Content:    &ses.SendRawEmailOutput{MessageId: aws.String(sesMessageID)},
+	}
+	if err := markDone(context.Background(), s, campaign, r); err != nil {
+		t.Fatal(err)
+	}
+	return &snsTest{
+		t:       t,
+		s:       s,
+		h:       snsHandler{store: s, verify: v.Verify},
+		signer:  signer,
+		receipt: path.Join(campaign.ReceiptPrefix(), d.Key()),
+	}
+}
+
+func (x *snsTest) fixture(name string) *saws.SNSMessage {
+	x.t.Helper()
+	f, err := os.Open(path.Join("testdata/sns", name))
+	if err != nil {
+		x.t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := saws.ParseSNSMessage(f)
+	if err != nil {
+		x.t.Fatal(err)
+	}
+	return m
+}
+
+func (x *snsTest) post(m *saws.SNSMessage) int {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		x.t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	x.h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/sns", bytes.NewReader(buf)))
+	return w.Code
+}
+
+func (x *snsTest) signed(name string) *saws.SNSMessage {
+	m := x.fixture(name)
+	if err := x.signer.Sign(m, "2"); err != nil {
+		x.t.Fatal(err)
+	}
+	return m
+}
+
+func TestSNSBounce(t *testing.T) {
+	x := newSNSTest(t)
+	if code := x.post(x.signed("bounce.json")); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	r, err := getReceipt(context.Background(), x.s, x.receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Successful || len(r.Events) != 1 || r.Events[0].Type != "Bounce" {
+		t.Fatalf("receipt not updated for the bounce: %v", r)
+	}
+	sup, err := jin.NewEmail("patient@example.com").CheckSuppressed(context.Background(), x.s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sup == nil {
+		t.Fatal("hard bounce not suppressed")
+	}
+}
+
+func TestSNSRejects(t *testing.T) {
+	x := newSNSTest(t)
+	unsigned := x.fixture("bounce.json")
+	altered := x.signed("bounce.json")
+	altered.Message = `{"notificationType": "Delivery"}`
+	garbled := x.fixture("delivery.json")
+	garbled.Message = "not json"
+	if err := x.signer.Sign(garbled, "2"); err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]struct {
+		m    *saws.SNSMessage
+		code int
+	}{
+		"unsigned": {unsigned, http.StatusForbidden},
+		"altered":  {altered, http.StatusForbidden},
+		"garbled":  {garbled, http.StatusBadRequest},
+	} {
+		if code := x.post(c.m); code != c.code {
+			t.Errorf("%s: got %d, want %d", name, code, c.code)
+		}
+	}
+	w := httptest.NewRecorder()
+	x.h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/sns", bytes.NewReader([]byte("{"))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for bad json", w.Code)
+	}
+	w = httptest.NewRecorder()
+	x.h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sns", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d for a get", w.Code)
+	}
+	r, err := getReceipt(context.Background(), x.s, x.receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Successful || len(r.Events) != 0 {
+		t.Fatalf("rejected messages changed the receipt: %v", r)
+	}
+}
+
+// Simultaneous notifications about one email must all be recorded.
+func TestSNSConcurrentEvents(t *testing.T) {
+	x := newSNSTest(t)
+	x.s = slowStore{x.s}
+	x.h.store = x.s
+	const n = 10
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		m := x.fixture("delivery.json")
+		m.MessageId = fmt.Sprintf("delivery-%d", i)
+		if err := x.signer.Sign(m, "1"); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = x.post(m)
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("notification %d: got %d", i, code)
+		}
+	}
+	r, err := getReceipt(context.Background(), x.s, x.receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Events) != n {
+		t.Fatalf("recorded %d of %d events", len(r.Events), n)
+	}
+}
+
+// failingStore fails puts while fail is set.
+type failingStore struct {
+	store.Store
+	fail bool
+}
+
+func (s *failingStore) Put(ctx context.Context, key string, value []byte) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	return s.Store.Put(ctx, key, value)
+}
+
+// A notification SNS delivers again is recorded once, unless handling it
+// failed the first time.
+func TestSNSRedelivery(t *testing.T) {
+	x := newSNSTest(t)
+	s := &failingStore{Store: x.s, fail: true}
+	x.h.store = s
+	m := x.signed("delivery.json")
+	if code := x.post(m); code != http.StatusInternalServerError {
+		t.Fatalf("got %d with the store down", code)
+	}
+	s.fail = false
+	for i := 0; i < 2; i++ {
+		if code := x.post(m); code != http.StatusOK {
+			t.Fatalf("delivery %d: got %d", i, code)
+		}
+	}
+	r, err := getReceipt(context.Background(), x.s, x.receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Events) != 1 {
+		t.Fatalf("recorded %d events for one notification", len(r.Events))
+	}
+}
+
+func TestSNSSubscription(t *testing.T) {
+	x := newSNSTest(t)
+	var confirmed int
+	x.h.confirm = func(saws.SNSMessage) error {
+		confirmed++
+		return nil
+	}
+	m := x.fixture("subscription-confirmation.json")
+	if err := x.signer.Sign(m, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if code := x.post(m); code != http.StatusOK || confirmed != 1 {
+		t.Fatalf("got %d, confirmed %d times", code, confirmed)
+	}
+}
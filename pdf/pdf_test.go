@@ -0,0 +1,93 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		`plain`:          `plain`,
+		`(a) \ b`:        `\(a\) \\ b`,
+		"‘quoted’ “too”": `'quoted' "too"`,
+		"a–b—c":          "a-b-c",
+		"café":           `caf\351`,
+		"北京":             "??",
+	} {
+		if got := escape(in); got != want {
+			t.Errorf("escape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEncodable(t *testing.T) {
+	for s, want := range map[string]bool{
+		"Estimado/a señor:":   true,
+		"Any questions?":      true,
+		"Gracias — “Dr. Qiu”": true,
+		"您好":                  false,
+		"Здравствуйте":        false,
+	} {
+		if got := Encodable(s); got != want {
+			t.Errorf("Encodable(%q) = %v", s, got)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	got := Wrap("the quick  brown fox\njumps over the lazy dog", 10)
+	want := []string{"the quick", "brown fox", "jumps over", "the lazy", "dog"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q", got)
+	}
+	if got := Wrap("unbreakablewordhere x", 5); got[0] != "unbreakablewordhere" || got[1] != "x" {
+		t.Fatalf("got %q", got)
+	}
+	if got := Wrap("  ", 5); len(got) != 0 {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// The cross reference table must point at each object, and the trailer at
+// the table, or readers will have to repair the file.
+func TestBytesXref(t *testing.T) {
+	d := new(Document)
+	for i := 0; i < 3; i++ {
+		d.AddPage().Text(Regular, 11, 72, 720, fmt.Sprintf("page (%d)", i))
+	}
+	buf := d.Bytes()
+	if !bytes.HasPrefix(buf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(buf, []byte("%%EOF\n")) {
+		t.Fatal("missing header or trailer")
+	}
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(buf)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(buf[xref:], []byte("xref\n0 11\n")) {
+		t.Fatalf("startxref %d doesn't point at an xref of 11 entries", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(buf[xref:], -1)
+	if len(entries) != 10 {
+		t.Fatalf("%d xref entries", len(entries))
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(buf[off:], []byte(want)) {
+			t.Errorf("entry %d points at %q", i+1, buf[off:off+10])
+		}
+	}
+	if !bytes.Contains(buf, []byte("/Count 3")) || !bytes.Contains(buf, []byte(`(page \(2\)) Tj`)) {
+		t.Fatal("pages missing")
+	}
+	// stream lengths match their content
+	for _, m := range regexp.MustCompile(`(?s)/Length (\d+) >>\nstream\n(.*?)endstream`).FindAllSubmatch(buf, -1) {
+		if n, _ := strconv.Atoi(string(m[1])); n != len(m[2]) {
+			t.Errorf("stream of %d bytes has length %d", len(m[2]), n)
+		}
+	}
+}
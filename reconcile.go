@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/xoba/sms/audit"
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/store"
+)
+
+// Reconcile resolves pending entries left by interrupted runs, asking the
+// provider whether each decision was actually carried out. Those that
+// were get a receipt; those that weren't are cleared to be retried.
+// Twilio's call and message logs are searched, but SES has no log of
+// sent mail, so email entries stay unresolved unless -assume is given.
+// Then receipts twilio hadn't priced when they were stored get the price
+// it has settled on since.
+func Reconcile(ctx context.Context, c Config) error {
+	switch c.Assume {
+	case "", "sent", "unsent":
+	default:
+		return fmt.Errorf("illegal assumption: %q", c.Assume)
+	}
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	provider, err := c.Provider(ctx, s)
+	if err != nil {
+		return err
+	}
+	a, err := startAudit(ctx, c, s)
+	if err != nil {
+		return err
+	}
+	lock, err := store.NewLock(ctx, s, c.campaign.Key("lock"), store.Owner(), time.Minute)
+	if errors.Is(err, store.ErrClaimed) {
+		return fmt.Errorf("campaign %q is being run by somebody else", c.campaign.Name)
+	} else if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	keys, err := s.List(ctx, c.campaign.Key("pending")+"/")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d pending entries\n", len(keys))
+	var sent, unsent, unknown int
+	for _, k := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		buf, err := s.Get(ctx, k)
+		if err != nil {
+			return err
+		}
+		var p jin.Pending
+		if err := json.Unmarshal(buf, &p); err != nil {
+			return fmt.Errorf("can't unmarshal %s: %w", k, err)
+		}
+		if path.Base(k) != p.Decision.Key() {
+			return fmt.Errorf("pending entry %s is for %s", k, p.Decision.Key())
+		}
+		// allow for clock skew between us and the provider
+		r, err := p.Decision.Find(provider, p.Time.Add(-time.Minute))
+		if errors.Is(err, jin.ErrUnknown) {
+			switch c.Assume {
+			case "sent":
+				r = &jin.Receipt{
+					Time:       time.Now(),
+					Successful: true,
+					Decision:   p.Decision,
+					Content:    "assumed sent when reconciling",
+				}
+			case "unsent":
+			default:
+				slog.Warn("can't tell whether sent", "decision", p.Decision, "owner", p.Owner, "time", p.Time)
+				unknown++
+				continue
+			}
+		} else if err != nil {
+			return err
+		}
+		status := "not sent"
+		if r != nil {
+			status = "sent"
+			if errors.Is(err, jin.ErrUnknown) {
+				status = "assumed sent"
+			}
+		}
+		if err := a.Append(ctx, audit.Status, auditDecision(p.Decision, "status", status, "owner", p.Owner)); err != nil {
+			return err
+		}
+		if r != nil {
+			if done, err := alreadyDone(ctx, s, *c.campaign, p.Decision); err != nil {
+				return err
+			} else if !done {
+				if err := markDone(ctx, s, *c.campaign, r); err != nil {
+					return err
+				}
+			}
+			slog.Info("sent", "decision", p.Decision, "owner", p.Owner, "time", p.Time)
+			sent++
+		} else {
+			slog.Info("not sent", "decision", p.Decision, "owner", p.Owner, "time", p.Time)
+			unsent++
+		}
+		if err := s.Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%d sent, %d not sent, %d unresolved\n", sent, unsent, unknown)
+	if unknown > 0 {
+		fmt.Println("check the unresolved ones by hand, like in the SES sending statistics, then settle them with -assume sent or -assume unsent")
+	}
+	receipts, err := readReceipts(ctx, s, *c.campaign)
+	if err != nil {
+		return err
+	}
+	priced, err := refreshPrices(ctx, s, provider, *c.campaign, receipts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d receipts newly priced by twilio\n", priced)
+	return nil
+}
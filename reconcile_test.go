@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/store"
+)
+
+// A pending entry left by an interrupted run gets a receipt if the
+// provider sent it, and is cleared to be retried if not; either way it
+// isn't pending anymore.
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := store.NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	campaign := jin.Campaign{Name: "test"}
+	outbox := jin.Outbox{Dir: t.TempDir()}
+	sent, unsent := jin.NewSMS("+12126888887"), jin.NewSMS("+12126888888")
+	sent.Campaign, unsent.Campaign = campaign.Name, campaign.Name
+	for _, d := range []jin.Decision{sent, unsent} {
+		p := jin.Pending{Time: time.Now(), Owner: "crashed", Decision: d}
+		if err := s.Put(ctx, path.Join(campaign.Key("pending"), d.Key()), []byte(p.String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := outbox.SendSMS(*sent.SMS, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Reconcile(ctx, Config{Store: dir, Outbox: outbox.Dir, campaign: &campaign}); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := alreadyDone(ctx, s, campaign, sent); err != nil || !done {
+		t.Fatalf("no receipt for what the provider sent: %v", err)
+	}
+	if done, err := alreadyDone(ctx, s, campaign, unsent); err != nil || done {
+		t.Fatalf("a receipt for what the provider never sent: %v", err)
+	}
+	if keys, err := s.List(ctx, campaign.Key("pending")+"/"); err != nil || len(keys) != 0 {
+		t.Fatalf("still pending: %v, %v", keys, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/saws"
+	"github.com/xoba/sms/store"
+)
+
+// Replies ingests patient replies giving their new PCP:
+//
+//	-m replies ingest
+//	-m replies list
+//	-m replies review
+//	-m replies accept <id> [name=...] [phone=...] [fax=...] [patient=...]
+//
+// where ingest reads sms replies within -since and emails saved in the
+// -inbox directory, review lists parses that need a human to check them,
+// and accept marks one checked, with corrections, and attaches it to
+// its patient.
+func Replies(ctx context.Context, c Config) error {
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("replies needs a command: ingest, list, review, or accept")
+	}
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "ingest":
+		return IngestReplies(ctx, c, s)
+	case "list", "review":
+		keys, err := s.List(ctx, jin.ReplyPrefix+"/")
+		if err != nil {
+			return err
+		}
+		var n int
+		for _, k := range keys {
+			r, err := jin.LoadReply(ctx, s, k)
+			if err != nil {
+				return err
+			}
+			if cmd == "review" && !r.NeedsReview() {
+				continue
+			}
+			n++
+			fmt.Printf("%s %s from %s (patient %q): %s\n", r.ID, r.Time.Format(time.RFC3339), c.pii(r.From), r.Patient, r.PCP)
+			if len(r.Problems) > 0 {
+				fmt.Printf("  review: %s; reviewed: %v\n", strings.Join(r.Problems, ", "), r.Reviewed)
+			}
+			switch {
+			case cmd != "review":
+			case c.UnsafeLog:
+				fmt.Printf("  %q\n", r.Body)
+			default:
+				fmt.Printf("  (body hidden, since it may identify the patient; use -unsafe-log to see it)\n")
+			}
+		}
+		fmt.Printf("%d replies\n", n)
+	case "accept":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: accept <id> [name=...] [phone=...] [fax=...] [patient=...]")
+		}
+		r, err := jin.LoadReply(ctx, s, jin.Reply{ID: args[0]}.Key())
+		if err != nil {
+			return err
+		}
+		for _, a := range args[1:] {
+			k, v, ok := strings.Cut(a, "=")
+			if !ok {
+				return fmt.Errorf("bad correction %q", a)
+			}
+			switch k {
+			case "name":
+				r.PCP.Name = v
+			case "phone", "fax":
+				n, err := jin.CleanNumber(v)
+				if err != nil {
+					return err
+				}
+				if k == "phone" {
+					r.PCP.Phone = n
+				} else {
+					r.PCP.Fax = n
+				}
+			case "patient":
+				r.Patient = v
+			default:
+				return fmt.Errorf("bad correction %q", a)
+			}
+		}
+		r.Reviewed = true
+		if err := jin.SaveReply(ctx, s, *r, false); err != nil {
+			return err
+		}
+		p, err := jin.AttachReply(ctx, s, *r)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("patient %s now has pcp %s\n", p.ID, p.PCP)
+	default:
+		return fmt.Errorf("unknown replies command: %q", cmd)
+	}
+	return nil
+}
+
+// IngestReplies parses new replies and attaches them to patients.
+func IngestReplies(ctx context.Context, c Config, s store.Store) error {
+	contacts, err := jin.LoadContacts(ctx, s)
+	if err != nil {
+		return err
+	}
+	senders := jin.Senders(contacts)
+	provider, err := c.Provider(ctx, s)
+	if err != nil {
+		return err
+	}
+	var replies []jin.Reply
+	inbound, err := provider.Inbound(time.Now().Add(-c.Since))
+	if err != nil {
+		return err
+	}
+	stops, err := jin.SuppressStops(ctx, s, inbound)
+	if err != nil {
+		return err
+	}
+	for _, m := range inbound {
+		if jin.IsStop(m.Body) {
+			continue // suppressed, with nothing to parse
+		}
+		replies = append(replies, jin.Reply{ID: m.ID, Time: m.Time, Channel: "sms", From: m.From, Body: m.Body})
+	}
+	emails, err := readInbox(c.Inbox)
+	if err != nil {
+		return err
+	}
+	replies = append(replies, emails...)
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].Time.Before(replies[j].Time)
+	})
+
+	var added, review int
+	for _, r := range replies {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r.Patient = jin.Sender(senders, r.From)
+		r.PCP, r.Problems = jin.ParsePCP(r.Body)
+		if r.Patient == "" {
+			r.Problems = append(r.Problems, "unknown sender")
+		}
+		if err := jin.SaveReply(ctx, s, r, true); errors.Is(err, store.ErrExists) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		added++
+		if r.NeedsReview() {
+			review++
+		}
+		if r.Patient != "" {
+			if _, err := jin.AttachReply(ctx, s, r); err != nil {
+				return err
+			}
+		}
+		if c.Verbose {
+			fmt.Printf("%s from %s: %s %v\n", r.ID, c.pii(r.From), r.PCP, r.Problems)
+		}
+	}
+	fmt.Printf("ingested %d new replies, %d need review, and suppressed %d stop replies\n", added, review, stops)
+	return nil
+}
+
+// readInbox reads the emails saved as files in dir, if it exists.
+func readInbox(dir string) ([]jin.Reply, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return nil, err
+	}
+	var out []jin.Reply
+	for _, n := range names {
+		buf, err := os.ReadFile(n)
+		if err != nil {
+			return nil, err
+		}
+		m, err := saws.ReadEmail(strings.NewReader(string(buf)))
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", n, err)
+		}
+		id := m.ID
+		if id == "" {
+			id = fmt.Sprintf("email-%x", sha256.Sum256(buf))[:22]
+		}
+		t := m.Time
+		if t.IsZero() {
+			if fi, err := os.Stat(n); err == nil {
+				t = fi.ModTime()
+			}
+		}
+		out = append(out, jin.Reply{ID: id, Time: t, Channel: "email", From: m.From, Body: m.Text})
+	}
+	return out, nil
+}
@@ -0,0 +1,37 @@
+package saws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// KMS wraps data keys with an AWS KMS key, for store.Encrypted.
+type KMS struct {
+	Svc   *kms.KMS
+	KeyID string // key id, arn or alias, like alias/drjin
+}
+
+func (k KMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	resp, err := k.Svc.EncryptWithContext(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(k.KeyID),
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.CiphertextBlob, aws.StringValue(resp.KeyId), nil
+}
+
+// Decrypt fails unless keyID is the key that wrapped the ciphertext.
+func (k KMS) Decrypt(ctx context.Context, ciphertext []byte, keyID string) ([]byte, error) {
+	resp, err := k.Svc.DecryptWithContext(ctx, &kms.DecryptInput{
+		CiphertextBlob: ciphertext,
+		KeyId:          aws.String(keyID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
@@ -0,0 +1,350 @@
+package saws
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// MaxRawSize is the largest message SES accepts, after encoding.
+const MaxRawSize = 10 << 20
+
+// Attachment is a file carried by an Email. Inline ones are referenced
+// from the html as "cid:" + ContentID.
+type Attachment struct {
+	Name        string
+	ContentType string `json:",omitempty"`
+	ContentID   string `json:",omitempty"`
+	Data        []byte `json:"-"`
+}
+
+// NewAttachment names data after a file, guessing its content type by
+// extension.
+func NewAttachment(name string, data []byte) Attachment {
+	t := mime.TypeByExtension(filepath.Ext(name))
+	if t == "" {
+		t = "application/octet-stream"
+	}
+	return Attachment{
+		Name:        filepath.Base(name),
+		ContentType: t,
+		Data:        data,
+	}
+}
+
+// Email is a message for SendRawEmail.
+type Email struct {
+	From, To    string
+	ReplyTo     string            `json:",omitempty"`
+	Subject     string            `json:",omitempty"`
+	Text        string            `json:",omitempty"`
+	HTML        string            `json:",omitempty"`
+	Headers     map[string]string `json:",omitempty"` // like List-Unsubscribe
+	Attachments []Attachment      `json:",omitempty"`
+	Inline      []Attachment      `json:",omitempty"`
+}
+
+// NeedsRaw reports whether the email can't be sent with SendEmail.
+func (e Email) NeedsRaw() bool {
+	return e.ReplyTo != "" || len(e.Headers) > 0 || len(e.Attachments) > 0 || len(e.Inline) > 0
+}
+
+func checkHeader(name, value string) error {
+	if strings.ContainsAny(name+value, "\r\n") {
+		return fmt.Errorf("illegal header %q: %q", name, value)
+	}
+	return nil
+}
+
+func textPart(w *multipart.Writer, contentType, body string) error {
+	p, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	q := quotedprintable.NewWriter(p)
+	if _, err := io.WriteString(q, body); err != nil {
+		return err
+	}
+	return q.Close()
+}
+
+// base64Lines wraps base64 at 76 characters, as MIME requires.
+type base64Lines struct {
+	w io.Writer
+	n int
+}
+
+func (b *base64Lines) Write(p []byte) (int, error) {
+	for i, c := range p {
+		if b.n == 76 {
+			if _, err := b.w.Write([]byte("\r\n")); err != nil {
+				return i, err
+			}
+			b.n = 0
+		}
+		if _, err := b.w.Write([]byte{c}); err != nil {
+			return i, err
+		}
+		b.n++
+	}
+	return len(p), nil
+}
+
+func filePart(w *multipart.Writer, a Attachment, disposition string) error {
+	h := textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(a.ContentType, map[string]string{"name": a.Name})},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType(disposition, map[string]string{"filename": a.Name})},
+	}
+	if a.ContentID != "" {
+		h.Set("Content-ID", "<"+a.ContentID+">")
+	}
+	p, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, &base64Lines{w: p})
+	if _, err := enc.Write(a.Data); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// nested starts a multipart part of the given subtype within w.
+func nested(w *multipart.Writer, subtype string) (*multipart.Writer, error) {
+	inner := multipart.NewWriter(nil)
+	p, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf("multipart/%s; boundary=%s", subtype, inner.Boundary())},
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := multipart.NewWriter(p)
+	if err := out.SetBoundary(inner.Boundary()); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Bytes renders the email as MIME: multipart/mixed around attachments,
+// multipart/related around inline images, and multipart/alternative
+// around the text and html, each layer only if needed.
+func (e Email) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	headers := map[string]string{
+		"From":         e.From,
+		"To":           e.To,
+		"Subject":      mime.QEncoding.Encode("UTF-8", e.Subject),
+		"Date":         time.Now().Format(time.RFC1123Z),
+		"MIME-Version": "1.0",
+	}
+	if e.ReplyTo != "" {
+		headers["Reply-To"] = e.ReplyTo
+	}
+	for k, v := range e.Headers {
+		headers[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	var names []string
+	for k, v := range headers {
+		if err := checkHeader(k, v); err != nil {
+			return nil, err
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(buf, "%s: %s\r\n", k, headers[k])
+	}
+
+	top := multipart.NewWriter(buf)
+	subtype := "alternative"
+	switch {
+	case len(e.Attachments) > 0:
+		subtype = "mixed"
+	case len(e.Inline) > 0:
+		subtype = "related"
+	}
+	fmt.Fprintf(buf, "Content-Type: multipart/%s; boundary=%s\r\n\r\n", subtype, top.Boundary())
+
+	related := top
+	if subtype == "mixed" && len(e.Inline) > 0 {
+		w, err := nested(top, "related")
+		if err != nil {
+			return nil, err
+		}
+		related = w
+	}
+	alternative := related
+	if subtype != "alternative" {
+		w, err := nested(related, "alternative")
+		if err != nil {
+			return nil, err
+		}
+		alternative = w
+	}
+	if err := textPart(alternative, "text/plain", e.Text); err != nil {
+		return nil, err
+	}
+	if e.HTML != "" {
+		if err := textPart(alternative, "text/html", e.HTML); err != nil {
+			return nil, err
+		}
+	}
+	if alternative != related {
+		if err := alternative.Close(); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range e.Inline {
+		if err := filePart(related, a, "inline"); err != nil {
+			return nil, err
+		}
+	}
+	if related != top {
+		if err := related.Close(); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range e.Attachments {
+		if err := filePart(top, a, "attachment"); err != nil {
+			return nil, err
+		}
+	}
+	if err := top.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() > MaxRawSize {
+		return nil, fmt.Errorf("email is %d bytes, more than the %d allowed", buf.Len(), MaxRawSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// SendRawEmail sends the email as MIME, checking its size beforehand.
+func SendRawEmail(svc *ses.SES, e Email) (*ses.SendRawEmailOutput, error) {
+	raw, err := e.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return svc.SendRawEmail(&ses.SendRawEmailInput{
+		Source:       aws.String(e.From),
+		Destinations: []*string{aws.String(e.To)},
+		RawMessage: &ses.RawMessage{
+			Data: raw,
+		},
+	})
+}
+
+// Received is an email read back by ReadEmail, as stored by an SES
+// receipt rule or any mail program.
+type Received struct {
+	ID      string
+	Time    time.Time
+	From    string
+	Subject string
+	Text    string
+}
+
+// ReadEmail parses a MIME message, keeping its plain text, or its html
+// with the tags stripped if that's all there is.
+func ReadEmail(r io.Reader) (*Received, error) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	out := Received{ID: strings.Trim(m.Header.Get("Message-Id"), "<> ")}
+	if t, err := m.Header.Date(); err == nil {
+		out.Time = t
+	}
+	if a, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+		out.From = a.Address
+	}
+	dec := new(mime.WordDecoder)
+	if s, err := dec.DecodeHeader(m.Header.Get("Subject")); err == nil {
+		out.Subject = s
+	}
+	text, html, err := readBody(textproto.MIMEHeader(m.Header), m.Body)
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		text = stripTags(html)
+	}
+	out.Text = text
+	return &out, nil
+}
+
+// readBody returns the first text/plain and text/html parts of a body.
+func readBody(h textproto.MIMEHeader, body io.Reader) (text, html string, err error) {
+	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		t = "text/plain"
+	}
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	if strings.HasPrefix(t, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return text, html, nil
+			} else if err != nil {
+				return "", "", err
+			}
+			t, h, err := readBody(p.Header, p)
+			if err != nil {
+				return "", "", err
+			}
+			if text == "" {
+				text = t
+			}
+			if html == "" {
+				html = h
+			}
+		}
+	}
+	buf, err := io.ReadAll(io.LimitReader(body, MaxRawSize))
+	if err != nil {
+		return "", "", err
+	}
+	switch t {
+	case "text/plain":
+		return string(buf), "", nil
+	case "text/html":
+		return "", string(buf), nil
+	}
+	return "", "", nil
+}
+
+var (
+	tags       = regexp.MustCompile(`(?s)<(script|style).*?</(script|style)>|<[^>]*>`)
+	blockTags  = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li)[^>]*>`)
+	blankLines = regexp.MustCompile(`\n\s*\n\s*`)
+)
+
+func stripTags(s string) string {
+	s = blockTags.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(tags.ReplaceAllString(s, ""))
+	return strings.TrimSpace(blankLines.ReplaceAllString(s, "\n\n"))
+}
@@ -0,0 +1,199 @@
+package saws_test
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/xoba/sms/saws"
+)
+
+type part struct {
+	contentType, id, disposition string
+	body                         []byte
+}
+
+// walk flattens a parsed message into its leaf parts, decoded, with the
+// multipart types enclosing them in order.
+func walk(t *testing.T, h mail.Header, body io.Reader, parts *[]part, types *[]string) {
+	t.Helper()
+	ct, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(ct, "multipart/") {
+		*types = append(*types, ct)
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextPart()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			walk(t, mail.Header(p.Header), p, parts, types)
+		}
+	}
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*parts = append(*parts, part{ct, h.Get("Content-Id"), h.Get("Content-Disposition"), buf})
+}
+
+func TestEmailBytes(t *testing.T) {
+	pdf := bytes.Repeat([]byte("%PDF-1.4 letter "), 100)
+	e := saws.Email{
+		From:        "clinic@example.com",
+		To:          "patient@example.com",
+		ReplyTo:     "replies@example.com",
+		Subject:     "Votre dossier médical",
+		Text:        "Bonjour,\nvotre médecin ferme.",
+		HTML:        "<p>Bonjour,</p><p>votre médecin ferme.</p>",
+		Headers:     map[string]string{"list-unsubscribe": "<mailto:stop@example.com>"},
+		Attachments: []saws.Attachment{saws.NewAttachment("letters/letter.pdf", pdf)},
+		Inline:      []saws.Attachment{{Name: "logo.png", ContentType: "image/png", ContentID: "logo", Data: []byte("png")}},
+	}
+	if !e.NeedsRaw() {
+		t.Fatal("an email with attachments needs sending raw")
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Fatalf("line of %d bytes", len(line))
+		}
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"From":             e.From,
+		"To":               e.To,
+		"Reply-To":         e.ReplyTo,
+		"List-Unsubscribe": "<mailto:stop@example.com>",
+		"Mime-Version":     "1.0",
+	} {
+		if got := m.Header.Get(k); got != v {
+			t.Errorf("%s is %q; want %q", k, got, v)
+		}
+	}
+	if s, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject")); err != nil || s != e.Subject {
+		t.Errorf("subject is %q, %v", s, err)
+	}
+
+	var parts []part
+	var types []string
+	walk(t, m.Header, m.Body, &parts, &types)
+	if got := strings.Join(types, " "); got != "multipart/mixed multipart/related multipart/alternative" {
+		t.Fatalf("nesting is %s", got)
+	}
+	if len(parts) != 4 {
+		t.Fatalf("got %d parts", len(parts))
+	}
+	// multipart.Reader undoes quoted-printable itself, but not base64, and
+	// text lines end in crlf
+	for i, want := range []string{e.Text, e.HTML} {
+		if got := strings.ReplaceAll(string(parts[i].body), "\r\n", "\n"); got != want {
+			t.Errorf("part %d is %q; want %q", i, got, want)
+		}
+	}
+	if p := parts[2]; p.contentType != "image/png" || p.id != "<logo>" || !strings.HasPrefix(p.disposition, "inline") {
+		t.Errorf("inline part is %+v", p)
+	}
+	if p := parts[3]; p.contentType != "application/pdf" || !strings.Contains(p.disposition, `filename=letter.pdf`) {
+		t.Errorf("attachment is %s, %s", p.contentType, p.disposition)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(parts[3].body)), "\r\n") {
+		if len(line) > 76 {
+			t.Fatalf("base64 line of %d characters", len(line))
+		}
+	}
+}
+
+func TestEmailBytesLayers(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		e    saws.Email
+		want string
+	}{
+		{"plain", saws.Email{Text: "hi"}, "multipart/alternative"},
+		{"inline", saws.Email{Text: "hi", Inline: []saws.Attachment{{Name: "a.png", ContentType: "image/png"}}}, "multipart/related multipart/alternative"},
+		{"attached", saws.Email{Text: "hi", Attachments: []saws.Attachment{saws.NewAttachment("a.bin", nil)}}, "multipart/mixed multipart/alternative"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.e.From, c.e.To = "a@example.com", "b@example.com"
+			raw, err := c.e.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var parts []part
+			var types []string
+			walk(t, m.Header, m.Body, &parts, &types)
+			if got := strings.Join(types, " "); got != c.want {
+				t.Fatalf("nesting is %s; want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestEmailBytesRejects(t *testing.T) {
+	e := saws.Email{From: "a@example.com", To: "b@example.com", Subject: "hi"}
+	e.Headers = map[string]string{"X-Campaign": "one\r\nBcc: c@example.com"}
+	if _, err := e.Bytes(); err == nil {
+		t.Fatal("allowed a header with a newline")
+	}
+	e.Headers = nil
+	e.Attachments = []saws.Attachment{saws.NewAttachment("big.bin", make([]byte, saws.MaxRawSize))}
+	_, err := e.Bytes()
+	if err == nil {
+		t.Fatal("allowed an email over the size limit")
+	}
+	if strings.Contains(err.Error(), e.To) {
+		t.Fatalf("error %q shows the address", err)
+	}
+}
+
+func TestReadEmail(t *testing.T) {
+	e := saws.Email{
+		From:    "Jane Doe <jane@example.com>",
+		To:      "replies@example.com",
+		Subject: "Re: Votre dossier médical",
+		Text:    "My new doctor is Dr. Smith, fax 212-555-0100.",
+		HTML:    "<p>ignored</p>",
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := saws.ReadEmail(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.From != "jane@example.com" || r.Subject != e.Subject || r.Text != e.Text || r.Time.IsZero() {
+		t.Fatalf("read %+v", r)
+	}
+
+	html := "Message-Id: <abc@example.com>\r\n" +
+		"From: jane@example.com\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"\r\n" +
+		"<style>p {}</style><p>Dr. Smith &amp; Partners</p><p>fax 212-555-0100<br>thanks</p>"
+	if r, err = saws.ReadEmail(strings.NewReader(html)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Dr. Smith & Partners\nfax 212-555-0100\nthanks"; r.ID != "abc@example.com" || r.Text != want {
+		t.Fatalf("read %q, %q; want %q", r.ID, r.Text, want)
+	}
+}
@@ -22,7 +22,9 @@ func NewSessionFromProfile(profile string) (*session.Session, error) {
 	})
 }
 
-func SendEmail(svc *ses.SES, from, to, subject, body string) (*ses.SendEmailOutput, error) {
+// SendEmail sends a text email, or multipart/alternative with the text as
+// fallback if html is given.
+func SendEmail(svc *ses.SES, from, to, subject, text, html string) (*ses.SendEmailOutput, error) {
 	content := func(x string) *ses.Content {
 		return &ses.Content{
 			Charset: aws.String("UTF-8"),
@@ -33,6 +35,12 @@ func SendEmail(svc *ses.SES, from, to, subject, body string) (*ses.SendEmailOutp
 		out = append(out, aws.String(a))
 		return
 	}
+	body := &ses.Body{
+		Text: content(text),
+	}
+	if html != "" {
+		body.Html = content(html)
+	}
 	return svc.SendEmail(&ses.SendEmailInput{
 		Destination: &ses.Destination{
 			ToAddresses:  addrs(to),
@@ -41,9 +49,7 @@ func SendEmail(svc *ses.SES, from, to, subject, body string) (*ses.SendEmailOutp
 		},
 		Message: &ses.Message{
 			Subject: content(subject),
-			Body: &ses.Body{
-				Text: content(body),
-			},
+			Body:    body,
 		},
 		//ReplyToAddresses: addrs(from),
 		Source: aws.String(from),
@@ -0,0 +1,240 @@
+package saws
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SNSMessage is the body of an http(s) notification from SNS.
+type SNSMessage struct {
+	Type             string
+	MessageId        string
+	Token            string `json:",omitempty"`
+	TopicArn         string
+	Subject          string `json:",omitempty"`
+	Message          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+	SubscribeURL     string `json:",omitempty"`
+	UnsubscribeURL   string `json:",omitempty"`
+}
+
+func ParseSNSMessage(r io.Reader) (*SNSMessage, error) {
+	var m SNSMessage
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("can't unmarshal sns message: %w", err)
+	}
+	return &m, nil
+}
+
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// checkSNSURL makes sure we only ever fetch from SNS itself.
+func checkSNSURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || !snsHost.MatchString(u.Host) {
+		return fmt.Errorf("not an sns url: %q", raw)
+	}
+	return nil
+}
+
+// signedFields lists, in order, the fields covered by the signature.
+func (m SNSMessage) signedFields() ([][2]string, error) {
+	switch m.Type {
+	case "Notification":
+		f := [][2]string{{"Message", m.Message}, {"MessageId", m.MessageId}}
+		if m.Subject != "" {
+			f = append(f, [2]string{"Subject", m.Subject})
+		}
+		return append(f,
+			[2]string{"Timestamp", m.Timestamp},
+			[2]string{"TopicArn", m.TopicArn},
+			[2]string{"Type", m.Type},
+		), nil
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		return [][2]string{
+			{"Message", m.Message},
+			{"MessageId", m.MessageId},
+			{"SubscribeURL", m.SubscribeURL},
+			{"Timestamp", m.Timestamp},
+			{"Token", m.Token},
+			{"TopicArn", m.TopicArn},
+			{"Type", m.Type},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown sns message type: %q", m.Type)
+}
+
+// StringToSign is the canonical form of the message that SNS signs.
+func (m SNSMessage) StringToSign() (string, error) {
+	fields, err := m.signedFields()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, f := range fields {
+		fmt.Fprintf(&b, "%s\n%s\n", f[0], f[1])
+	}
+	return b.String(), nil
+}
+
+// SNSVerifier checks message signatures, caching signing certificates.
+type SNSVerifier struct {
+	Client *http.Client
+
+	lock  sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+func (v *SNSVerifier) cert(raw string) (*x509.Certificate, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if c, ok := v.certs[raw]; ok {
+		return c, nil
+	}
+	if err := checkSNSURL(raw); err != nil {
+		return nil, err
+	}
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Get(raw)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't fetch %s: %s", raw, resp.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate at %s", raw)
+	}
+	c, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if v.certs == nil {
+		v.certs = make(map[string]*x509.Certificate)
+	}
+	v.certs[raw] = c
+	return c, nil
+}
+
+// Verify checks the message's signature against its SNS certificate.
+func (v *SNSVerifier) Verify(m SNSMessage) error {
+	s, err := m.StringToSign()
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("bad signature encoding: %w", err)
+	}
+	c, err := v.cert(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := c.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unexpected signing key type %T", c.PublicKey)
+	}
+	switch m.SignatureVersion {
+	case "1":
+		h := sha1.Sum([]byte(s))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA1, h[:], sig)
+	case "2":
+		h := sha256.Sum256([]byte(s))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig)
+	}
+	return fmt.Errorf("unknown signature version: %q", m.SignatureVersion)
+}
+
+// ConfirmSubscription visits the SubscribeURL of a verified confirmation.
+func ConfirmSubscription(client *http.Client, m SNSMessage) error {
+	if err := checkSNSURL(m.SubscribeURL); err != nil {
+		return err
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Get(m.SubscribeURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("can't confirm subscription: %s", resp.Status)
+	}
+	return nil
+}
+
+// SESNotification is the Message of an SNS notification about email
+// sent through SES, whether from identity notifications or event
+// publishing.
+type SESNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Mail             struct {
+		MessageId   string   `json:"messageId"`
+		Timestamp   string   `json:"timestamp"`
+		Destination []string `json:"destination"`
+	} `json:"mail"`
+	Bounce *struct {
+		BounceType        string `json:"bounceType"`
+		BounceSubType     string `json:"bounceSubType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce,omitempty"`
+	Complaint *struct {
+		ComplainedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+	} `json:"complaint,omitempty"`
+	Delivery *struct {
+		Recipients []string `json:"recipients"`
+	} `json:"delivery,omitempty"`
+}
+
+// Kind is Bounce, Complaint, Delivery or the like.
+func (n SESNotification) Kind() string {
+	if n.NotificationType != "" {
+		return n.NotificationType
+	}
+	return n.EventType
+}
+
+func ParseSESNotification(message string) (*SESNotification, error) {
+	var n SESNotification
+	if err := json.Unmarshal([]byte(message), &n); err != nil {
+		return nil, fmt.Errorf("can't unmarshal ses notification: %w", err)
+	}
+	return &n, nil
+}
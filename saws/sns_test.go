@@ -0,0 +1,131 @@
+package saws_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xoba/sms/saws"
+	"github.com/xoba/sms/saws/snstest"
+)
+
+func fixtures(t *testing.T) map[string]*saws.SNSMessage {
+	t.Helper()
+	names, err := filepath.Glob("../testdata/sns/*.json")
+	if err != nil || len(names) == 0 {
+		t.Fatalf("no fixtures: %v", err)
+	}
+	out := make(map[string]*saws.SNSMessage)
+	for _, n := range names {
+		f, err := os.Open(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := saws.ParseSNSMessage(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", n, err)
+		}
+		out[filepath.Base(n)] = m
+	}
+	return out
+}
+
+func TestStringToSign(t *testing.T) {
+	m := saws.SNSMessage{
+		Type:      "Notification",
+		MessageId: "id",
+		TopicArn:  "arn",
+		Message:   "hello\nworld",
+		Timestamp: "2020-09-14T16:22:07.313Z",
+	}
+	want := "Message\nhello\nworld\nMessageId\nid\nTimestamp\n2020-09-14T16:22:07.313Z\nTopicArn\narn\nType\nNotification\n"
+	if got, err := m.StringToSign(); err != nil || got != want {
+		t.Fatalf("got %q, %v; want %q", got, err, want)
+	}
+	m.Subject = "subject"
+	want = "Message\nhello\nworld\nMessageId\nid\nSubject\nsubject\nTimestamp\n2020-09-14T16:22:07.313Z\nTopicArn\narn\nType\nNotification\n"
+	if got, err := m.StringToSign(); err != nil || got != want {
+		t.Fatalf("got %q, %v; want %q", got, err, want)
+	}
+	c := saws.SNSMessage{
+		Type:         "SubscriptionConfirmation",
+		MessageId:    "id",
+		Token:        "token",
+		TopicArn:     "arn",
+		Message:      "confirm",
+		SubscribeURL: "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription",
+		Timestamp:    "t",
+	}
+	want = "Message\nconfirm\nMessageId\nid\nSubscribeURL\nhttps://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription\nTimestamp\nt\nToken\ntoken\nTopicArn\narn\nType\nSubscriptionConfirmation\n"
+	if got, err := c.StringToSign(); err != nil || got != want {
+		t.Fatalf("got %q, %v; want %q", got, err, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	signer, err := snstest.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &saws.SNSVerifier{Client: signer.Client()}
+	for name, m := range fixtures(t) {
+		for _, version := range []string{"1", "2"} {
+			if err := signer.Sign(m, version); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.Verify(*m); err != nil {
+				t.Errorf("%s, version %s: %v", name, version, err)
+			}
+			altered := *m
+			altered.Message += " "
+			if err := v.Verify(altered); err == nil {
+				t.Errorf("%s, version %s: verified an altered message", name, version)
+			}
+		}
+	}
+	if signer.Fetches != 1 {
+		t.Errorf("fetched the certificate %d times, not once", signer.Fetches)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	signer, err := snstest.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := snstest.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &saws.SNSVerifier{Client: signer.Client()}
+	m := *fixtures(t)["bounce.json"]
+	if err := other.Sign(&m, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(m); err == nil {
+		t.Error("verified a message signed by another key")
+	}
+	for _, url := range []string{
+		"http://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem",
+		"https://sns.us-east-1.amazonaws.com.evil.com/cert.pem",
+		"https://evil.com/sns.us-east-1.amazonaws.com/cert.pem",
+	} {
+		m := *fixtures(t)["bounce.json"]
+		if err := signer.Sign(&m, "1"); err != nil {
+			t.Fatal(err)
+		}
+		m.SigningCertURL = url
+		if err := v.Verify(m); err == nil {
+			t.Errorf("fetched a certificate from %s", url)
+		}
+	}
+	m = *fixtures(t)["bounce.json"]
+	if err := signer.Sign(&m, "1"); err != nil {
+		t.Fatal(err)
+	}
+	m.SignatureVersion = "3"
+	if err := v.Verify(m); err == nil {
+		t.Error("verified an unknown signature version")
+	}
+}
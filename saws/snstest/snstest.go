@@ -0,0 +1,104 @@
+// Package snstest signs SNS messages with a self-signed certificate, and
+// serves the certificate in place of SNS, for tests.
+package snstest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/xoba/sms/saws"
+)
+
+// CertURL looks like an SNS signing certificate's url, and is served by
+// Signer.Client.
+const CertURL = "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem"
+
+// Signer signs messages as SNS would.
+type Signer struct {
+	key  *rsa.PrivateKey
+	cert []byte // pem
+
+	Fetches int32 // of the certificate
+}
+
+func NewSigner() (*Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return &Signer{key: key, cert: cert}, nil
+}
+
+// Sign signs the message with the given signature version, 1 or 2,
+// pointing it at CertURL.
+func (s *Signer) Sign(m *saws.SNSMessage, version string) error {
+	text, err := m.StringToSign()
+	if err != nil {
+		return err
+	}
+	var sig []byte
+	switch version {
+	case "1":
+		h := sha1.Sum([]byte(text))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, h[:])
+	case "2":
+		h := sha256.Sum256([]byte(text))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h[:])
+	default:
+		return fmt.Errorf("unknown signature version: %q", version)
+	}
+	if err != nil {
+		return err
+	}
+	m.SignatureVersion = version
+	m.Signature = base64.StdEncoding.EncodeToString(sig)
+	m.SigningCertURL = CertURL
+	return nil
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Client serves the certificate at CertURL, and nothing else.
+func (s *Signer) Client() *http.Client {
+	return &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+		if r.URL.String() != CertURL {
+			return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: http.NoBody, Request: r}, nil
+		}
+		atomic.AddInt32(&s.Fetches, 1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Body:       io.NopCloser(bytes.NewReader(s.cert)),
+			Request:    r,
+		}, nil
+	})}
+}
@@ -0,0 +1,240 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KMS wraps and unwraps data keys under a master key it never reveals,
+// like AWS KMS's Encrypt and Decrypt.
+type KMS interface {
+	// Encrypt returns the wrapped key and the id of the master key used.
+	Encrypt(ctx context.Context, plaintext []byte) (ciphertext []byte, keyID string, err error)
+	Decrypt(ctx context.Context, ciphertext []byte, keyID string) ([]byte, error)
+}
+
+// LocalKMS stands in for a KMS with a master key kept in a local file.
+type LocalKMS struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewKeyfile writes a new random master key to name, which mustn't exist.
+func NewKeyfile(name string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadKeyfile reads a master key written by NewKeyfile: 32 bytes, in hex.
+func LoadKeyfile(name string) (*LocalKMS, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("keyfile %s doesn't hold 32 bytes in hex", name)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	// the id names the key without revealing it
+	h := sha256.Sum256(key)
+	return &LocalKMS{id: "local:" + hex.EncodeToString(h[:8]), aead: aead}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *LocalKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return k.aead.Seal(nonce, nonce, plaintext, nil), k.id, nil
+}
+
+func (k *LocalKMS) Decrypt(ctx context.Context, ciphertext []byte, keyID string) ([]byte, error) {
+	if keyID != k.id {
+		return nil, fmt.Errorf("data key is wrapped by %s, not %s", keyID, k.id)
+	}
+	n := k.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("wrapped key is too short")
+	}
+	return k.aead.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+}
+
+// magic begins every encrypted object; nothing we store in the clear,
+// json or csv, starts with a zero byte.
+const magic = "\x00smsenc1"
+
+// ErrNoKey is returned for encrypted objects when there's no KMS to
+// unwrap their keys.
+var ErrNoKey = errors.New("object is encrypted, but no key was given")
+
+// IsEncrypted reports whether an object was written by Encrypted.
+func IsEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(magic))
+}
+
+// Encrypted seals every object it writes with a fresh AES-GCM data key,
+// itself wrapped by the KMS and stored alongside, and opens them again
+// when read. Objects still in the clear are read as they are, so a store
+// can be encrypted bit by bit. With a nil KMS, it writes in the clear.
+type Encrypted struct {
+	Store
+	KMS KMS
+}
+
+// the object's key is bound to its ciphertext, so objects can't be
+// swapped around
+func (e Encrypted) seal(ctx context.Context, key string, value []byte) ([]byte, error) {
+	if e.KMS == nil {
+		return value, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, keyID, err := e.KMS.Encrypt(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't wrap data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// magic, key id and wrapped key with 16-bit lengths, nonce, ciphertext
+	var b bytes.Buffer
+	b.WriteString(magic)
+	for _, x := range [][]byte{[]byte(keyID), wrapped} {
+		binary.Write(&b, binary.BigEndian, uint16(len(x)))
+		b.Write(x)
+	}
+	b.Write(nonce)
+	return aead.Seal(b.Bytes(), nonce, value, []byte(key)), nil
+}
+
+func (e Encrypted) open(ctx context.Context, key string, value []byte) ([]byte, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if e.KMS == nil {
+		return nil, fmt.Errorf("%s: %w", key, ErrNoKey)
+	}
+	r := bytes.NewReader(value[len(magic):])
+	var parts [2][]byte
+	for i := range parts {
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, fmt.Errorf("%s: bad envelope: %w", key, err)
+		}
+		parts[i] = make([]byte, n)
+		if _, err := io.ReadFull(r, parts[i]); err != nil {
+			return nil, fmt.Errorf("%s: bad envelope: %w", key, err)
+		}
+	}
+	dataKey, err := e.KMS.Decrypt(ctx, parts[1], string(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't unwrap data key: %w", key, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	rest := value[len(value)-r.Len():]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s: bad envelope", key)
+	}
+	out, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't decrypt: %w", key, err)
+	}
+	return out, nil
+}
+
+func (e Encrypted) Get(ctx context.Context, key string) ([]byte, error) {
+	buf, err := e.Store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(ctx, key, buf)
+}
+
+func (e Encrypted) Put(ctx context.Context, key string, value []byte) error {
+	buf, err := e.seal(ctx, key, value)
+	if err != nil {
+		return err
+	}
+	return e.Store.Put(ctx, key, buf)
+}
+
+func (e Encrypted) Create(ctx context.Context, key string, value []byte) error {
+	buf, err := e.seal(ctx, key, value)
+	if err != nil {
+		return err
+	}
+	return e.Store.Create(ctx, key, buf)
+}
+
+// EncryptAll rewrites the objects under prefix that are still in the
+// clear, returning how many it encrypted and how many already were.
+func (e Encrypted) EncryptAll(ctx context.Context, prefix string) (encrypted, skipped int, err error) {
+	if e.KMS == nil {
+		return 0, 0, errors.New("no key to encrypt with")
+	}
+	keys, err := e.Store.List(ctx, prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, k := range keys {
+		buf, err := e.Store.Get(ctx, k)
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted meanwhile, like a released lease
+		} else if err != nil {
+			return encrypted, skipped, err
+		}
+		if IsEncrypted(buf) {
+			skipped++
+			continue
+		}
+		if err := e.Put(ctx, k, buf); err != nil {
+			return encrypted, skipped, err
+		}
+		encrypted++
+	}
+	return encrypted, skipped, nil
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func testKMS(t *testing.T) (*LocalKMS, error) {
+	name := filepath.Join(t.TempDir(), "key.txt")
+	if err := NewKeyfile(name); err != nil {
+		return nil, err
+	}
+	return LoadKeyfile(name)
+}
+
+func TestEncrypted(t *testing.T) {
+	ctx := context.Background()
+	dir := newTestDir(t)
+	kms, err := testKMS(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Encrypted{Store: dir, KMS: kms}
+	secret := []byte("Jane Doe,+12125550123,jane@example.com")
+	if err := e.Put(ctx, "patients.csv", secret); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := dir.Get(ctx, "patients.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(raw) || bytes.Contains(raw, []byte("Jane")) {
+		t.Fatal("stored in the clear")
+	}
+	if buf, err := e.Get(ctx, "patients.csv"); err != nil || !bytes.Equal(buf, secret) {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	// objects can't be read without the key, nor with another
+	if _, err := (Encrypted{Store: dir}).Get(ctx, "patients.csv"); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("got %v without a key", err)
+	}
+	other, err := testKMS(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (Encrypted{Store: dir, KMS: other}).Get(ctx, "patients.csv"); err == nil {
+		t.Fatal("read with the wrong key")
+	}
+
+	// nor moved to another key
+	if err := dir.Put(ctx, "moved.csv", raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Get(ctx, "moved.csv"); err == nil {
+		t.Fatal("read an object moved to another key")
+	}
+
+	// nor altered
+	raw[len(raw)-1] ^= 1
+	if err := dir.Put(ctx, "patients.csv", raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Get(ctx, "patients.csv"); err == nil {
+		t.Fatal("read an altered object")
+	}
+}
+
+func TestEncryptAll(t *testing.T) {
+	ctx := context.Background()
+	dir := newTestDir(t)
+	kms, err := testKMS(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a/1", "a/2", "b/1"} {
+		if err := dir.Put(ctx, k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := Encrypted{Store: dir, KMS: kms}
+	if buf, err := e.Get(ctx, "a/1"); err != nil || string(buf) != "a/1" {
+		t.Fatalf("got %q, %v reading in the clear", buf, err)
+	}
+	if n, skipped, err := e.EncryptAll(ctx, "a/"); err != nil || n != 2 || skipped != 0 {
+		t.Fatalf("encrypted %d, skipped %d, %v", n, skipped, err)
+	}
+	if n, skipped, err := e.EncryptAll(ctx, ""); err != nil || n != 1 || skipped != 2 {
+		t.Fatalf("encrypted %d, skipped %d, %v", n, skipped, err)
+	}
+	for _, k := range []string{"a/1", "a/2", "b/1"} {
+		if buf, err := e.Get(ctx, k); err != nil || string(buf) != k {
+			t.Fatalf("got %q, %v for %s", buf, err, k)
+		}
+	}
+}
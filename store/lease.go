@@ -0,0 +1,221 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClaimed means somebody else holds an unexpired claim.
+var ErrClaimed = errors.New("claimed by another runner")
+
+// Owner identifies this process in claims.
+func Owner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// Lease is a claim on a key with an expiry. Claims are stored as
+// generations under "<key>/claims/"; taking over an expired claim means
+// creating the next generation, so only one runner can win it.
+type Lease struct {
+	Key     string
+	Owner   string
+	Token   string
+	Gen     int
+	Expires time.Time
+
+	s Store
+}
+
+func (l Lease) String() string {
+	buf, _ := json.Marshal(l)
+	return string(buf)
+}
+
+func claimKey(key string, gen int) string {
+	return path.Join(key, "claims", fmt.Sprintf("%08d", gen))
+}
+
+func newToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", buf)
+}
+
+// latest returns the highest claim generation for key, if any.
+func latest(ctx context.Context, s Store, key string) (*Lease, error) {
+	keys, err := s.List(ctx, path.Join(key, "claims")+"/")
+	if err != nil {
+		return nil, err
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		gen, err := strconv.Atoi(path.Base(keys[i]))
+		if err != nil {
+			continue
+		}
+		buf, err := s.Get(ctx, keys[i])
+		if errors.Is(err, ErrNotFound) {
+			continue // released underneath us
+		} else if err != nil {
+			return nil, err
+		}
+		var l Lease
+		if err := json.Unmarshal(buf, &l); err != nil {
+			return nil, fmt.Errorf("can't unmarshal claim %s: %w", keys[i], err)
+		}
+		l.Gen = gen
+		l.s = s
+		return &l, nil
+	}
+	return nil, nil
+}
+
+// Claim takes a lease on key for ttl, failing with ErrClaimed if another
+// owner holds an unexpired one.
+func Claim(ctx context.Context, s Store, key, owner string, ttl time.Duration) (*Lease, error) {
+	current, err := latest(ctx, s, key)
+	if err != nil {
+		return nil, err
+	}
+	gen := 1
+	if current != nil {
+		if current.Owner != owner && time.Now().Before(current.Expires) {
+			return nil, ErrClaimed
+		}
+		gen = current.Gen + 1
+	}
+	l := &Lease{
+		Key:     key,
+		Owner:   owner,
+		Token:   newToken(),
+		Gen:     gen,
+		Expires: time.Now().Add(ttl),
+		s:       s,
+	}
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	// Create is atomic in every store, so only one runner gets each
+	// generation
+	if err := s.Create(ctx, claimKey(key, gen), buf); errors.Is(err, ErrExists) {
+		return nil, ErrClaimed
+	} else if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+var awaits atomic.Int64
+
+// Await claims key like Claim, but waits up to wait for others to finish
+// with it, and as a new owner each time: an owner can always reclaim its
+// own claim, so claims by one owner don't exclude each other. It's for
+// brief exclusive updates, from any goroutine of any process.
+func Await(ctx context.Context, s Store, key string, ttl, wait time.Duration) (*Lease, error) {
+	owner := fmt.Sprintf("%s/%d", Owner(), awaits.Add(1))
+	deadline := time.Now().Add(wait)
+	for {
+		l, err := Claim(ctx, s, key, owner, ttl)
+		if !errors.Is(err, ErrClaimed) || time.Now().After(deadline) {
+			return l, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Renew extends the lease, failing with ErrClaimed if it was lost.
+func (l *Lease) Renew(ctx context.Context, ttl time.Duration) error {
+	current, err := latest(ctx, l.s, l.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Token != l.Token {
+		return ErrClaimed
+	}
+	l.Expires = time.Now().Add(ttl)
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return l.s.Put(ctx, claimKey(l.Key, l.Gen), buf)
+}
+
+// Release deletes every claim generation up to ours, oldest first, so
+// that the key reads as claimed until the last one is gone.
+func (l *Lease) Release(ctx context.Context) error {
+	for gen := 1; gen <= l.Gen; gen++ {
+		if err := l.s.Delete(ctx, claimKey(l.Key, gen)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lock is a lease that renews itself in the background until unlocked.
+type Lock struct {
+	lease *Lease
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewLock claims key and keeps the claim alive until Unlock, even after
+// ctx is done, so that a run can finish its work in flight.
+func NewLock(ctx context.Context, s Store, key, owner string, ttl time.Duration) (*Lock, error) {
+	lease, err := Claim(ctx, s, key, owner, ttl)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lock{lease: lease, done: make(chan struct{})}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-t.C:
+				if err := lease.Renew(context.Background(), ttl); err != nil {
+					l.mu.Lock()
+					l.err = err
+					l.mu.Unlock()
+					return
+				}
+			}
+		}
+	}()
+	return l, nil
+}
+
+// Err returns non-nil once the lock could not be renewed.
+func (l *Lock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *Lock) Unlock() error {
+	close(l.done)
+	l.wg.Wait()
+	return l.lease.Release(context.Background())
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClaim(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, err := Claim(ctx, s, "k", "a", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Claim(ctx, s, "k", "b", time.Minute); !errors.Is(err, ErrClaimed) {
+				t.Fatalf("got %v claiming a held lease", err)
+			}
+			if err := a.Renew(ctx, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Release(ctx); err != nil {
+				t.Fatal(err)
+			}
+			b, err := Claim(ctx, s, "k", "b", time.Minute)
+			if err != nil {
+				t.Fatalf("can't claim a released lease: %v", err)
+			}
+			if err := b.Release(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestClaimExpired(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, err := Claim(ctx, s, "k", "a", -time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := Claim(ctx, s, "k", "b", time.Minute)
+			if err != nil {
+				t.Fatalf("can't take over an expired lease: %v", err)
+			}
+			if b.Gen != a.Gen+1 {
+				t.Fatalf("took over with generation %d after %d", b.Gen, a.Gen)
+			}
+			if err := a.Renew(ctx, time.Minute); !errors.Is(err, ErrClaimed) {
+				t.Fatalf("got %v renewing a lease taken over", err)
+			}
+		})
+	}
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	s := stores(t)["dir"]
+	l, err := NewLock(ctx, s, "lock", "a", 30*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// outlive the ttl a few times over, so only renewal keeps it
+	time.Sleep(100 * time.Millisecond)
+	if _, err := Claim(ctx, s, "lock", "b", time.Minute); !errors.Is(err, ErrClaimed) {
+		t.Fatalf("got %v claiming a renewed lock", err)
+	}
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Claim(ctx, s, "lock", "b", time.Minute); err != nil {
+		t.Fatalf("can't claim an unlocked lock: %v", err)
+	}
+}
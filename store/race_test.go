@@ -0,0 +1,114 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xoba/sms/store/s3test"
+)
+
+// TestMain doubles as the contender in TestProcessRace, when run with
+// STORE_CONTENDER set.
+func TestMain(m *testing.M) {
+	if spec := os.Getenv("STORE_CONTENDER"); spec != "" {
+		if err := contend(spec, os.Getenv("STORE_START")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// contend waits for the agreed start, then tries to create a key and
+// claim a lease, printing which it won.
+func contend(spec, start string) error {
+	var s Store
+	var err error
+	if url, ok := strings.CutPrefix(spec, "s3:"); ok {
+		s, err = dialS3(url, "test")
+	} else {
+		s, err = NewDir(strings.TrimPrefix(spec, "dir:"))
+	}
+	if err != nil {
+		return err
+	}
+	ns, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Until(time.Unix(0, ns)))
+	ctx := context.Background()
+	created := "won"
+	if err := s.Create(ctx, "race/created", []byte(Owner())); errors.Is(err, ErrExists) {
+		created = "lost"
+	} else if err != nil {
+		return err
+	}
+	claimed := "won"
+	if _, err := Claim(ctx, s, "race/lease", Owner(), time.Minute); errors.Is(err, ErrClaimed) {
+		claimed = "lost"
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("create %s\nclaim %s\n", created, claimed)
+	return nil
+}
+
+// TestProcessRace races separate processes to create the same key and
+// claim the same lease; exactly one must win each.
+func TestProcessRace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts processes")
+	}
+	srv := httptest.NewServer(s3test.New("test"))
+	defer srv.Close()
+	for name, spec := range map[string]string{
+		"dir": "dir:" + t.TempDir(),
+		"s3":  "s3:" + srv.URL,
+	} {
+		t.Run(name, func(t *testing.T) {
+			const n = 8
+			start := strconv.FormatInt(time.Now().Add(time.Second).UnixNano(), 10)
+			cmds := make([]*exec.Cmd, n)
+			outs := make([]*bytes.Buffer, n)
+			for i := range cmds {
+				cmds[i] = exec.Command(os.Args[0], "-test.run=^$")
+				cmds[i].Env = append(os.Environ(), "STORE_CONTENDER="+spec, "STORE_START="+start)
+				outs[i] = new(bytes.Buffer)
+				cmds[i].Stdout = outs[i]
+				cmds[i].Stderr = os.Stderr
+				if err := cmds[i].Start(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wins := make(map[string]int)
+			for i, cmd := range cmds {
+				if err := cmd.Wait(); err != nil {
+					t.Fatalf("contender %d: %v", i, err)
+				}
+				sc := bufio.NewScanner(outs[i])
+				for sc.Scan() {
+					if what, ok := strings.CutSuffix(sc.Text(), " won"); ok {
+						wins[what]++
+					}
+				}
+			}
+			for _, what := range []string{"create", "claim"} {
+				if wins[what] != 1 {
+					t.Errorf("%d of %d processes won the %s", wins[what], n, what)
+				}
+			}
+		})
+	}
+}
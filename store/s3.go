@@ -0,0 +1,120 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const Bucket = "drjin"
+
+type S3 struct {
+	svc    *s3.S3
+	bucket string
+}
+
+func NewS3(svc *s3.S3, bucket string) *S3 {
+	return &S3{svc: svc, bucket: bucket}
+}
+
+func notFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if notFound(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3) Put(ctx context.Context, key string, value []byte) error {
+	_, err := s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(value),
+	})
+	return err
+}
+
+// Create writes with If-None-Match: *, so that S3 itself refuses to
+// overwrite an existing key, even one written a moment before by another
+// runner.
+func (s *S3) Create(ctx context.Context, key string, value []byte) error {
+	for tries := 0; ; tries++ {
+		req, _ := s.svc.PutObjectRequest(&s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(value),
+		})
+		req.SetContext(ctx)
+		// this version of the sdk has no field for the header
+		req.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		})
+		err := req.Send()
+		var rf awserr.RequestFailure
+		if !errors.As(err, &rf) {
+			return err
+		}
+		switch rf.StatusCode() {
+		case http.StatusPreconditionFailed:
+			return ErrExists
+		case http.StatusConflict:
+			// a concurrent conditional write to the same key is in flight;
+			// retrying tells us which of them won
+			if tries < 5 {
+				time.Sleep(time.Duration(tries+1) * 50 * time.Millisecond)
+				continue
+			}
+		}
+		return err
+	}
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var out []string
+	f := func(x *s3.ListObjectsV2Output, b bool) bool {
+		for _, o := range x.Contents {
+			out = append(out, *o.Key)
+		}
+		return true
+	}
+	i := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+	if err := s.svc.ListObjectsV2PagesWithContext(ctx, i, f); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,138 @@
+// Package s3test fakes the parts of S3 the store uses, for tests.
+package s3test
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Fake serves the few S3 calls the store makes, for one bucket, with
+// path-style urls. Conditional puts are atomic, as they are in S3.
+type Fake struct {
+	bucket string
+	page   int // keys per list page
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// New returns an empty bucket.
+func New(bucket string) *Fake {
+	return &Fake{bucket: bucket, page: 2, objects: make(map[string][]byte)}
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket)
+	if !ok {
+		writeXML(w, http.StatusNotFound, s3Error{Code: "NoSuchBucket"})
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		buf, ok := f.objects[key]
+		if !ok {
+			writeXML(w, http.StatusNotFound, s3Error{Code: "NoSuchKey", Message: key})
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+		if r.Method == http.MethodGet {
+			w.Write(buf)
+		}
+	case r.Method == http.MethodPut:
+		buf, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeXML(w, http.StatusBadRequest, s3Error{Code: "IncompleteBody"})
+			return
+		}
+		if _, exists := f.objects[key]; exists && r.Header.Get("If-None-Match") == "*" {
+			writeXML(w, http.StatusPreconditionFailed, s3Error{Code: "PreconditionFailed", Message: key})
+			return
+		}
+		f.objects[key] = buf
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeXML(w, http.StatusMethodNotAllowed, s3Error{Code: "MethodNotAllowed"})
+	}
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []struct{ Key string }
+}
+
+// list pages through keys in order, the token being the index of the
+// next page
+func (f *Fake) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(q.Get("continuation-token"))
+	end := start + f.page
+	if end > len(keys) {
+		end = len(keys)
+	}
+	out := listResult{Name: f.bucket, Prefix: prefix, KeyCount: end - start}
+	for _, k := range keys[start:end] {
+		out.Contents = append(out.Contents, struct{ Key string }{k})
+	}
+	if end < len(keys) {
+		out.IsTruncated = true
+		out.NextContinuationToken = strconv.Itoa(end)
+	}
+	writeXML(w, http.StatusOK, out)
+}
+
+// Client returns an S3 client for a fake served at url.
+func Client(url string) (*s3.S3, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(url),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+)
+
+// Store is a flat namespace of objects with "/"-separated keys, like the
+// drjin bucket, holding contacts, credentials and receipts.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+	// Create is like Put, but fails with ErrExists if key is present,
+	// atomically, even between processes.
+	Create(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+	// List returns every key beginning with prefix, in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Open returns the drjin bucket for an empty spec, otherwise a local
+// directory store rooted at spec.
+func Open(spec string, newS3 func() (*S3, error)) (Store, error) {
+	if spec == "" {
+		return newS3()
+	}
+	return NewDir(strings.TrimPrefix(spec, "dir:"))
+}
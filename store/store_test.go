@@ -0,0 +1,153 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/xoba/sms/store/s3test"
+)
+
+func newTestDir(t *testing.T) *Dir {
+	t.Helper()
+	d, err := NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// stores returns one of each kind of store, all empty.
+func stores(t *testing.T) map[string]Store {
+	kms, err := testKMS(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{
+		"dir":           newTestDir(t),
+		"s3":            newTestS3(t),
+		"encrypted dir": Encrypted{Store: newTestDir(t), KMS: kms},
+		"encrypted s3":  Encrypted{Store: newTestS3(t), KMS: kms},
+	}
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.Get(ctx, "a/x"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("got %v for a missing key", err)
+			}
+			for _, k := range []string{"b/2", "a/x", "b/1", "b/3", "c"} {
+				if err := s.Put(ctx, k, []byte(k)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Put(ctx, "a/x", []byte("again")); err != nil {
+				t.Fatal(err)
+			}
+			if buf, err := s.Get(ctx, "a/x"); err != nil || string(buf) != "again" {
+				t.Fatalf("got %q, %v", buf, err)
+			}
+			keys, err := s.List(ctx, "b/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"b/1", "b/2", "b/3"}; !reflect.DeepEqual(keys, want) {
+				t.Fatalf("listed %q, want %q", keys, want)
+			}
+			if err := s.Create(ctx, "b/1", []byte("x")); !errors.Is(err, ErrExists) {
+				t.Fatalf("got %v creating an existing key", err)
+			}
+			if err := s.Create(ctx, "b/4", []byte("4")); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(ctx, "b/1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(ctx, "b/1"); err != nil {
+				t.Fatalf("deleting a missing key: %v", err)
+			}
+			if _, err := s.Get(ctx, "b/1"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("got %v for a deleted key", err)
+			}
+		})
+	}
+}
+
+func TestCreateRace(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			errs := make([]error, 20)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = s.Create(ctx, "race", []byte(fmt.Sprint(i)))
+				}(i)
+			}
+			wg.Wait()
+			var won []int
+			for i, err := range errs {
+				switch {
+				case err == nil:
+					won = append(won, i)
+				case !errors.Is(err, ErrExists):
+					t.Fatal(err)
+				}
+			}
+			if len(won) != 1 {
+				t.Fatalf("%d creates won: %v", len(won), won)
+			}
+			buf, err := s.Get(ctx, "race")
+			if err != nil || !bytes.Equal(buf, []byte(fmt.Sprint(won[0]))) {
+				t.Fatalf("got %q, %v; want the winner's value", buf, err)
+			}
+		})
+	}
+}
+
+func TestDirKeys(t *testing.T) {
+	d := newTestDir(t)
+	ctx := context.Background()
+	for _, k := range []string{"", "/etc/passwd", "../x", "a/../../x"} {
+		if err := d.Put(ctx, k, nil); err == nil {
+			t.Errorf("wrote illegal key %q", k)
+		}
+	}
+	if err := d.Put(ctx, "a/b/c", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := d.List(ctx, ""); err != nil || len(keys) != 0 {
+		t.Fatalf("listed %q, %v after deleting everything", keys, err)
+	}
+}
+
+func dialS3(url, bucket string) (*S3, error) {
+	c, err := s3test.Client(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewS3(c, bucket), nil
+}
+
+func newTestS3(t *testing.T) *S3 {
+	t.Helper()
+	srv := httptest.NewServer(s3test.New("test"))
+	t.Cleanup(srv.Close)
+	s, err := dialS3(srv.URL, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
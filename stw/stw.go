@@ -1,13 +1,15 @@
 package stw
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"net/url"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/kevinburke/twilio-go"
+	"github.com/xoba/sms/store"
 )
 
 type Credentials struct {
@@ -20,18 +22,13 @@ func (c Credentials) String() string {
 	return string(buf)
 }
 
-func LoadCredentials(svc *s3.S3) (*Credentials, error) {
-	resp, err := svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String("drjin"),
-		Key:    aws.String("twilio.json"),
-	})
+func LoadCredentials(ctx context.Context, s store.Store) (*Credentials, error) {
+	buf, err := s.Get(ctx, "twilio.json")
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	d := json.NewDecoder(resp.Body)
 	var c Credentials
-	if err := d.Decode(&c); err != nil {
+	if err := json.Unmarshal(buf, &c); err != nil {
 		return nil, err
 	}
 	return &c, nil
@@ -49,6 +46,97 @@ func MakeCall(client *twilio.Client, from, to, twimlURL string) (*twilio.Call, e
 	return client.Calls.MakeCall(from, to, u)
 }
 
+type say struct {
+	XMLName  xml.Name `xml:"Say"`
+	Voice    string   `xml:"voice,attr"`
+	Language string   `xml:"language,attr,omitempty"`
+	Text     string   `xml:",chardata"`
+}
+
+type pause struct {
+	XMLName xml.Name `xml:"Pause"`
+	Length  int      `xml:"length,attr"`
+}
+
+// Say calls to speak text twice, for whoever picks up late, with one of
+// twilio's text-to-speech voices in the given locale, like "es-US".
+func Say(client *twilio.Client, from, to, voice, locale, text string) (*twilio.Call, error) {
+	s := say{Voice: voice, Language: locale, Text: text}
+	buf, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Response"`
+		Verbs   []interface{}
+	}{Verbs: []interface{}{s, pause{Length: 2}, s}})
+	if err != nil {
+		return nil, err
+	}
+	return client.Calls.Create(context.Background(), url.Values{
+		"From":  []string{from},
+		"To":    []string{to},
+		"Twiml": []string{string(buf)},
+	})
+}
+
 func SendSMS(client *twilio.Client, from, to, message string) (*twilio.Message, error) {
 	return client.Messages.SendMessage(from, to, message, nil)
 }
+
+// GetMessage fetches a message as twilio has it now, like with its price
+// once known.
+func GetMessage(client *twilio.Client, sid string) (*twilio.Message, error) {
+	return client.Messages.Get(context.Background(), sid)
+}
+
+// GetCall fetches a call as twilio has it now.
+func GetCall(client *twilio.Client, sid string) (*twilio.Call, error) {
+	return client.Calls.Get(context.Background(), sid)
+}
+
+// FindMessages lists messages sent from one number to another since the
+// given day, with an empty from or to matching any number.
+func FindMessages(client *twilio.Client, from, to string, since time.Time) ([]*twilio.Message, error) {
+	v := url.Values{
+		"DateSent>": []string{since.UTC().Format("2006-01-02")},
+	}
+	if from != "" {
+		v.Set("From", from)
+	}
+	if to != "" {
+		v.Set("To", to)
+	}
+	var out []*twilio.Message
+	iter := client.Messages.GetPageIterator(v)
+	for {
+		page, err := iter.Next(context.Background())
+		if err == twilio.NoMoreResults {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, page.Messages...)
+	}
+}
+
+// FindCalls lists calls made from one number to another since the given
+// day, with an empty from or to matching any number.
+func FindCalls(client *twilio.Client, from, to string, since time.Time) ([]*twilio.Call, error) {
+	v := url.Values{
+		"StartTime>": []string{since.UTC().Format("2006-01-02")},
+	}
+	if from != "" {
+		v.Set("From", from)
+	}
+	if to != "" {
+		v.Set("To", to)
+	}
+	var out []*twilio.Call
+	iter := client.Calls.GetPageIterator(v)
+	for {
+		page, err := iter.Next(context.Background())
+		if err == twilio.NoMoreResults {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, page.Calls...)
+	}
+}
@@ -0,0 +1,68 @@
+package stw
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kevinburke/twilio-go"
+)
+
+// pager serves a twilio list resource in pages of one, keeping the query
+// of each request.
+func pager(t *testing.T, field string, sids []string, queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*queries = append(*queries, r.URL.RawQuery)
+		page, _ := strconv.Atoi(r.URL.Query().Get("Page"))
+		out := map[string]interface{}{
+			field: []map[string]string{{"sid": sids[page]}},
+		}
+		if page+1 < len(sids) {
+			out["next_page_uri"] = fmt.Sprintf("%s?Page=%d", r.URL.Path, page+1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func testClient(url string) *twilio.Client {
+	c := twilio.NewClient("AC123", "token", nil)
+	c.Base = url
+	return c
+}
+
+func TestFindCallsPages(t *testing.T) {
+	var queries []string
+	srv := pager(t, "calls", []string{"CA1", "CA2", "CA3"}, &queries)
+	defer srv.Close()
+	since := time.Date(2022, 12, 1, 15, 0, 0, 0, time.UTC)
+	calls, err := FindCalls(testClient(srv.URL), "+12125550100", "", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 3 || calls[2].Sid != "CA3" {
+		t.Fatalf("got %d calls, want all 3 pages", len(calls))
+	}
+	if want := "From=%2B12125550100&StartTime%3E=2022-12-01"; queries[0] != want {
+		t.Fatalf("queried %q, want %q", queries[0], want)
+	}
+}
+
+func TestFindMessagesPages(t *testing.T) {
+	var queries []string
+	srv := pager(t, "messages", []string{"SM1", "SM2"}, &queries)
+	defer srv.Close()
+	messages, err := FindMessages(testClient(srv.URL), "", "+12125550100", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want both pages", len(messages))
+	}
+}
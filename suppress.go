@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xoba/sms/jin"
+)
+
+// Suppress manages the suppression list:
+//
+//	-m suppress list
+//	-m suppress add <phone|email|patient> <value> [reason...]
+//	-m suppress remove <phone|email|patient> <value>
+//	-m suppress sync
+//
+// where sync adds everyone who replied STOP by sms within -since. Ingesting
+// replies and the daemon do the same as they go.
+func Suppress(ctx context.Context, c Config) error {
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("suppress needs a command: list, add, remove, or sync")
+	}
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "list":
+		list, err := jin.LoadSuppressions(ctx, s)
+		if err != nil {
+			return err
+		}
+		for _, x := range list {
+			fmt.Printf("%-8s %-30s %s %q\n", x.Kind, c.pii(x.Value), x.Time.Format(time.RFC3339), c.piiText(x.Reason))
+		}
+		fmt.Printf("%d suppressions\n", len(list))
+	case "add":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: add <phone|email|patient> <value> [reason...]")
+		}
+		x, err := jin.NewSuppression(jin.SuppressionKind(args[0]), args[1], strings.Join(args[2:], " "))
+		if err != nil {
+			return err
+		}
+		if err := jin.AddSuppression(ctx, s, *x); err != nil {
+			return err
+		}
+		fmt.Printf("added %s %s\n", x.Kind, c.pii(x.Value))
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: remove <phone|email|patient> <value>")
+		}
+		if err := jin.RemoveSuppression(ctx, s, jin.SuppressionKind(args[0]), args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("removed %s %s\n", args[0], c.pii(args[1]))
+	case "sync":
+		provider, err := c.Provider(ctx, s)
+		if err != nil {
+			return err
+		}
+		replies, err := provider.Inbound(time.Now().Add(-c.Since))
+		if err != nil {
+			return err
+		}
+		stops, err := jin.SuppressStops(ctx, s, replies)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d stop replies among %d\n", stops, len(replies))
+	default:
+		return fmt.Errorf("illegal suppress command: %q", cmd)
+	}
+	return nil
+}
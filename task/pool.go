@@ -0,0 +1,209 @@
+package task
+
+import (
+	"context"
+	"runtime/debug"
+	"sort"
+	"sync"
+)
+
+// Pool applies Func to a stream of inputs on a fixed number of workers.
+type Pool[In, Out any] struct {
+	Func    func(ctx context.Context, in In) (Out, error)
+	Threads int
+	// QueueSize bounds the inputs accepted but not yet started.
+	QueueSize int
+	// Ordered emits outputs in input order, rather than as they finish.
+	Ordered bool
+	// Key, if set, serializes inputs with the same key: they never run
+	// concurrently, and run in input order.
+	Key func(in In) string
+}
+
+// Output is the result of Func on the input with the given index.
+type Output[In, Out any] struct {
+	Index int
+	In    In
+	Out   Out
+	Err   error
+}
+
+type job[In any] struct {
+	index int
+	in    In
+	key   string
+}
+
+func (p Pool[In, Out]) run(ctx context.Context, j job[In]) (out Output[In, Out]) {
+	out = Output[In, Out]{Index: j.index, In: j.in}
+	if err := ctx.Err(); err != nil {
+		out.Err = err
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			out.Err = PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	out.Out, out.Err = p.Func(ctx, j.in)
+	return
+}
+
+// Stream processes inputs until the channel is closed, then closes the
+// returned channel once every output has been delivered. Once ctx is
+// done, no more inputs are read, and queued ones fail with its error.
+// The caller must drain the returned channel.
+func (p Pool[In, Out]) Stream(ctx context.Context, inputs <-chan In) <-chan Output[In, Out] {
+	threads := p.Threads
+	if threads < 1 {
+		threads = 1
+	}
+	queue := p.QueueSize
+	if queue < 1 {
+		queue = threads
+	}
+	work := make(chan job[In])
+	finished := make(chan string)
+	results := make(chan Output[In, Out])
+
+	// the dispatcher never blocks on anything but its select, so workers
+	// can always report back
+	go func() {
+		defer close(work)
+		var ready []job[In]
+		waiting := make(map[string][]job[In])
+		active := make(map[string]bool)
+		var held, inflight, index int
+		in, cancelled := inputs, ctx.Done()
+		enqueue := func(j job[In]) {
+			if p.Key != nil {
+				active[j.key] = true
+			}
+			ready = append(ready, j)
+		}
+		for in != nil || len(ready) > 0 || inflight > 0 {
+			accept := in
+			if len(ready)+held >= queue {
+				accept = nil
+			}
+			var send chan<- job[In]
+			var next job[In]
+			if len(ready) > 0 {
+				send, next = work, ready[0]
+			}
+			select {
+			case x, ok := <-accept:
+				if !ok {
+					in = nil
+					continue
+				}
+				j := job[In]{index: index, in: x}
+				index++
+				if p.Key != nil {
+					j.key = p.Key(x)
+					if active[j.key] {
+						waiting[j.key] = append(waiting[j.key], j)
+						held++
+						continue
+					}
+				}
+				enqueue(j)
+			case send <- next:
+				ready = ready[1:]
+				inflight++
+			case key := <-finished:
+				inflight--
+				delete(active, key)
+				if list := waiting[key]; len(list) > 0 {
+					if len(list) == 1 {
+						delete(waiting, key)
+					} else {
+						waiting[key] = list[1:]
+					}
+					held--
+					enqueue(list[0])
+				}
+			case <-cancelled:
+				in, cancelled = nil, nil
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				results <- p.run(ctx, j)
+				finished <- j.key
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	if !p.Ordered {
+		return results
+	}
+	out := make(chan Output[In, Out])
+	go func() {
+		defer close(out)
+		pending := make(map[int]Output[In, Out])
+		var next int
+		for r := range results {
+			pending[r.Index] = r
+			for {
+				r, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				out <- r
+				next++
+			}
+		}
+		// every accepted input has an output, but deliver any left after
+		// a gap rather than drop them
+		var rest []int
+		for i := range pending {
+			rest = append(rest, i)
+		}
+		sort.Ints(rest)
+		for _, i := range rest {
+			out <- pending[i]
+		}
+	}()
+	return out
+}
+
+// Map runs the pool over a slice, returning one output per input in
+// input order. Inputs not started by the time ctx is done fail with its
+// error, and a panic fails only the input that caused it.
+func (p Pool[In, Out]) Map(ctx context.Context, inputs []In) []Output[In, Out] {
+	ch := make(chan In)
+	go func() {
+		defer close(ch)
+		for _, in := range inputs {
+			select {
+			case ch <- in:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	out := make([]Output[In, Out], len(inputs))
+	seen := make([]bool, len(inputs))
+	for r := range p.Stream(ctx, ch) {
+		out[r.Index] = r
+		seen[r.Index] = true
+	}
+	for i, ok := range seen {
+		if !ok {
+			out[i] = Output[In, Out]{Index: i, In: inputs[i], Err: ctx.Err()}
+		}
+	}
+	return out
+}
@@ -0,0 +1,276 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMap(t *testing.T) {
+	var active, most int32
+	p := Pool[int, int]{
+		Threads: 4,
+		Func: func(ctx context.Context, n int) (int, error) {
+			a := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if a <= m || atomic.CompareAndSwapInt32(&most, m, a) {
+					break
+				}
+			}
+			// finish out of order
+			time.Sleep(time.Duration(n%3) * time.Millisecond)
+			if n == 7 {
+				return 0, errors.New("seven")
+			}
+			return n * n, nil
+		},
+	}
+	var inputs []int
+	for i := 0; i < 50; i++ {
+		inputs = append(inputs, i)
+	}
+	out := p.Map(context.Background(), inputs)
+	if len(out) != len(inputs) {
+		t.Fatalf("got %d outputs for %d inputs", len(out), len(inputs))
+	}
+	for i, o := range out {
+		if o.Index != i || o.In != i {
+			t.Fatalf("output %d is for input %d", i, o.Index)
+		}
+		switch {
+		case i == 7 && o.Err == nil:
+			t.Fatal("lost an error")
+		case i != 7 && (o.Err != nil || o.Out != i*i):
+			t.Fatalf("got %d, %v for %d", o.Out, o.Err, i)
+		}
+	}
+	if most > 4 {
+		t.Fatalf("%d ran at once on 4 threads", most)
+	}
+}
+
+func TestMapPanic(t *testing.T) {
+	p := Pool[int, int]{
+		Threads: 2,
+		Func: func(ctx context.Context, n int) (int, error) {
+			if n == 1 {
+				panic("boom")
+			}
+			return n, nil
+		},
+	}
+	out := p.Map(context.Background(), []int{0, 1, 2})
+	var pe PanicError
+	if !errors.As(out[1].Err, &pe) || pe.Value != "boom" {
+		t.Fatalf("got %v, want the panic", out[1].Err)
+	}
+	if out[0].Err != nil || out[2].Err != nil {
+		t.Fatalf("a panic failed other inputs: %v, %v", out[0].Err, out[2].Err)
+	}
+}
+
+// Cancelling part way must still account for every input, in order,
+// whether it finished, was cut short or never started.
+func TestMapCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var ran int32
+	p := Pool[int, int]{
+		Threads: 3,
+		Func: func(ctx context.Context, n int) (int, error) {
+			if atomic.AddInt32(&ran, 1) == 10 {
+				cancel()
+			}
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(time.Millisecond):
+				return n, nil
+			}
+		},
+	}
+	inputs := make([]int, 1000)
+	for i := range inputs {
+		inputs[i] = i
+	}
+	out := p.Map(ctx, inputs)
+	var finished, cancelled int
+	for i, o := range out {
+		if o.Index != i || o.In != i {
+			t.Fatalf("output %d is for input %d", i, o.Index)
+		}
+		switch {
+		case o.Err == nil && o.Out == i:
+			finished++
+		case errors.Is(o.Err, context.Canceled):
+			cancelled++
+		default:
+			t.Fatalf("got %d, %v for %d", o.Out, o.Err, i)
+		}
+	}
+	if finished == 0 || cancelled < len(inputs)-20 {
+		t.Fatalf("%d finished and %d cancelled", finished, cancelled)
+	}
+}
+
+func feed(inputs ...int) <-chan int {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		for _, in := range inputs {
+			ch <- in
+		}
+	}()
+	return ch
+}
+
+// Inputs with the same key never run at once, and run in input order,
+// while other keys carry on alongside.
+func TestKey(t *testing.T) {
+	const keys = 3
+	var running [keys]int32
+	var most int32
+	var mu sync.Mutex
+	order := make(map[int][]int)
+	p := Pool[int, int]{
+		Threads: 8,
+		Key:     func(n int) string { return strconv.Itoa(n % keys) },
+		Func: func(ctx context.Context, n int) (int, error) {
+			k := n % keys
+			if atomic.AddInt32(&running[k], 1) > 1 {
+				t.Errorf("two inputs with key %d at once", k)
+			}
+			defer atomic.AddInt32(&running[k], -1)
+			var total int32
+			for i := range running {
+				total += atomic.LoadInt32(&running[i])
+			}
+			mu.Lock()
+			order[k] = append(order[k], n)
+			most = max(most, total)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			return n, nil
+		},
+	}
+	var inputs []int
+	for i := 0; i < 60; i++ {
+		inputs = append(inputs, i)
+	}
+	for _, o := range p.Map(context.Background(), inputs) {
+		if o.Err != nil || o.Out != o.In {
+			t.Fatalf("got %d, %v for %d", o.Out, o.Err, o.In)
+		}
+	}
+	for k, list := range order {
+		if !sort.IntsAreSorted(list) || len(list) != len(inputs)/keys {
+			t.Fatalf("key %d ran %v", k, list)
+		}
+	}
+	if most < 2 {
+		t.Fatal("different keys never ran together")
+	}
+}
+
+// Unordered, outputs come as they finish, before the inputs run out.
+func TestStreamUnordered(t *testing.T) {
+	release := make(chan struct{})
+	p := Pool[int, int]{
+		Threads: 2,
+		Func: func(ctx context.Context, n int) (int, error) {
+			if n == 0 {
+				<-release
+			}
+			return n, nil
+		},
+	}
+	inputs := make(chan int)
+	out := p.Stream(context.Background(), inputs)
+	inputs <- 0
+	inputs <- 1
+	if o := <-out; o.Index != 1 || o.Out != 1 {
+		t.Fatalf("first output is %+v; want input 1's", o)
+	}
+	close(release)
+	close(inputs)
+	if o := <-out; o.Index != 0 {
+		t.Fatalf("second output is %+v; want input 0's", o)
+	}
+	if o, ok := <-out; ok {
+		t.Fatalf("extra output %+v", o)
+	}
+}
+
+// Ordered, every input read has exactly one output, in order, even when
+// cancelled part way.
+func TestStreamOrderedCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := Pool[int, int]{
+		Threads: 4,
+		Ordered: true,
+		Func: func(ctx context.Context, n int) (int, error) {
+			if n == 20 {
+				cancel()
+			}
+			time.Sleep(time.Duration(n%3) * time.Millisecond)
+			return n, nil
+		},
+	}
+	inputs := make([]int, 500)
+	for i := range inputs {
+		inputs[i] = i
+	}
+	var next int
+	for o := range p.Stream(ctx, feed(inputs...)) {
+		if o.Index != next || o.In != next {
+			t.Fatalf("got output %d, want %d", o.Index, next)
+		}
+		next++
+	}
+	if next < 21 || next == len(inputs) {
+		t.Fatalf("got %d outputs", next)
+	}
+}
+
+// No more than QueueSize inputs wait beyond those running.
+func TestQueueSize(t *testing.T) {
+	release := make(chan struct{})
+	p := Pool[int, int]{
+		Threads:   1,
+		QueueSize: 2,
+		Func: func(ctx context.Context, n int) (int, error) {
+			<-release
+			return n, nil
+		},
+	}
+	var sent int32
+	inputs := make(chan int)
+	go func() {
+		defer close(inputs)
+		for i := 0; i < 10; i++ {
+			inputs <- i
+			atomic.AddInt32(&sent, 1)
+		}
+	}()
+	out := p.Stream(context.Background(), inputs)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&sent); n != 3 {
+		t.Fatalf("took %d inputs with 1 running and 2 queued", n)
+	}
+	close(release)
+	var n int
+	for range out {
+		n++
+	}
+	if n != 10 {
+		t.Fatalf("got %d outputs", n)
+	}
+}
@@ -1,39 +1,112 @@
 package task
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"sync"
 )
 
-type Task func() error
+type Task func(ctx context.Context) error
 
-func Run(tasks []Task, threads int) []error {
-	input := make(chan Task)
+type Options struct {
+	Threads int
+	// StopOnError cancels tasks not yet finished after the first failure.
+	StopOnError bool
+	// Progress, if set, is called after each task finishes, one at a time.
+	Progress func(done, total int)
+}
+
+// Result is the outcome of the task with the same index.
+type Result struct {
+	Index int
+	Err   error
+}
+
+// PanicError is a panic recovered from a task.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", p.Value, p.Stack)
+}
+
+func call(ctx context.Context, t Task) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return t(ctx)
+}
+
+// Run runs tasks concurrently, returning one result per task in input
+// order. Tasks not started by the time ctx is done, or after a failure
+// with StopOnError, fail with the context's error.
+func Run(ctx context.Context, tasks []Task, o Options) []Result {
+	if o.Threads < 1 {
+		o.Threads = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]Result, len(tasks))
+	input := make(chan int)
 	go func() {
-		for _, task := range tasks {
-			input <- task
+		defer close(input)
+		for i := range tasks {
+			select {
+			case input <- i:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(input)
 	}()
 	var wg sync.WaitGroup
-	results := make(chan error)
-	for i := 0; i < threads; i++ {
+	var lock sync.Mutex
+	started := make([]bool, len(tasks))
+	var done int
+	for i := 0; i < o.Threads; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for task := range input {
-				results <- task()
+			for i := range input {
+				lock.Lock()
+				started[i] = true
+				lock.Unlock()
+				err := call(ctx, tasks[i])
+				lock.Lock()
+				results[i] = Result{Index: i, Err: err}
+				done++
+				if err != nil && o.StopOnError {
+					cancel()
+				}
+				if o.Progress != nil {
+					o.Progress(done, len(tasks))
+				}
+				lock.Unlock()
 			}
 		}()
 	}
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-	var errors []error
-	for e := range results {
-		if e != nil {
-			errors = append(errors, e)
+	wg.Wait()
+	for i := range results {
+		if !started[i] {
+			results[i] = Result{Index: i, Err: ctx.Err()}
+		}
+	}
+	return results
+}
+
+// Errors combines the failures among results, labeled by task index, or
+// returns nil if there were none.
+func Errors(results []Result) error {
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("task %d: %w", r.Index, r.Err))
 		}
 	}
-	return errors
+	return errors.Join(errs...)
 }
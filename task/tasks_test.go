@@ -0,0 +1,87 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var tasks []Task
+	for i := 0; i < 20; i++ {
+		i := i
+		tasks = append(tasks, func(ctx context.Context) error {
+			switch i {
+			case 3:
+				return errors.New("three")
+			case 5:
+				panic("five")
+			}
+			return nil
+		})
+	}
+	var calls, last int
+	results := Run(context.Background(), tasks, Options{
+		Threads: 4,
+		Progress: func(done, total int) {
+			calls++
+			if done != last+1 || total != len(tasks) {
+				t.Errorf("progress %d/%d after %d", done, total, last)
+			}
+			last = done
+		},
+	})
+	if calls != len(tasks) {
+		t.Fatalf("progress called %d times for %d tasks", calls, len(tasks))
+	}
+	for i, r := range results {
+		if r.Index != i {
+			t.Fatalf("result %d is for task %d", i, r.Index)
+		}
+		if (r.Err != nil) != (i == 3 || i == 5) {
+			t.Fatalf("task %d: %v", i, r.Err)
+		}
+	}
+	var pe PanicError
+	if !errors.As(results[5].Err, &pe) || pe.Value != "five" {
+		t.Fatalf("got %v, want the panic", results[5].Err)
+	}
+	err := Errors(results)
+	if err == nil || !errors.As(err, &pe) {
+		t.Fatalf("errors are %v", err)
+	}
+	if Errors(results[:3]) != nil {
+		t.Fatal("errors among successes")
+	}
+}
+
+// After a failure with StopOnError, running tasks see their context done
+// and the rest never start.
+func TestRunStopOnError(t *testing.T) {
+	var started int32
+	tasks := make([]Task, 100)
+	for i := range tasks {
+		i := i
+		tasks[i] = func(ctx context.Context) error {
+			atomic.AddInt32(&started, 1)
+			if i == 2 {
+				return errors.New("two")
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Millisecond):
+				return nil
+			}
+		}
+	}
+	results := Run(context.Background(), tasks, Options{Threads: 2, StopOnError: true})
+	if n := atomic.LoadInt32(&started); n > 10 {
+		t.Fatalf("%d tasks started after the failure", n)
+	}
+	if results[2].Err == nil || !errors.Is(results[len(results)-1].Err, context.Canceled) {
+		t.Fatalf("got %v and %v", results[2].Err, results[len(results)-1].Err)
+	}
+}
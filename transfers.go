@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xoba/sms/audit"
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/store"
+)
+
+// Transfers tracks each patient's records on their way to a new PCP:
+//
+//	-m transfers list [state]
+//	-m transfers advance <patient> <state> [pcp=<name>] [phone=<number>] [fax=<number>] [note...]
+//	-m transfers sync
+//	-m transfers report
+//
+// where the states are requested, pcp-received, authorized, sent and
+// confirmed. advance takes the pcp from the patient's replies, or from
+// pcp=, phone= and fax= for one given by phone, fax or letter. sync requests a transfer for every patient contacted in the
+// campaign and marks the pcp received for those whose replies gave one,
+// and report lists patients still lacking a destination by -deadline.
+func Transfers(ctx context.Context, c Config) error {
+	s, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("transfers needs a command: list, advance, sync, or report")
+	}
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "list":
+		var state jin.TransferState
+		if len(args) > 0 {
+			if state, err = jin.ParseTransferState(args[0]); err != nil {
+				return err
+			}
+		}
+		all, err := jin.LoadTransfers(ctx, s)
+		if err != nil {
+			return err
+		}
+		counts := make(map[jin.TransferState]int)
+		for _, t := range sortedTransfers(all) {
+			counts[t.State]++
+			if state != jin.NoTransfer && t.State != state {
+				continue
+			}
+			var to string
+			if t.PCP != nil {
+				to = t.PCP.String()
+			}
+			fmt.Printf("%-12s %-13s %s %s\n", t.Patient, t.State, t.Updated().Format(time.RFC3339), to)
+		}
+		for _, x := range jin.TransferStates {
+			fmt.Printf("%d %s; ", counts[x], x)
+		}
+		fmt.Printf("%d total\n", len(all))
+	case "advance":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: advance <patient> <state> [pcp=<name>] [phone=<number>] [fax=<number>] [note...]")
+		}
+		state, err := jin.ParseTransferState(args[1])
+		if err != nil {
+			return err
+		}
+		pcp, note, err := parsePCPArgs(args[2:])
+		if err != nil {
+			return err
+		}
+		a, err := startAudit(ctx, c, s)
+		if err != nil {
+			return err
+		}
+		t, err := advanceTransfer(ctx, s, a, args[0], state, pcp, note)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("transfer for %s is %s\n", t.Patient, t.State)
+	case "sync":
+		if c.audit, err = startAudit(ctx, c, s); err != nil {
+			return err
+		}
+		return SyncTransfers(ctx, c, s)
+	case "report":
+		return TransferReport(ctx, c, s)
+	default:
+		return fmt.Errorf("unknown transfers command: %q", cmd)
+	}
+	return nil
+}
+
+func operator() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return store.Owner()
+}
+
+func sortedTransfers(m map[string]*jin.Transfer) []*jin.Transfer {
+	var out []*jin.Transfer
+	for _, t := range m {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Patient < out[j].Patient
+	})
+	return out
+}
+
+// parsePCPArgs splits advance's arguments into the pcp they give, if
+// any, and the note.
+func parsePCPArgs(args []string) (*jin.PCP, string, error) {
+	var pcp *jin.PCP
+	var note []string
+	for _, a := range args {
+		k, v, ok := strings.Cut(a, "=")
+		if !ok || (k != "pcp" && k != "phone" && k != "fax") {
+			note = append(note, a)
+			continue
+		}
+		if pcp == nil {
+			pcp = new(jin.PCP)
+		}
+		if k == "pcp" {
+			pcp.Name = v
+			continue
+		}
+		n, err := jin.CleanNumber(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("bad pcp %s: %w", k, err)
+		}
+		if k == "phone" {
+			pcp.Phone = n
+		} else {
+			pcp.Fax = n
+		}
+	}
+	return pcp, strings.Join(note, " "), nil
+}
+
+// advanceTransfer moves a patient's transfer forward, taking the pcp
+// from replies attached to the patient, if any, with what's given
+// filling in or correcting it.
+func advanceTransfer(ctx context.Context, s store.Store, a *audit.Log, patient string, state jin.TransferState, given *jin.PCP, note string) (*jin.Transfer, error) {
+	r, err := jin.LoadPatientRecord(ctx, s, patient)
+	if err != nil {
+		return nil, err
+	}
+	var changed bool
+	t, err := jin.UpdateTransfer(ctx, s, patient, func(t *jin.Transfer) (bool, error) {
+		pcp := r.PCP
+		if given != nil {
+			var merged jin.PCP
+			switch {
+			case t.PCP != nil:
+				merged = *t.PCP
+			case r.PCP != nil:
+				merged = *r.PCP
+			}
+			if given.Name != "" {
+				merged.Name = given.Name
+			}
+			if given.Phone != "" {
+				merged.Phone = given.Phone
+			}
+			if given.Fax != "" {
+				merged.Fax = given.Fax
+			}
+			pcp = &merged
+		}
+		changed, err = t.Advance(state, pcp, operator(), note)
+		return changed, err
+	})
+	if err != nil || !changed {
+		return t, err
+	}
+	entry := map[string]interface{}{
+		"patient":  patient,
+		"transfer": t.State,
+		"by":       operator(),
+		"note":     note,
+	}
+	if given != nil {
+		entry["pcp"] = "given"
+	}
+	return t, a.Append(ctx, audit.Status, entry)
+}
+
+// SyncTransfers brings transfers up to date with receipts and replies.
+func SyncTransfers(ctx context.Context, c Config, s store.Store) error {
+	contacts, err := jin.LoadContacts(ctx, s)
+	if err != nil {
+		return err
+	}
+	receipts, err := loadReceipts(ctx, s, *c.campaign)
+	if err != nil {
+		return err
+	}
+	all, err := jin.LoadTransfers(ctx, s)
+	if err != nil {
+		return err
+	}
+	var requested, received int
+	for _, i := range contacts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		decisions, err := i.Decisions()
+		if err != nil {
+			return err
+		}
+		var contacted bool
+		for _, d := range decisions {
+			d.Campaign = c.campaign.Name
+			contacted = contacted || receipts[d.Key()] || receipts[d.LegacyKey()]
+		}
+		t := all[i.ID]
+		if t == nil {
+			if !contacted {
+				continue
+			}
+			if t, err = advanceTransfer(ctx, s, c.audit, i.ID, jin.Requested, nil, "notified in campaign "+c.campaign.Name); err != nil {
+				return err
+			}
+			requested++
+		}
+		if t.State != jin.Requested {
+			continue
+		}
+		r, err := jin.LoadPatientRecord(ctx, s, i.ID)
+		if err != nil {
+			return err
+		}
+		if r.PCP == nil {
+			continue
+		}
+		if _, err := advanceTransfer(ctx, s, c.audit, i.ID, jin.PCPReceived, nil, "from replies"); err != nil {
+			return err
+		}
+		received++
+	}
+	fmt.Printf("requested %d transfers, %d with a pcp received\n", requested, received)
+	return nil
+}
+
+// TransferReport lists patients whose records have nowhere to go, and
+// how long is left before the deadline. Their names, mobiles and emails
+// are masked unless -unsafe-log is given.
+func TransferReport(ctx context.Context, c Config, s store.Store) error {
+	if c.Deadline == "" {
+		return fmt.Errorf("report needs a -deadline")
+	}
+	deadline, err := time.ParseInLocation("2006-01-02", c.Deadline, time.Local)
+	if err != nil {
+		return err
+	}
+	contacts, err := jin.LoadContacts(ctx, s)
+	if err != nil {
+		return err
+	}
+	all, err := jin.LoadTransfers(ctx, s)
+	if err != nil {
+		return err
+	}
+	var missing int
+	for _, i := range contacts {
+		t := all[i.ID]
+		if t != nil && t.HasDestination() {
+			continue
+		}
+		missing++
+		state := "no transfer"
+		if t != nil {
+			state = string(t.State)
+		}
+		fmt.Printf("%-12s %-20s %-13s %s %s\n", i.ID, c.pii(i.First+" "+i.Last), state, c.pii(string(i.Mobile)), c.pii(string(i.Email)))
+	}
+	left := time.Until(deadline)
+	switch {
+	case left > 0:
+		fmt.Printf("%d of %d patients have no destination, with %.0f days to the %s deadline\n",
+			missing, len(contacts), left.Hours()/24, c.Deadline)
+	default:
+		fmt.Printf("%d of %d patients had no destination by the %s deadline\n", missing, len(contacts), c.Deadline)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/xoba/sms/jin"
+	"github.com/xoba/sms/store"
+)
+
+func TestParsePCPArgs(t *testing.T) {
+	pcp, note, err := parsePCPArgs([]string{"pcp=Dr. Li", "called", "fax=(212) 688-8887", "in", "x=y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pcp != (jin.PCP{Name: "Dr. Li", Fax: "+12126888887"}) || note != "called in x=y" {
+		t.Fatalf("got %v, %q", pcp, note)
+	}
+	if pcp, note, err = parsePCPArgs([]string{"just", "a", "note"}); pcp != nil || note != "just a note" || err != nil {
+		t.Fatalf("got %v, %q, %v", pcp, note, err)
+	}
+	if _, _, err = parsePCPArgs([]string{"phone=none"}); err == nil {
+		t.Fatal("took a bad number")
+	}
+}
+
+// A pcp given by phone or fax is a destination, even with no replies.
+func TestAdvanceTransferGiven(t *testing.T) {
+	ctx := context.Background()
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := advanceTransfer(ctx, s, nil, "p1", jin.PCPReceived, nil, ""); err == nil {
+		t.Fatal("advanced with no destination")
+	}
+	x, err := advanceTransfer(ctx, s, nil, "p1", jin.PCPReceived, &jin.PCP{Fax: "+12126888887"}, "faxed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.State != jin.PCPReceived {
+		t.Fatalf("got %s", x.State)
+	}
+	x, err = advanceTransfer(ctx, s, nil, "p1", jin.PCPReceived, &jin.PCP{Name: "Dr. Li"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.PCP.Name != "Dr. Li" || x.PCP.Fax != "+12126888887" {
+		t.Fatalf("name didn't fill in the pcp: %v", x.PCP)
+	}
+	saved, err := jin.LoadTransfer(ctx, s, "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *saved.PCP != *x.PCP {
+		t.Fatalf("saved %v", saved.PCP)
+	}
+}